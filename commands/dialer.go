@@ -70,6 +70,12 @@ func (cmdListDialers) Execute(args ...string) error {
 		fmt.Printf("  - name: %s\n", dialer.Name)
 		fmt.Printf("    type: %s\n", dialer.Type)
 		fmt.Printf("    destination: %s\n", dialer.Destination)
+		if len(dialer.State) > 0 {
+			fmt.Printf("    state: %s\n", dialer.State)
+		}
+		if dialer.CoolingDown {
+			fmt.Printf("    cooling_down: true\n")
+		}
 	}
 	return nil
 }
@@ -0,0 +1,287 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+)
+
+func init() {
+	RegisterCommand("list-dns-cache", cmdListDNSCache{})
+	RegisterCommand("flush-dns-cache", cmdFlushDNSCache{})
+	RegisterCommand("add-dns-zone", (&cmdAddDNSZone{}).Init())
+	RegisterCommand("list-dns-zones", cmdListDNSZones{})
+	RegisterCommand("remove-dns-zone", cmdRemoveDNSZone{})
+	RegisterCommand("add-host", (&cmdAddHost{}).Init())
+	RegisterCommand("list-hosts", cmdListHosts{})
+	RegisterCommand("remove-host", cmdRemoveHost{})
+	RegisterCommand("dns-log", (&cmdDNSLog{}).Init())
+}
+
+type cmdListDNSCache struct{}
+
+func (cmdListDNSCache) Execute(args ...string) error {
+	entries, err := control.Client().ListDNSCache()
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("entries: []")
+		return nil
+	}
+
+	fmt.Println("entries:")
+	for _, entry := range entries {
+		fmt.Printf("  - name: %s\n", entry.Name)
+		fmt.Printf("    type: %s\n", entry.Type)
+		fmt.Printf("    rcode: %s\n", entry.Rcode)
+		if entry.Negative {
+			fmt.Println("    negative: true")
+		}
+		fmt.Printf("    ttl: %d\n", entry.TTL)
+		fmt.Printf("    hits: %d\n", entry.Hits)
+		fmt.Printf("    proxy: %s\n", entry.Proxy)
+	}
+	return nil
+}
+
+type cmdFlushDNSCache struct{}
+
+func (cmdFlushDNSCache) Execute(args ...string) error {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	removed := 0
+	for _, name := range args {
+		result, err := control.Client().FlushDNSCache(name)
+		if err != nil {
+			return err
+		}
+		removed += result.Removed
+	}
+	fmt.Printf("removed: %d\n", removed)
+	return nil
+}
+
+type cmdAddDNSZone struct {
+	flags  *flag.FlagSet
+	dialer string
+}
+
+func (cmd *cmdAddDNSZone) Init() *cmdAddDNSZone {
+	cmd.flags = flag.NewFlagSet("add-dns-zone", flag.ContinueOnError)
+	cmd.flags.StringVar(&cmd.dialer, "dialer", "", "the dialer used to connect to the target (default: the dialer of the DNS proxy)")
+	cmd.flags.Usage = func() {
+		fmt.Println("\nUsage: sshtunnel add-dns-zone [options] zone target")
+		fmt.Println("\nQueries for the zone and its subdomains are forwarded to the target (host[:port]).")
+		cmd.flags.PrintDefaults()
+	}
+	return cmd
+}
+
+func (cmd *cmdAddDNSZone) Execute(args ...string) error {
+	cmd.flags.Parse(args)
+
+	if cmd.flags.NArg() != 2 {
+		cmd.flags.Usage()
+		return nil
+	}
+
+	return control.Client().AddDNSZone(control.DNSZone{
+		Zone:   cmd.flags.Arg(0),
+		Target: cmd.flags.Arg(1),
+		Dialer: cmd.dialer,
+	})
+}
+
+type cmdListDNSZones struct{}
+
+func (cmdListDNSZones) Execute(args ...string) error {
+	zones, err := control.Client().ListDNSZones()
+	if err != nil {
+		return err
+	}
+
+	if len(zones) == 0 {
+		fmt.Println("zones: []")
+		return nil
+	}
+
+	fmt.Println("zones:")
+	for _, zone := range zones {
+		fmt.Printf("  - zone: %s\n", zone.Zone)
+		fmt.Printf("    target: %s\n", zone.Target)
+		if len(zone.Dialer) > 0 {
+			fmt.Printf("    dialer: %s\n", zone.Dialer)
+		}
+	}
+	return nil
+}
+
+type cmdRemoveDNSZone struct{}
+
+func (cmdRemoveDNSZone) Execute(args ...string) error {
+	if len(args) == 0 {
+		fmt.Println("\nUsage: sshtunnel remove-dns-zone zone...")
+		return nil
+	}
+	for _, zone := range args {
+		if err := control.Client().RemoveDNSZone(zone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cmdAddHost struct {
+	flags      *flag.FlagSet
+	recordType string
+	file       string
+}
+
+func (cmd *cmdAddHost) Init() *cmdAddHost {
+	cmd.flags = flag.NewFlagSet("add-host", flag.ContinueOnError)
+	cmd.flags.StringVar(&cmd.recordType, "type", "", "A, AAAA, CNAME or PTR (default: derived from the value)")
+	cmd.flags.StringVar(&cmd.file, "file", "", "load the records from a file in the format of /etc/hosts")
+	cmd.flags.Usage = func() {
+		fmt.Println("\nUsage: sshtunnel add-host [options] name value")
+		fmt.Println("       sshtunnel add-host -file hosts")
+		fmt.Println("\nThe DNS proxies answer queries for the name using the value (an IP")
+		fmt.Println("address or the target of a CNAME record). Use '*.domain' for wildcards.")
+		cmd.flags.PrintDefaults()
+	}
+	return cmd
+}
+
+func (cmd *cmdAddHost) Execute(args ...string) error {
+	cmd.flags.Parse(args)
+
+	if len(cmd.file) > 0 {
+		file, err := filepath.Abs(cmd.file)
+		if err != nil {
+			return err
+		}
+		result, err := control.Client().LoadDNSHosts(control.DNSHostsFile{File: file})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("loaded %d hosts from %s\n", result.Hosts, result.File)
+		return nil
+	}
+
+	if cmd.flags.NArg() != 2 {
+		cmd.flags.Usage()
+		return nil
+	}
+
+	return control.Client().AddDNSHost(control.DNSHost{
+		Name:  cmd.flags.Arg(0),
+		Type:  cmd.recordType,
+		Value: cmd.flags.Arg(1),
+	})
+}
+
+type cmdListHosts struct{}
+
+func (cmdListHosts) Execute(args ...string) error {
+	hosts, err := control.Client().ListDNSHosts()
+	if err != nil {
+		return err
+	}
+
+	if len(hosts) == 0 {
+		fmt.Println("hosts: []")
+		return nil
+	}
+
+	fmt.Println("hosts:")
+	for _, host := range hosts {
+		fmt.Printf("  - name: %s\n", host.Name)
+		fmt.Printf("    type: %s\n", host.Type)
+		fmt.Printf("    value: %s\n", host.Value)
+		if len(host.Source) > 0 {
+			fmt.Printf("    source: %s\n", host.Source)
+		}
+	}
+	return nil
+}
+
+type cmdRemoveHost struct{}
+
+func (cmdRemoveHost) Execute(args ...string) error {
+	if len(args) == 0 {
+		fmt.Println("\nUsage: sshtunnel remove-host name...")
+		return nil
+	}
+	for _, name := range args {
+		if err := control.Client().RemoveDNSHost(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cmdDNSLog struct {
+	flags  *flag.FlagSet
+	filter control.DNSLogFilter
+	follow bool
+}
+
+func (cmd *cmdDNSLog) Init() *cmdDNSLog {
+	cmd.flags = flag.NewFlagSet("dns-log", flag.ContinueOnError)
+	cmd.flags.StringVar(&cmd.filter.Name, "name", "", "show the queries for this domain and its subdomains")
+	cmd.flags.StringVar(&cmd.filter.Type, "type", "", "show the queries of this type (like A or AAAA)")
+	cmd.flags.StringVar(&cmd.filter.Rcode, "rcode", "", "show the queries with this response code (like NXDOMAIN)")
+	cmd.flags.StringVar(&cmd.filter.Client, "client", "", "show the queries of this client IP address")
+	cmd.flags.StringVar(&cmd.filter.Proxy, "proxy", "", "show the queries of the DNS proxy with this address")
+	cmd.flags.IntVar(&cmd.filter.Limit, "limit", 50, "show the last queries (0: all)")
+	cmd.flags.BoolVar(&cmd.follow, "follow", false, "wait for new queries and show them")
+	cmd.flags.Usage = func() {
+		fmt.Println("\nUsage: sshtunnel dns-log [options]")
+		fmt.Println("\nShows the queries answered by the DNS proxies.")
+		cmd.flags.PrintDefaults()
+	}
+	return cmd
+}
+
+func (cmd *cmdDNSLog) Execute(args ...string) error {
+	if err := cmd.flags.Parse(args); err != nil {
+		return nil
+	}
+
+	filter := cmd.filter
+	for {
+		entries, err := control.Client().ListDNSLog(filter)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			printDNSLogEntry(entry)
+			filter.Since = entry.Seq
+		}
+		if !cmd.follow {
+			return nil
+		}
+		// all new entries are shown while following
+		filter.Limit = 0
+		time.Sleep(time.Second)
+	}
+}
+
+func printDNSLogEntry(entry control.DNSLogEntry) {
+	source := entry.Upstream
+	if entry.Cached {
+		source = "cache"
+	}
+	line := fmt.Sprintf("%s %-15s %-5s %-8s %s %s %.1fms",
+		entry.Time.Local().Format("15:04:05.000"), entry.Client, entry.Type,
+		entry.Rcode, entry.Name, source, entry.LatencyMS)
+	if len(entry.Error) > 0 {
+		line += " error: " + entry.Error
+	}
+	fmt.Println(line)
+}
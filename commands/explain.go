@@ -0,0 +1,116 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+)
+
+func init() {
+	RegisterCommand("explain", (&cmdExplain{}).Init())
+}
+
+type cmdExplain struct {
+	flags   *flag.FlagSet
+	profile string
+}
+
+func (cmd *cmdExplain) Init() *cmdExplain {
+	cmd.flags = flag.NewFlagSet("explain", flag.ContinueOnError)
+	cmd.flags.StringVar(&cmd.profile, "profile", "", "use this profile instead of the active one")
+	cmd.flags.Usage = func() {
+		fmt.Println("\nUsage: sshtunnel explain [options] host|ip[:port]")
+		cmd.flags.PrintDefaults()
+	}
+	return cmd
+}
+
+func (cmd *cmdExplain) Execute(args ...string) error {
+	cmd.flags.Parse(args)
+
+	if 1 != cmd.flags.NArg() {
+		cmd.flags.Usage()
+		return nil
+	}
+
+	explanation, err := control.Client().Explain(cmd.flags.Arg(0), cmd.profile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("target: %s\n", explanation.Target)
+	fmt.Printf("profile: %s\n", explanation.Profile)
+	if len(explanation.Addresses) > 0 {
+		fmt.Println("addresses:")
+		for _, address := range explanation.Addresses {
+			fmt.Printf("  - %s\n", address)
+		}
+	}
+	if len(explanation.Lookups) > 0 {
+		fmt.Println("lookups:")
+		for _, lookup := range explanation.Lookups {
+			fmt.Printf("  - mode: %s\n", lookup.Mode)
+			if len(lookup.Address) > 0 {
+				fmt.Printf("    address: %s\n", lookup.Address)
+			}
+			if len(lookup.Error) > 0 {
+				fmt.Printf("    error: %s\n", lookup.Error)
+			}
+		}
+	}
+	if dns := explanation.DNSProxy; dns != nil {
+		fmt.Println("dns_proxy:")
+		fmt.Printf("  target: %s\n", dns.Target)
+		for _, address := range dns.Addresses {
+			fmt.Printf("  address: %s\n", address)
+		}
+		if len(dns.Error) > 0 {
+			fmt.Printf("  error: %s\n", dns.Error)
+		}
+	}
+
+	if len(explanation.Rules) == 0 {
+		fmt.Println("rules: []")
+	} else {
+		fmt.Println("rules:")
+		for _, rule := range explanation.Rules {
+			printRuleTarget(rule.Rule)
+			fmt.Printf("    dialer: %s\n", rule.Dialer)
+			fmt.Printf("    matched: %v\n", rule.Matched)
+		}
+	}
+
+	if explanation.Dialer == nil {
+		fmt.Println("dialer: direct (no rule matched)")
+		return nil
+	}
+	if len(explanation.DialAddress) > 0 {
+		fmt.Printf("dial_address: %s\n", explanation.DialAddress)
+	}
+	if len(explanation.DialError) > 0 {
+		fmt.Printf("dial_error: %s\n", explanation.DialError)
+	}
+	fmt.Println("dialer:")
+	printExplainDialer("  ", "  ", *explanation.Dialer)
+	if len(explanation.Fallbacks) > 0 {
+		fmt.Println("fallbacks:")
+		for _, fallback := range explanation.Fallbacks {
+			printExplainDialer("  - ", "    ", fallback)
+		}
+	}
+	return nil
+}
+
+func printExplainDialer(first, prefix string, dialer control.Dialer) {
+	fmt.Printf("%sname: %s\n", first, dialer.Name)
+	if len(dialer.Type) > 0 {
+		fmt.Printf("%stype: %s\n", prefix, dialer.Type)
+	}
+	if len(dialer.State) > 0 {
+		fmt.Printf("%sstate: %s\n", prefix, dialer.State)
+	}
+	if dialer.CoolingDown {
+		fmt.Printf("%scooling_down: true\n", prefix)
+	}
+}
@@ -4,46 +4,91 @@
 package commands
 
 import (
+	"flag"
 	"fmt"
+	"net"
+	"strings"
 
 	"github.com/dueckminor/go-sshtunnel/control"
 )
 
 func init() {
-	RegisterCommand("iptables-script", cmdIptablesScript{})
+	RegisterCommand("iptables-script", (&cmdIptablesScript{}).Init())
 }
 
-type cmdIptablesScript struct{}
+type cmdIptablesScript struct {
+	flags *flag.FlagSet
+	mode  string
+}
 
-func (cmdIptablesScript) Execute(args ...string) error {
-	fmt.Print(`#!/usr/bin/env bash
-set -e
+func (cmd *cmdIptablesScript) Init() *cmdIptablesScript {
+	cmd.flags = flag.NewFlagSet("iptables-script", flag.ContinueOnError)
+	cmd.flags.StringVar(&cmd.mode, "mode", "redirect", "redirect (for the transparent proxy) or tproxy (for the tproxy proxy)")
+	cmd.flags.Usage = func() {
+		fmt.Println("\nUsage: sshtunnel iptables-script [options]")
+		cmd.flags.PrintDefaults()
+	}
+	return cmd
+}
 
-sudo iptables-save | grep -v sshtunnel | grep -v "^-A PREROUTING" | sudo iptables-restore
-`)
+func (cmd *cmdIptablesScript) Execute(args ...string) error {
+	if err := cmd.flags.Parse(args); err != nil {
+		return nil
+	}
 
 	c := control.Client()
 	proxies, err := c.ListProxies()
 	if err != nil {
 		return err
 	}
-	rules, err := c.ListRules()
+	rules, err := c.ListRules("")
 	if err != nil {
 		return err
 	}
 
 	transparentPort := 0
+	tproxyPort := 0
 	dnsPort := 0
+	dnsUpstream := ""
 
 	for _, proxy := range proxies {
 		switch proxy.ProxyType {
 		case "transparent":
 			transparentPort = proxy.ProxyPort
+		case "tproxy":
+			tproxyPort = proxy.ProxyPort
 		case "dns":
 			dnsPort = proxy.ProxyPort
+			dnsUpstream = proxy.ProxyParameters
+			// connections to fake IP addresses are mapped back to the host
+			// names by the transparent proxies
+			if pool := proxy.Options["fake-ip"]; len(pool) > 0 {
+				rules = append(rules, control.Rule{CIDR: pool, Dialer: "fake-ip"})
+			}
 		}
 	}
 
+	switch cmd.mode {
+	case "redirect":
+		printRedirectScript(rules, transparentPort, dnsPort, dnsUpstream)
+	case "tproxy":
+		if tproxyPort == 0 {
+			return fmt.Errorf("there is no running proxy of type 'tproxy'")
+		}
+		printTProxyScript(rules, tproxyPort, dnsPort, dnsUpstream)
+	default:
+		return fmt.Errorf("unknown mode '%s'", cmd.mode)
+	}
+	return nil
+}
+
+func printRedirectScript(rules []control.Rule, transparentPort, dnsPort int, dnsUpstream string) {
+	fmt.Print(`#!/usr/bin/env bash
+set -e
+
+sudo iptables-save | grep -v sshtunnel | grep -v "^-A PREROUTING" | sudo iptables-restore
+`)
+
 	fmt.Print(`
 sudo iptables -t nat -N sshtunnel
 sudo iptables -t nat -F sshtunnel
@@ -53,23 +98,143 @@ sudo iptables -t nat -I PREROUTING 1 -j sshtunnel
 `)
 
 	for _, rule := range rules {
-		if rule.Dialer == "direct" {
+		if len(rule.CIDR) == 0 {
+			continue
+		}
+		if isDirect(rule) {
 			fmt.Printf("sudo iptables -t nat -A sshtunnel -j ACCEPT --dest %s -p tcp\n", rule.CIDR)
 			fmt.Printf("sudo iptables -t nat -A PREROUTING -i eth0 -p tcp --dest %s -j ACCEPT\n", rule.CIDR)
 		}
 	}
 
 	for _, rule := range rules {
-		if rule.Dialer != "direct" {
+		if len(rule.CIDR) == 0 {
+			continue
+		}
+		if !isDirect(rule) {
 			fmt.Printf("sudo iptables -t nat -A sshtunnel -j REDIRECT --dest %s -p tcp --to-ports %d\n", rule.CIDR, transparentPort)
 			fmt.Printf("sudo iptables -t nat -A PREROUTING -i eth0 -p tcp --dest %s -j REDIRECT --to-ports %d\n", rule.CIDR, transparentPort)
 		}
 	}
 
 	if dnsPort > 0 {
-		fmt.Printf("sudo iptables -t nat -A sshtunnel -p udp --dport 53 -j REDIRECT --to-ports %d\n", dnsPort)
-		fmt.Printf("sudo iptables -t nat -A PREROUTING -i eth0 -p udp --dport 53 -j REDIRECT --to-ports %d\n", dnsPort)
+		printDNSUpstreamExclusion(dnsUpstream)
+		for _, protocol := range []string{"udp", "tcp"} {
+			fmt.Printf("sudo iptables -t nat -A sshtunnel -p %s --dport 53 -j REDIRECT --to-ports %d\n", protocol, dnsPort)
+			fmt.Printf("sudo iptables -t nat -A PREROUTING -i eth0 -p %s --dport 53 -j REDIRECT --to-ports %d\n", protocol, dnsPort)
+		}
 	}
+}
 
-	return nil
+// Packets with the firewall mark tproxyMark are routed to the local machine
+// using the routing table tproxyTable, so that TPROXY can divert them
+const (
+	tproxyMark  = "0x1/0x1"
+	tproxyTable = 100
+)
+
+// printTProxyScript prints the mangle rules for the tproxy proxy. Forwarded
+// packets are diverted in PREROUTING. Local packets are marked in OUTPUT, so
+// that the policy routing sends them through the loopback interface and they
+// get diverted in PREROUTING as well.
+func printTProxyScript(rules []control.Rule, tproxyPort, dnsPort int, dnsUpstream string) {
+	fmt.Print(`#!/usr/bin/env bash
+set -e
+
+sudo iptables-save -t mangle | grep -v sshtunnel | sudo iptables-restore -T mangle
+sudo ip6tables-save -t mangle | grep -v sshtunnel | sudo ip6tables-restore -T mangle
+sudo iptables-save -t nat | grep -v sshtunnel | sudo iptables-restore -T nat
+`)
+
+	fmt.Println()
+	for _, family := range []struct{ ip, iptables, local string }{
+		{"ip", "iptables", "0.0.0.0/0"},
+		{"ip -6", "ip6tables", "::/0"},
+	} {
+		fmt.Printf("sudo %s rule del fwmark %s lookup %d 2>/dev/null || true\n", family.ip, tproxyMark, tproxyTable)
+		fmt.Printf("sudo %s rule add fwmark %s lookup %d\n", family.ip, tproxyMark, tproxyTable)
+		fmt.Printf("sudo %s route replace local %s dev lo table %d\n", family.ip, family.local, tproxyTable)
+		fmt.Printf("sudo %s -t mangle -N sshtunnel\n", family.iptables)
+		fmt.Printf("sudo %s -t mangle -I PREROUTING 1 -j sshtunnel\n", family.iptables)
+		fmt.Printf("sudo %s -t mangle -N sshtunnel-output\n", family.iptables)
+		fmt.Printf("sudo %s -t mangle -I OUTPUT 1 -j sshtunnel-output\n", family.iptables)
+		// packets of established connections are delivered to the socket
+		fmt.Printf("sudo %s -t mangle -A sshtunnel -p tcp -m socket --transparent -j MARK --set-mark %s\n", family.iptables, tproxyMark)
+		fmt.Printf("sudo %s -t mangle -A sshtunnel -p tcp -m socket --transparent -j RETURN\n", family.iptables)
+		fmt.Println()
+	}
+
+	for _, rule := range rules {
+		if len(rule.CIDR) == 0 || !isDirect(rule) {
+			continue
+		}
+		iptables := iptablesFor(rule.CIDR)
+		fmt.Printf("sudo %s -t mangle -A sshtunnel -p tcp --dest %s -j RETURN\n", iptables, rule.CIDR)
+		fmt.Printf("sudo %s -t mangle -A sshtunnel-output -p tcp --dest %s -j RETURN\n", iptables, rule.CIDR)
+	}
+
+	for _, rule := range rules {
+		if len(rule.CIDR) == 0 || isDirect(rule) {
+			continue
+		}
+		iptables := iptablesFor(rule.CIDR)
+		fmt.Printf("sudo %s -t mangle -A sshtunnel -p tcp --dest %s -j TPROXY --on-port %d --tproxy-mark %s\n",
+			iptables, rule.CIDR, tproxyPort, tproxyMark)
+		fmt.Printf("sudo %s -t mangle -A sshtunnel-output -p tcp --dest %s -j MARK --set-mark %s\n",
+			iptables, rule.CIDR, tproxyMark)
+	}
+
+	if dnsPort > 0 {
+		fmt.Print(`
+sudo iptables -t nat -N sshtunnel
+sudo iptables -t nat -I OUTPUT 1 -j sshtunnel
+sudo iptables -t nat -I PREROUTING 1 -j sshtunnel
+`)
+		printDNSUpstreamExclusion(dnsUpstream)
+		for _, protocol := range []string{"udp", "tcp"} {
+			fmt.Printf("sudo iptables -t nat -A sshtunnel -p %s --dport 53 -j REDIRECT --to-ports %d\n", protocol, dnsPort)
+		}
+	}
+}
+
+// printDNSUpstreamExclusion prevents that the TCP requests of the DNS proxy
+// to its upstreams get redirected to the DNS proxy itself. The upstreams are
+// a comma separated list, each optionally followed by "@dialer".
+func printDNSUpstreamExclusion(dnsUpstreams string) {
+	for _, dnsUpstream := range strings.Split(dnsUpstreams, ",") {
+		dnsUpstream = strings.TrimSpace(dnsUpstream)
+		if at := strings.LastIndex(dnsUpstream, "@"); at >= 0 {
+			dnsUpstream = dnsUpstream[:at]
+		}
+		if strings.Contains(dnsUpstream, "://") {
+			// DNS over TLS and DNS over HTTPS don't use port 53
+			continue
+		}
+		host, port, err := net.SplitHostPort(dnsUpstream)
+		if err != nil {
+			host, port = dnsUpstream, "53"
+		}
+		if len(host) == 0 {
+			// the default upstream of the DNS proxy
+			host = "127.0.0.53"
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+			continue
+		}
+		fmt.Printf("sudo iptables -t nat -A sshtunnel -p tcp --dest %s --dport %s -j RETURN\n", host, port)
+	}
+}
+
+// iptablesFor returns the iptables command handling the address family of
+// cidr
+func iptablesFor(cidr string) string {
+	if strings.Contains(cidr, ":") {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// isDirect checks if the first dialer of a rule is the direct dialer
+func isDirect(rule control.Rule) bool {
+	return strings.SplitN(rule.Dialer, ",", 2)[0] == "direct"
 }
@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+)
+
+func init() {
+	RegisterCommand("use-profile", cmdUseProfile{})
+	RegisterCommand("list-profiles", cmdListProfiles{})
+}
+
+type cmdUseProfile struct{}
+
+func (cmdUseProfile) Execute(args ...string) error {
+	if len(args) != 1 {
+		fmt.Println("\nUsage: sshtunnel use-profile name")
+		return nil
+	}
+	return control.Client().UseProfile(args[0])
+}
+
+type cmdListProfiles struct{}
+
+func (cmdListProfiles) Execute(args ...string) error {
+	profiles, err := control.Client().ListProfiles()
+	if err != nil {
+		return err
+	}
+	if len(profiles) == 0 {
+		fmt.Println("profiles: []")
+		return nil
+	}
+	fmt.Println("profiles:")
+	for _, profile := range profiles {
+		fmt.Printf("  - name: %s\n", profile.Name)
+		fmt.Printf("    active: %v\n", profile.Active)
+		fmt.Printf("    rules: %d\n", profile.Rules)
+	}
+	return nil
+}
@@ -3,27 +3,183 @@ package commands
 import (
 	"flag"
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/dueckminor/go-sshtunnel/control"
 )
 
 func init() {
-	RegisterCommand("start-proxy", cmdStartProxy{})
+	RegisterCommand("start-proxy", (&cmdStartProxy{}).Init())
 	RegisterCommand("list-proxies", cmdListProxies{})
+	RegisterCommand("stop-proxy", cmdStopProxy{})
+	RegisterCommand("restart-proxy", (&cmdRestartProxy{}).Init())
 }
 
-type cmdStartProxy struct{}
+// optionsFlag collects repeated "-o key=value" flags
+type optionsFlag map[string]string
+
+func (options optionsFlag) String() string {
+	return ""
+}
+
+func (options optionsFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return fmt.Errorf("expected key=value, got '%s'", value)
+	}
+	options[parts[0]] = parts[1]
+	return nil
+}
+
+type cmdStartProxy struct {
+	flags   *flag.FlagSet
+	profile string
+	listen  string
+	options optionsFlag
+}
+
+func (cmd *cmdStartProxy) Init() *cmdStartProxy {
+	cmd.flags = flag.NewFlagSet("start-proxy", flag.ContinueOnError)
+	cmd.flags.StringVar(&cmd.profile, "profile", "", "bind the proxy to this profile instead of the active one")
+	cmd.flags.StringVar(&cmd.listen, "listen", "", "listen on this address (host:port, port or unix socket path)")
+	cmd.options = make(optionsFlag)
+	cmd.flags.Var(cmd.options, "o", "set an option of the proxy type (key=value, repeatable)")
+	cmd.flags.Usage = func() {
+		fmt.Println("\nUsage: sshtunnel start-proxy [options] type [parameters]")
+		cmd.flags.PrintDefaults()
+	}
+	return cmd
+}
+
+func (cmd *cmdStartProxy) Execute(args ...string) error {
+	cmd.flags.Parse(args)
+
+	if 0 == cmd.flags.NArg() {
+		cmd.flags.Usage()
+		return nil
+	}
 
-func (cmdStartProxy) Execute(args ...string) error {
 	parameters := ""
-	if len(args) > 1 {
-		parameters = args[1]
+	if cmd.flags.NArg() > 1 {
+		parameters = cmd.flags.Arg(1)
 	}
 
-	flag.Parse()
+	absFileOptions(cmd.options)
 
-	_, err := control.Client().StartProxy(args[0], parameters)
-	return err
+	proxy, err := control.Client().StartProxy(control.Proxy{
+		ProxyType:       cmd.flags.Arg(0),
+		ProxyParameters: parameters,
+		Profile:         cmd.profile,
+		Listen:          cmd.listen,
+		Options:         cmd.options,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("started proxy %s on %s\n", proxy.ID, proxy.Address)
+	return nil
+}
+
+// absFileOptions makes the file names passed as proxy options absolute, as
+// the daemon may run in a different working directory
+func absFileOptions(options optionsFlag) {
+	for _, key := range []string{"users", "cert", "key", "client-ca", "ca", "log-file"} {
+		if file := options[key]; len(file) > 0 {
+			if abs, err := filepath.Abs(file); err == nil {
+				options[key] = abs
+			}
+		}
+	}
+}
+
+type cmdStopProxy struct{}
+
+func (cmdStopProxy) Execute(args ...string) error {
+	if len(args) == 0 {
+		fmt.Println("\nUsage: sshtunnel stop-proxy id...")
+		return nil
+	}
+	for _, id := range args {
+		if err := control.Client().StopProxy(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cmdRestartProxy struct {
+	flags   *flag.FlagSet
+	profile string
+	listen  string
+	options optionsFlag
+}
+
+func (cmd *cmdRestartProxy) Init() *cmdRestartProxy {
+	cmd.flags = flag.NewFlagSet("restart-proxy", flag.ContinueOnError)
+	cmd.flags.StringVar(&cmd.profile, "profile", "", "bind the proxy to this profile")
+	cmd.flags.StringVar(&cmd.listen, "listen", "", "listen on this address (host:port, port or unix socket path)")
+	cmd.options = make(optionsFlag)
+	cmd.flags.Var(cmd.options, "o", "set an option of the proxy type (key=value, repeatable, an empty value removes it)")
+	cmd.flags.Usage = func() {
+		fmt.Println("\nUsage: sshtunnel restart-proxy [options] id [parameters]")
+		fmt.Println("\nThe proxy keeps its current parameters and profile unless new ones are given.")
+		cmd.flags.PrintDefaults()
+	}
+	return cmd
+}
+
+func (cmd *cmdRestartProxy) Execute(args ...string) error {
+	cmd.flags.Parse(args)
+
+	if 0 == cmd.flags.NArg() {
+		cmd.flags.Usage()
+		return nil
+	}
+	id := cmd.flags.Arg(0)
+
+	proxies, err := control.Client().ListProxies()
+	if err != nil {
+		return err
+	}
+	var request *control.Proxy
+	for i := range proxies {
+		if proxies[i].ID == id {
+			request = &proxies[i]
+		}
+	}
+	if request == nil {
+		return fmt.Errorf("there is no proxy with id '%s'", id)
+	}
+
+	if cmd.flags.NArg() > 1 {
+		request.ProxyParameters = cmd.flags.Arg(1)
+	}
+	if len(cmd.profile) > 0 {
+		request.Profile = cmd.profile
+	}
+	if len(cmd.listen) > 0 {
+		request.Listen = cmd.listen
+	}
+	absFileOptions(cmd.options)
+	for key, value := range cmd.options {
+		if request.Options == nil {
+			request.Options = make(map[string]string)
+		}
+		if len(value) == 0 {
+			delete(request.Options, key)
+		} else {
+			request.Options[key] = value
+		}
+	}
+
+	proxy, err := control.Client().RestartProxy(id, *request)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restarted proxy %s on %s\n", proxy.ID, proxy.Address)
+	return nil
 }
 
 type cmdListProxies struct{}
@@ -42,7 +198,41 @@ func (cmdListProxies) Execute(args ...string) error {
 
 	fmt.Println("proxies:")
 	for _, proxy := range proxies {
-		fmt.Printf("  - type: %s\n    port: %d\n", proxy.ProxyType, proxy.ProxyPort)
+		fmt.Printf("  - id: %s\n    type: %s\n    port: %d\n", proxy.ID, proxy.ProxyType, proxy.ProxyPort)
+		fmt.Printf("    address: %s\n", proxy.Address)
+		if len(proxy.Options) > 0 {
+			keys := make([]string, 0, len(proxy.Options))
+			for key := range proxy.Options {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			fmt.Println("    options:")
+			for _, key := range keys {
+				fmt.Printf("      %s: %s\n", key, proxy.Options[key])
+			}
+		}
+		if len(proxy.ProxyParameters) > 0 {
+			fmt.Printf("    params: %s\n", proxy.ProxyParameters)
+		}
+		if len(proxy.Profile) > 0 {
+			fmt.Printf("    profile: %s\n", proxy.Profile)
+		}
+		if len(proxy.Upstreams) > 0 {
+			fmt.Println("    upstreams:")
+			for _, upstream := range proxy.Upstreams {
+				fmt.Printf("      - target: %s\n", upstream.Target)
+				if len(upstream.Dialer) > 0 {
+					fmt.Printf("        dialer: %s\n", upstream.Dialer)
+				}
+				fmt.Printf("        healthy: %v\n", upstream.Healthy)
+				if upstream.RTTMS > 0 {
+					fmt.Printf("        rtt: %.1fms\n", upstream.RTTMS)
+				}
+				if len(upstream.LastError) > 0 {
+					fmt.Printf("        error: %s\n", upstream.LastError)
+				}
+			}
+		}
 	}
 
 	return err
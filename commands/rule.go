@@ -3,6 +3,7 @@ package commands
 import (
 	"flag"
 	"fmt"
+	"net"
 
 	"github.com/dueckminor/go-sshtunnel/control"
 )
@@ -13,11 +14,13 @@ func init() {
 }
 
 type cmdListRules struct {
-	flags *flag.FlagSet
+	flags   *flag.FlagSet
+	profile string
 }
 
 func (cmd *cmdListRules) Init() *cmdListRules {
 	cmd.flags = flag.NewFlagSet("list-rules", flag.ContinueOnError)
+	cmd.flags.StringVar(&cmd.profile, "profile", "", "list the rules of this profile instead of the active one")
 	defUsage := cmd.flags.Usage
 	cmd.flags.Usage = func() {
 		defUsage()
@@ -27,7 +30,7 @@ func (cmd *cmdListRules) Init() *cmdListRules {
 
 func (cmd *cmdListRules) Execute(args ...string) error {
 	cmd.flags.Parse(args)
-	rules, err := control.Client().ListRules()
+	rules, err := control.Client().ListRules(cmd.profile)
 	if err != nil {
 		return err
 	}
@@ -36,22 +39,45 @@ func (cmd *cmdListRules) Execute(args ...string) error {
 	}
 	fmt.Println("rules:")
 	for _, rule := range rules {
-		fmt.Printf("  - cidr: %s\n", rule.CIDR)
+		printRuleTarget(rule)
 		fmt.Printf("    dialer: %s\n", rule.Dialer)
+		if len(rule.Resolve) > 0 {
+			fmt.Printf("    resolve: %s\n", rule.Resolve)
+		}
+		if rule.RemoteLookup {
+			fmt.Printf("    remote_lookup: true\n")
+		}
+		if len(rule.Source) > 0 {
+			fmt.Printf("    source: %s\n", rule.Source)
+		}
 	}
 	return nil
 }
 
+func printRuleTarget(rule control.Rule) {
+	if len(rule.Domain) > 0 {
+		fmt.Printf("  - domain: %s\n", rule.Domain)
+	} else {
+		fmt.Printf("  - cidr: %s\n", rule.CIDR)
+	}
+}
+
 type cmdAddRule struct {
-	flags  *flag.FlagSet
-	dialer string
+	flags        *flag.FlagSet
+	dialer       string
+	profile      string
+	resolve      string
+	remoteLookup bool
 }
 
 func (cmd *cmdAddRule) Init() *cmdAddRule {
 	cmd.flags = flag.NewFlagSet("add-rule", flag.ContinueOnError)
-	cmd.flags.StringVar(&cmd.dialer, "dialer", "default", "the dialer which shall be used if the rule matches")
+	cmd.flags.StringVar(&cmd.dialer, "dialer", "default", "the dialer which shall be used if the rule matches, or a comma separated list of dialers which are tried in order")
+	cmd.flags.StringVar(&cmd.profile, "profile", "", "add the rule to this profile instead of the active one")
+	cmd.flags.StringVar(&cmd.resolve, "resolve", "", "where host names are resolved: local, dns (the DNS proxy) or remote (the ssh server)")
+	cmd.flags.BoolVar(&cmd.remoteLookup, "remote-lookup", false, "resolve host names over the ssh session to match the cidr (requires -resolve remote)")
 	cmd.flags.Usage = func() {
-		fmt.Println("\nUsage: sshtunnel add-rule [options] cidr...")
+		fmt.Println("\nUsage: sshtunnel add-rule [options] cidr|domain...")
 		cmd.flags.PrintDefaults()
 	}
 	return cmd
@@ -65,10 +91,17 @@ func (cmd *cmdAddRule) Execute(args ...string) error {
 		return nil
 	}
 
-	for _, cidr := range cmd.flags.Args() {
+	for _, target := range cmd.flags.Args() {
 		rule := control.Rule{
-			CIDR:   cidr,
-			Dialer: cmd.dialer,
+			Dialer:       cmd.dialer,
+			Resolve:      cmd.resolve,
+			RemoteLookup: cmd.remoteLookup,
+			Profile:      cmd.profile,
+		}
+		if isCIDR(target) {
+			rule.CIDR = target
+		} else {
+			rule.Domain = target
 		}
 		err := control.Client().AddRule(rule)
 		if err != nil {
@@ -77,3 +110,10 @@ func (cmd *cmdAddRule) Execute(args ...string) error {
 	}
 	return nil
 }
+
+func isCIDR(target string) bool {
+	if _, _, err := net.ParseCIDR(target); err == nil {
+		return true
+	}
+	return net.ParseIP(target) != nil
+}
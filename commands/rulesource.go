@@ -0,0 +1,96 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+)
+
+func init() {
+	RegisterCommand("add-rule-source", (&cmdAddRuleSource{}).Init())
+	RegisterCommand("list-rule-sources", cmdListRuleSources{})
+	RegisterCommand("remove-rule-source", cmdRemoveRuleSource{})
+}
+
+type cmdAddRuleSource struct {
+	flags    *flag.FlagSet
+	source   control.RuleSource
+	interval string
+}
+
+func (cmd *cmdAddRuleSource) Init() *cmdAddRuleSource {
+	cmd.flags = flag.NewFlagSet("add-rule-source", flag.ContinueOnError)
+	cmd.flags.StringVar(&cmd.source.Name, "name", "", "the name of the rule source (default: the location)")
+	cmd.flags.StringVar(&cmd.source.Dialer, "dialer", "default", "the dialer for all entries which don't specify a dialer")
+	cmd.flags.StringVar(&cmd.source.Profile, "profile", "", "add the rules to this profile instead of the active one")
+	cmd.flags.StringVar(&cmd.source.Format, "format", "", "one of cidr, json or yaml (default: derived from the location)")
+	cmd.flags.StringVar(&cmd.interval, "interval", "5m", "the refresh interval")
+	cmd.flags.Usage = func() {
+		fmt.Println("\nUsage: sshtunnel add-rule-source [options] file|url")
+		cmd.flags.PrintDefaults()
+	}
+	return cmd
+}
+
+func (cmd *cmdAddRuleSource) Execute(args ...string) error {
+	cmd.flags.Parse(args)
+
+	if 1 != cmd.flags.NArg() {
+		cmd.flags.Usage()
+		return nil
+	}
+
+	source := cmd.source
+	source.Interval = cmd.interval
+	source.Location = cmd.flags.Arg(0)
+	if !strings.Contains(source.Location, "://") {
+		// the daemon has a different working directory
+		location, err := filepath.Abs(source.Location)
+		if err != nil {
+			return err
+		}
+		source.Location = location
+	}
+
+	return control.Client().AddRuleSource(source)
+}
+
+type cmdListRuleSources struct{}
+
+func (cmdListRuleSources) Execute(args ...string) error {
+	sources, err := control.Client().ListRuleSources()
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		fmt.Println("sources: []")
+		return nil
+	}
+	fmt.Println("sources:")
+	for _, source := range sources {
+		fmt.Printf("  - name: %s\n", source.Name)
+		fmt.Printf("    location: %s\n", source.Location)
+		fmt.Printf("    profile: %s\n", source.Profile)
+		fmt.Printf("    interval: %s\n", source.Interval)
+		fmt.Printf("    rules: %d\n", source.Rules)
+		fmt.Printf("    last_refresh: %s\n", source.LastRefresh.Format(time.RFC3339))
+		if len(source.Error) > 0 {
+			fmt.Printf("    error: %s\n", source.Error)
+		}
+	}
+	return nil
+}
+
+type cmdRemoveRuleSource struct{}
+
+func (cmdRemoveRuleSource) Execute(args ...string) error {
+	if len(args) != 1 {
+		fmt.Println("\nUsage: sshtunnel remove-rule-source name")
+		return nil
+	}
+	return control.Client().RemoveRuleSource(args[0])
+}
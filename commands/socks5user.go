@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+	"github.com/manifoldco/promptui"
+)
+
+func init() {
+	RegisterCommand("add-socks5-user", (&cmdAddSocks5User{}).Init())
+	RegisterCommand("list-socks5-users", cmdListSocks5Users{})
+	RegisterCommand("remove-socks5-user", cmdRemoveSocks5User{})
+}
+
+type cmdAddSocks5User struct {
+	flags   *flag.FlagSet
+	dialers string
+}
+
+func (cmd *cmdAddSocks5User) Init() *cmdAddSocks5User {
+	cmd.flags = flag.NewFlagSet("add-socks5-user", flag.ContinueOnError)
+	cmd.flags.StringVar(&cmd.dialers, "dialer", "", "comma separated list of the dialers the user may use (default: all)")
+	cmd.flags.Usage = func() {
+		fmt.Println("\nUsage: sshtunnel add-socks5-user [options] name [password]")
+		fmt.Println("\nIf no password is given, it is read from the terminal.")
+		cmd.flags.PrintDefaults()
+	}
+	return cmd
+}
+
+func (cmd *cmdAddSocks5User) Execute(args ...string) error {
+	cmd.flags.Parse(args)
+
+	if 0 == cmd.flags.NArg() {
+		cmd.flags.Usage()
+		return nil
+	}
+
+	password := cmd.flags.Arg(1)
+	if len(password) == 0 {
+		prompt := promptui.Prompt{
+			Label: "Password",
+			Mask:  '•',
+		}
+		var err error
+		password, err = prompt.Run()
+		if err != nil {
+			return err
+		}
+	}
+
+	return control.Client().AddSocks5User(control.Socks5User{
+		Name:     cmd.flags.Arg(0),
+		Password: password,
+		Dialers:  cmd.dialers,
+	})
+}
+
+type cmdListSocks5Users struct{}
+
+func (cmdListSocks5Users) Execute(args ...string) error {
+	users, err := control.Client().ListSocks5Users()
+	if err != nil {
+		return err
+	}
+
+	if len(users) == 0 {
+		fmt.Println("users: []")
+		return nil
+	}
+
+	fmt.Println("users:")
+	for _, user := range users {
+		fmt.Printf("  - name: %s\n", user.Name)
+		if len(user.Dialers) > 0 {
+			fmt.Printf("    dialers: %s\n", user.Dialers)
+		}
+	}
+	return nil
+}
+
+type cmdRemoveSocks5User struct{}
+
+func (cmdRemoveSocks5User) Execute(args ...string) error {
+	if len(args) == 0 {
+		fmt.Println("\nUsage: sshtunnel remove-socks5-user name...")
+		return nil
+	}
+	for _, name := range args {
+		if err := control.Client().RemoveSocks5User(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package commands
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/dueckminor/go-sshtunnel/proxy"
+)
+
+func init() {
+	RegisterCommand("udp-relay", cmdUDPRelay{})
+}
+
+// cmdUDPRelay runs the UDP relay in the foreground. It is started on the
+// remote side of an ssh dialer to carry the datagrams of SOCKS5 UDP
+// associations.
+type cmdUDPRelay struct{}
+
+func (cmdUDPRelay) Execute(args ...string) error {
+	listen := proxy.DefaultUDPRelayAddress
+	if len(args) > 0 {
+		listen = args[0]
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	fmt.Println("UDP relay listening on", listener.Addr())
+	return proxy.ServeUDPRelay(listener)
+}
@@ -1,5 +1,7 @@
 package control
 
+import "time"
+
 // API is the intrace of the REST API
 type API interface {
 	Health() (bool, error)
@@ -9,16 +11,47 @@ type API interface {
 	AddSSHKey(encodedKey string, passPhrase string) error
 	ListKeys() ([]SSHKey, error)
 	//// Proxies ////
-	StartProxy(proxyType string, proxyParameter string) (Proxy, error)
+	StartProxy(proxy Proxy) (Proxy, error)
 	ListProxies() ([]Proxy, error)
+	StopProxy(id string) error
+	RestartProxy(id string, proxy Proxy) (Proxy, error)
+	ListSocks5Users() ([]Socks5User, error)
+	AddSocks5User(user Socks5User) error
+	RemoveSocks5User(name string) error
+	//// DNS ////
+	ListDNSCache() ([]DNSCacheEntry, error)
+	FlushDNSCache(name string) (DNSCacheFlush, error)
+	ListDNSZones() ([]DNSZone, error)
+	AddDNSZone(zone DNSZone) error
+	RemoveDNSZone(zone string) error
+	ListDNSHosts() ([]DNSHost, error)
+	AddDNSHost(host DNSHost) error
+	RemoveDNSHost(name string) error
+	LoadDNSHosts(file DNSHostsFile) (DNSHostsFile, error)
+	ListDNSLog(filter DNSLogFilter) ([]DNSLogEntry, error)
 	//// Dialer ////
 	AddDialer(uri string) error
 	ListDialers() ([]Dialer, error)
 	Connect(in ConnectIn) (out ConnectOut, err error)
 
 	//// Rules ////
-	ListRules() ([]Rule, error)
+	ListRules(profile string) ([]Rule, error)
 	AddRule(rule Rule) error
+
+	ListRuleSources() ([]RuleSource, error)
+	AddRuleSource(source RuleSource) error
+	RemoveRuleSource(name string) error
+
+	Explain(target string, profile string) (Explanation, error)
+
+	//// Profiles ////
+	ListProfiles() ([]Profile, error)
+	UseProfile(name string) error
+}
+
+// Error is the transport format of failed requests
+type Error struct {
+	Message string `json:"error"`
 }
 
 // Health is the transport format of the GET /health endpoint
@@ -30,6 +63,7 @@ type Health struct {
 type Status struct {
 	Health
 	Proxies []Proxy `json:"proxies"`
+	Profile string  `json:"profile"`
 }
 
 // SSHKey is the transport format of the POST /ssh/keys endpoint
@@ -45,17 +79,202 @@ type SSHTarget struct {
 	URI string `json:"uri"`
 }
 
-// Proxy is the transport format of the POST /proxies endpoint
+// Proxy is the transport format of the /proxies endpoints
 type Proxy struct {
+	ID              string `json:"id,omitempty"`
 	ProxyType       string `json:"type"`
 	ProxyPort       int    `json:"port"`
 	ProxyParameters string `json:"params"`
+	Profile         string `json:"profile,omitempty"`
+	// Listen is the requested listen address: host:port, a port or the path
+	// of a unix socket
+	Listen string `json:"listen,omitempty"`
+	// Address is the address the proxy is actually bound to
+	Address string `json:"address,omitempty"`
+	// Options are specific to the proxy type
+	Options map[string]string `json:"options,omitempty"`
+	// Upstreams is the status of the upstreams of a DNS proxy
+	Upstreams []DNSUpstream `json:"upstreams,omitempty"`
+}
+
+// DNSUpstream is the status of an upstream of a DNS proxy
+type DNSUpstream struct {
+	Target string `json:"target"`
+	// Dialer is empty if the dialer of the DNS proxy is used
+	Dialer  string `json:"dialer,omitempty"`
+	Healthy bool   `json:"healthy"`
+	// RTTMS is the smoothed round trip time in milliseconds
+	RTTMS     float64 `json:"rtt_ms,omitempty"`
+	LastError string  `json:"last_error,omitempty"`
+}
+
+// Socks5User is the transport format of the /socks5/users endpoints
+type Socks5User struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+	// Dialers is a comma separated list of the dialers the user may use. If
+	// it is empty, all dialers are allowed.
+	Dialers string `json:"dialers,omitempty"`
 }
 
-// Rule defines which IP Addresses get forwarded to a dialer
+// DNSCacheEntry is the transport format of the GET /dns/cache endpoint
+type DNSCacheEntry struct {
+	Proxy string `json:"proxy"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	// Negative is set for cached NXDOMAIN and NODATA responses
+	Negative bool   `json:"negative,omitempty"`
+	Rcode    string `json:"rcode"`
+	// TTL is the remaining time in seconds
+	TTL  int `json:"ttl"`
+	Hits int `json:"hits"`
+}
+
+// DNSCacheFlush is the transport format of the DELETE /dns/cache endpoint
+type DNSCacheFlush struct {
+	Removed int `json:"removed"`
+}
+
+// DNSZone is the transport format of the /dns/zones endpoints. Queries for
+// the zone and its subdomains are forwarded to the target.
+type DNSZone struct {
+	Zone   string `json:"zone"`
+	Target string `json:"target"`
+	// Dialer is the name of the dialer used to connect to the target. If it
+	// is empty, the dialer of the DNS proxy is used.
+	Dialer string `json:"dialer,omitempty"`
+}
+
+// DNSHost is the transport format of the /dns/hosts endpoints. It is a local
+// record which is answered by the DNS proxies.
+type DNSHost struct {
+	Name string `json:"name"`
+	// Type is one of "A", "AAAA", "CNAME" or "PTR". If it is empty, it is
+	// derived from the value.
+	Type  string `json:"type,omitempty"`
+	Value string `json:"value"`
+	// Source is the hosts file the record has been loaded from
+	Source string `json:"source,omitempty"`
+}
+
+// DNSHostsFile is the transport format of the POST /dns/hosts/files
+// endpoint
+type DNSHostsFile struct {
+	File string `json:"file"`
+	// Hosts is the number of host names loaded from the file
+	Hosts int `json:"hosts"`
+}
+
+// DNSLogEntry is the transport format of the GET /dns/log endpoint
+type DNSLogEntry struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Proxy  string    `json:"proxy"`
+	Client string    `json:"client"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Rcode  string    `json:"rcode"`
+	// Upstream is the target which answered the query, "local" or "fake-ip"
+	Upstream  string  `json:"upstream,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	Cached    bool    `json:"cached,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// DNSLogFilter are the query parameters of the GET /dns/log endpoint. Empty
+// fields match all entries.
+type DNSLogFilter struct {
+	// Since selects the entries with a higher sequence number
+	Since uint64 `form:"since"`
+	// Name selects the queries for a domain and its subdomains
+	Name   string `form:"name"`
+	Type   string `form:"type"`
+	Rcode  string `form:"rcode"`
+	Client string `form:"client"`
+	Proxy  string `form:"proxy"`
+	// Limit selects the last entries matching the filter
+	Limit int `form:"limit"`
+}
+
+// Rule defines which IP Addresses or domains get forwarded to a dialer
 type Rule struct {
-	CIDR   string `json:"cidr"`
+	CIDR   string `json:"cidr,omitempty"`
+	Domain string `json:"domain,omitempty"`
 	Dialer string `json:"dialer"`
+	// Resolve is one of "local", "dns" or "remote". If it is empty, CIDR
+	// rules are matched using the local resolver and the host name is
+	// passed to the dialer.
+	Resolve      string `json:"resolve,omitempty"`
+	RemoteLookup bool   `json:"remote_lookup,omitempty"`
+	Profile      string `json:"profile,omitempty"`
+	Source       string `json:"source,omitempty"`
+}
+
+// RuleSource defines a file or URL from which rules are loaded periodically
+type RuleSource struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	// Format is one of "cidr" (one entry per line), "json" or "yaml". If it
+	// is empty, the format is derived from the location or content type.
+	Format   string `json:"format,omitempty"`
+	Dialer   string `json:"dialer,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	Interval string `json:"interval,omitempty"`
+
+	LastRefresh time.Time `json:"last_refresh,omitempty"`
+	Rules       int       `json:"rules"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// EvaluatedRule is a rule which has been checked by the explain endpoint
+type EvaluatedRule struct {
+	Rule
+	Matched bool `json:"matched"`
+}
+
+// ExplainDNS describes how the DNS proxy resolves a host name
+type ExplainDNS struct {
+	Target    string   `json:"target"`
+	Addresses []string `json:"addresses,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Lookup is a host name resolution done by the explain endpoint
+type Lookup struct {
+	Mode    string `json:"mode"`
+	Address string `json:"address,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Explanation is the transport format of the GET /explain endpoint. It
+// describes which rule and dialer would be used to connect to a target.
+type Explanation struct {
+	Target  string `json:"target"`
+	Profile string `json:"profile"`
+	// Addresses are the addresses the target host has been resolved to.
+	// Lookups are the resolutions needed to check the CIDR rules, the host
+	// name is not resolved otherwise.
+	Addresses []string        `json:"addresses,omitempty"`
+	Lookups   []Lookup        `json:"lookups,omitempty"`
+	DNSProxy  *ExplainDNS     `json:"dns_proxy,omitempty"`
+	Rules     []EvaluatedRule `json:"rules"`
+	Rule      *Rule           `json:"rule,omitempty"`
+	// DialAddress is the address passed to the dialer
+	DialAddress string `json:"dial_address,omitempty"`
+	DialError   string `json:"dial_error,omitempty"`
+	// Dialer is the selected dialer. If no rule matches, it is nil and the
+	// connection is established directly. Fallbacks are the other dialers of
+	// the rule in the order they are tried.
+	Dialer    *Dialer  `json:"dialer,omitempty"`
+	Fallbacks []Dialer `json:"fallbacks,omitempty"`
+}
+
+// Profile is a named set of rules. Proxies which are not bound to a specific
+// profile use the active one.
+type Profile struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	Rules  int    `json:"rules"`
 }
 
 // Dialer defines a dialer
@@ -63,6 +282,8 @@ type Dialer struct {
 	Name        string `json:"name"`
 	Type        string `json:"type"`
 	Destination string `json:"destination"`
+	State       string `json:"state,omitempty"`
+	CoolingDown bool   `json:"cooling_down,omitempty"`
 }
 
 type ConnectStatus string
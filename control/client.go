@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 )
 
 type clientAPI struct {
@@ -53,11 +57,8 @@ func (c clientAPI) Stop() (err error) {
 	return nil
 }
 
-func (c clientAPI) StartProxy(proxyType string, proxyParameter string) (proxyInfo Proxy, err error) {
-	err = c.PostJSON("/api/proxies", Proxy{
-		ProxyType:       proxyType,
-		ProxyParameters: proxyParameter,
-	}, &proxyInfo)
+func (c clientAPI) StartProxy(proxy Proxy) (proxyInfo Proxy, err error) {
+	err = c.PostJSON("/api/proxies", proxy, &proxyInfo)
 	return proxyInfo, err
 }
 
@@ -66,6 +67,73 @@ func (c clientAPI) ListProxies() (proxyInfos []Proxy, err error) {
 	return proxyInfos, err
 }
 
+func (c clientAPI) StopProxy(id string) error {
+	return c.SendJSON("DELETE", "/api/proxies/"+url.PathEscape(id), nil, nil)
+}
+
+func (c clientAPI) RestartProxy(id string, proxy Proxy) (proxyInfo Proxy, err error) {
+	err = c.SendJSON("PUT", "/api/proxies/"+url.PathEscape(id), proxy, &proxyInfo)
+	return proxyInfo, err
+}
+
+func (c clientAPI) ListSocks5Users() (users []Socks5User, err error) {
+	err = c.GetJSON("/api/socks5/users", &users)
+	return users, err
+}
+
+func (c clientAPI) AddSocks5User(user Socks5User) error {
+	return c.PostJSON("/api/socks5/users", user, nil)
+}
+
+func (c clientAPI) RemoveSocks5User(name string) error {
+	return c.SendJSON("DELETE", "/api/socks5/users/"+url.PathEscape(name), nil, nil)
+}
+
+func (c clientAPI) ListDNSCache() (entries []DNSCacheEntry, err error) {
+	err = c.GetJSON("/api/dns/cache", &entries)
+	return entries, err
+}
+
+func (c clientAPI) FlushDNSCache(name string) (result DNSCacheFlush, err error) {
+	path := "/api/dns/cache"
+	if len(name) > 0 {
+		path += "?name=" + url.QueryEscape(name)
+	}
+	err = c.SendJSON("DELETE", path, nil, &result)
+	return result, err
+}
+
+func (c clientAPI) ListDNSZones() (zones []DNSZone, err error) {
+	err = c.GetJSON("/api/dns/zones", &zones)
+	return zones, err
+}
+
+func (c clientAPI) AddDNSZone(zone DNSZone) error {
+	return c.PostJSON("/api/dns/zones", zone, nil)
+}
+
+func (c clientAPI) RemoveDNSZone(zone string) error {
+	return c.SendJSON("DELETE", "/api/dns/zones/"+url.PathEscape(zone), nil, nil)
+}
+
+func (c clientAPI) ListDNSHosts() (hosts []DNSHost, err error) {
+	err = c.GetJSON("/api/dns/hosts", &hosts)
+	return hosts, err
+}
+
+func (c clientAPI) AddDNSHost(host DNSHost) error {
+	return c.PostJSON("/api/dns/hosts", host, nil)
+}
+
+func (c clientAPI) RemoveDNSHost(name string) error {
+	return c.SendJSON("DELETE", "/api/dns/hosts/"+url.PathEscape(name), nil, nil)
+}
+
+func (c clientAPI) LoadDNSHosts(file DNSHostsFile) (result DNSHostsFile, err error) {
+	err = c.PostJSON("/api/dns/hosts/files", file, &result)
+	return result, err
+}
+
 func (c clientAPI) AddSSHKey(privateKey string, passphrase string) error {
 	return c.PostJSON("/api/ssh/keys", SSHKey{
 		PrivateKey: privateKey,
@@ -94,8 +162,39 @@ func (c clientAPI) Connect(in ConnectIn) (out ConnectOut, err error) {
 	return out, err
 }
 
-func (c clientAPI) ListRules() (rules []Rule, err error) {
-	err = c.GetJSON("/api/rules", &rules)
+func (c clientAPI) ListDNSLog(filter DNSLogFilter) (entries []DNSLogEntry, err error) {
+	query := url.Values{}
+	if filter.Since > 0 {
+		query.Set("since", strconv.FormatUint(filter.Since, 10))
+	}
+	for key, value := range map[string]string{
+		"name":   filter.Name,
+		"type":   filter.Type,
+		"rcode":  filter.Rcode,
+		"client": filter.Client,
+		"proxy":  filter.Proxy,
+	} {
+		if len(value) > 0 {
+			query.Set(key, value)
+		}
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	path := "/api/dns/log"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	err = c.GetJSON(path, &entries)
+	return entries, err
+}
+
+func (c clientAPI) ListRules(profile string) (rules []Rule, err error) {
+	path := "/api/rules"
+	if len(profile) > 0 {
+		path += "?profile=" + url.QueryEscape(profile)
+	}
+	err = c.GetJSON(path, &rules)
 	return rules, err
 }
 
@@ -104,6 +203,42 @@ func (c clientAPI) AddRule(rule Rule) error {
 	return err
 }
 
+func (c clientAPI) ListRuleSources() (sources []RuleSource, err error) {
+	err = c.GetJSON("/api/rules/sources", &sources)
+	return sources, err
+}
+
+func (c clientAPI) AddRuleSource(source RuleSource) error {
+	return c.PostJSON("/api/rules/sources", source, nil)
+}
+
+func (c clientAPI) RemoveRuleSource(name string) error {
+	query := url.Values{}
+	query.Set("name", name)
+	return c.SendJSON("DELETE", "/api/rules/sources?"+query.Encode(), nil, nil)
+}
+
+func (c clientAPI) Explain(target string, profile string) (explanation Explanation, err error) {
+	query := url.Values{}
+	query.Set("target", target)
+	if len(profile) > 0 {
+		query.Set("profile", profile)
+	}
+	err = c.GetJSON("/api/explain?"+query.Encode(), &explanation)
+	return explanation, err
+}
+
+func (c clientAPI) ListProfiles() (profiles []Profile, err error) {
+	err = c.GetJSON("/api/profiles", &profiles)
+	return profiles, err
+}
+
+func (c clientAPI) UseProfile(name string) error {
+	return c.SendJSON("PUT", "/api/profiles/active", Profile{
+		Name: name,
+	}, nil)
+}
+
 func (c clientAPI) MakeURL(path string) (url string) {
 	if len(path) > 0 && path[0] == '/' {
 		return "http://unix" + path
@@ -133,15 +268,23 @@ func (c clientAPI) GetJSON(path string, responseBody interface{}) error {
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(body, responseBody)
+	return c.decodeResponse(resp, body, responseBody)
 }
 
 func (c clientAPI) PostJSON(path string, requestBody interface{}, responseBody interface{}) error {
-	body, err := json.Marshal(requestBody)
-	if err != nil {
-		return err
+	return c.SendJSON("POST", path, requestBody, responseBody)
+}
+
+func (c clientAPI) SendJSON(method, path string, requestBody interface{}, responseBody interface{}) error {
+	var reader io.Reader
+	if requestBody != nil {
+		body, err := json.Marshal(requestBody)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewBuffer(body)
 	}
-	req, err := http.NewRequest("POST", c.MakeURL(path), bytes.NewBuffer(body))
+	req, err := http.NewRequest(method, c.MakeURL(path), reader)
 	if err != nil {
 		return err
 	}
@@ -151,10 +294,24 @@ func (c clientAPI) PostJSON(path string, requestBody interface{}, responseBody i
 		return err
 	}
 	defer resp.Body.Close()
-	body, err = ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
+	return c.decodeResponse(resp, body, responseBody)
+}
+
+func (c clientAPI) decodeResponse(resp *http.Response, body []byte, responseBody interface{}) error {
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiError := Error{}
+		if json.Unmarshal(body, &apiError) == nil && len(apiError.Message) > 0 {
+			return errors.New(apiError.Message)
+		}
+		return fmt.Errorf("request failed: %s", resp.Status)
+	}
+	if responseBody == nil || len(body) == 0 {
+		return nil
+	}
 	return json.Unmarshal(body, responseBody)
 }
 
@@ -11,6 +11,12 @@ type server struct {
 	impl API
 }
 
+func abortWithError(c *gin.Context, httpResponseCode int, err error) {
+	c.AbortWithStatusJSON(httpResponseCode, Error{
+		Message: err.Error(),
+	})
+}
+
 func (s server) Health(c *gin.Context) {
 	healthy, err := s.impl.Health()
 	httpResponseCode := http.StatusOK
@@ -37,8 +43,167 @@ func (s server) PostProxies(c *gin.Context) {
 	if err != nil {
 		return
 	}
-	response, err := s.impl.StartProxy(request.ProxyType, request.ProxyParameters)
+	response, err := s.impl.StartProxy(request)
 	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) PutProxy(c *gin.Context) {
+	request := Proxy{}
+	err := c.BindJSON(&request)
+	if err != nil {
+		return
+	}
+	response, err := s.impl.RestartProxy(c.Param("id"), request)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) DeleteProxy(c *gin.Context) {
+	err := s.impl.StopProxy(c.Param("id"))
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+}
+
+func (s server) GetSocks5Users(c *gin.Context) {
+	response, err := s.impl.ListSocks5Users()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) PostSocks5Users(c *gin.Context) {
+	user := Socks5User{}
+	err := c.BindJSON(&user)
+	if err != nil {
+		return
+	}
+	err = s.impl.AddSocks5User(user)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+}
+
+func (s server) DeleteSocks5User(c *gin.Context) {
+	err := s.impl.RemoveSocks5User(c.Param("name"))
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+}
+
+func (s server) GetDNSCache(c *gin.Context) {
+	response, err := s.impl.ListDNSCache()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) DeleteDNSCache(c *gin.Context) {
+	response, err := s.impl.FlushDNSCache(c.Query("name"))
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) GetDNSZones(c *gin.Context) {
+	response, err := s.impl.ListDNSZones()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) PostDNSZones(c *gin.Context) {
+	zone := DNSZone{}
+	err := c.BindJSON(&zone)
+	if err != nil {
+		return
+	}
+	err = s.impl.AddDNSZone(zone)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+}
+
+func (s server) DeleteDNSZone(c *gin.Context) {
+	err := s.impl.RemoveDNSZone(c.Param("zone"))
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+}
+
+func (s server) GetDNSHosts(c *gin.Context) {
+	response, err := s.impl.ListDNSHosts()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) PostDNSHosts(c *gin.Context) {
+	host := DNSHost{}
+	err := c.BindJSON(&host)
+	if err != nil {
+		return
+	}
+	err = s.impl.AddDNSHost(host)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+}
+
+func (s server) DeleteDNSHost(c *gin.Context) {
+	err := s.impl.RemoveDNSHost(c.Param("name"))
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+}
+
+func (s server) PostDNSHostsFiles(c *gin.Context) {
+	file := DNSHostsFile{}
+	err := c.BindJSON(&file)
+	if err != nil {
+		return
+	}
+	response, err := s.impl.LoadDNSHosts(file)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) GetDNSLog(c *gin.Context) {
+	filter := DNSLogFilter{}
+	err := c.BindQuery(&filter)
+	if err != nil {
+		return
+	}
+	response, err := s.impl.ListDNSLog(filter)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 	c.AbortWithStatusJSON(http.StatusOK, response)
@@ -119,8 +284,9 @@ func (s server) PostTargets(c *gin.Context) {
 }
 
 func (s server) GetRules(c *gin.Context) {
-	response, err := s.impl.ListRules()
+	response, err := s.impl.ListRules(c.Query("profile"))
 	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 	c.AbortWithStatusJSON(http.StatusOK, response)
@@ -134,6 +300,70 @@ func (s server) PostRules(c *gin.Context) {
 	}
 	err = s.impl.AddRule(rule)
 	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+}
+
+func (s server) GetRuleSources(c *gin.Context) {
+	response, err := s.impl.ListRuleSources()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) PostRuleSources(c *gin.Context) {
+	source := RuleSource{}
+	err := c.BindJSON(&source)
+	if err != nil {
+		return
+	}
+	err = s.impl.AddRuleSource(source)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+}
+
+// DeleteRuleSource takes the name as query parameter, as the names of
+// sources are usually paths or URLs
+func (s server) DeleteRuleSource(c *gin.Context) {
+	err := s.impl.RemoveRuleSource(c.Query("name"))
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+}
+
+func (s server) GetExplain(c *gin.Context) {
+	response, err := s.impl.Explain(c.Query("target"), c.Query("profile"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) GetProfiles(c *gin.Context) {
+	response, err := s.impl.ListProfiles()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, response)
+}
+
+func (s server) PutActiveProfile(c *gin.Context) {
+	profile := Profile{}
+	err := c.BindJSON(&profile)
+	if err != nil {
+		return
+	}
+	err = s.impl.UseProfile(profile.Name)
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err)
 		return
 	}
 }
@@ -144,6 +374,21 @@ func (s server) createGinEngine() *gin.Engine {
 	r.GET("/api/status", s.Status)
 	r.GET("/api/proxies", s.GetProxies)
 	r.POST("/api/proxies", s.PostProxies)
+	r.PUT("/api/proxies/:id", s.PutProxy)
+	r.DELETE("/api/proxies/:id", s.DeleteProxy)
+	r.GET("/api/socks5/users", s.GetSocks5Users)
+	r.POST("/api/socks5/users", s.PostSocks5Users)
+	r.DELETE("/api/socks5/users/:name", s.DeleteSocks5User)
+	r.GET("/api/dns/cache", s.GetDNSCache)
+	r.DELETE("/api/dns/cache", s.DeleteDNSCache)
+	r.GET("/api/dns/zones", s.GetDNSZones)
+	r.POST("/api/dns/zones", s.PostDNSZones)
+	r.DELETE("/api/dns/zones/:zone", s.DeleteDNSZone)
+	r.GET("/api/dns/hosts", s.GetDNSHosts)
+	r.POST("/api/dns/hosts", s.PostDNSHosts)
+	r.DELETE("/api/dns/hosts/:name", s.DeleteDNSHost)
+	r.POST("/api/dns/hosts/files", s.PostDNSHostsFiles)
+	r.GET("/api/dns/log", s.GetDNSLog)
 	r.GET("/api/ssh/keys", s.GetKeys)
 	r.POST("/api/ssh/keys", s.PostKeys)
 	r.POST("/api/ssh/connect", s.Connect)
@@ -154,6 +399,12 @@ func (s server) createGinEngine() *gin.Engine {
 	r.POST("/api/targets", s.PostTargets)
 	r.GET("/api/rules", s.GetRules)
 	r.POST("/api/rules", s.PostRules)
+	r.GET("/api/rules/sources", s.GetRuleSources)
+	r.POST("/api/rules/sources", s.PostRuleSources)
+	r.DELETE("/api/rules/sources", s.DeleteRuleSource)
+	r.GET("/api/explain", s.GetExplain)
+	r.GET("/api/profiles", s.GetProfiles)
+	r.PUT("/api/profiles/active", s.PutActiveProfile)
 	return r
 }
 
@@ -0,0 +1,56 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sourcesAPI implements the rule source functions of the API, all other
+// functions panic
+type sourcesAPI struct {
+	API
+	sources map[string]bool
+}
+
+func (api *sourcesAPI) RemoveRuleSource(name string) error {
+	if !api.sources[name] {
+		return fmt.Errorf("there is no rule source with name '%s'", name)
+	}
+	delete(api.sources, name)
+	return nil
+}
+
+func TestRemoveRuleSource(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	api := &sourcesAPI{sources: map[string]bool{
+		"/etc/sshtunnel/rules.yaml":      true,
+		"https://example.com/rules.yaml": true,
+	}}
+	ts := httptest.NewServer(server{impl: api}.createGinEngine())
+	defer ts.Close()
+
+	client := clientAPI{httpClient: http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "tcp", ts.Listener.Addr().String())
+		},
+	}}}
+
+	// the default names of file and URL sources contain slashes
+	for _, name := range []string{"/etc/sshtunnel/rules.yaml", "https://example.com/rules.yaml"} {
+		if err := client.RemoveRuleSource(name); err != nil {
+			t.Errorf("RemoveRuleSource(%s) failed: %v", name, err)
+		}
+	}
+	if len(api.sources) != 0 {
+		t.Errorf("the sources %v have not been removed", api.sources)
+	}
+	if err := client.RemoveRuleSource("/etc/sshtunnel/rules.yaml"); err == nil {
+		t.Errorf("removing an unknown source succeeded")
+	}
+}
@@ -0,0 +1,109 @@
+package dialer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// CoolDown is the time a dialer is skipped by DialChain after it failed to
+// establish a connection
+var CoolDown = 30 * time.Second
+
+var (
+	failuresLock sync.Mutex
+	failures     = make(map[string]time.Time)
+	timeNow      = time.Now
+)
+
+// CoolingDown checks if the dialer failed recently and is skipped by
+// DialChain
+func CoolingDown(dialerName string) bool {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	failedAt, ok := failures[dialerName]
+	if ok && timeNow().Sub(failedAt) >= CoolDown {
+		delete(failures, dialerName)
+		return false
+	}
+	return ok
+}
+
+func reportFailure(dialerName string, err error) {
+	if dialerName == DirectDialer {
+		// there is nothing in between which could be broken
+		return
+	}
+	var openChannelError *ssh.OpenChannelError
+	if errors.As(err, &openChannelError) {
+		// the tunnel is up, but the destination is not reachable from the
+		// remote side
+		return
+	}
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	failures[dialerName] = timeNow()
+}
+
+func reportSuccess(dialerName string) {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	delete(failures, dialerName)
+}
+
+// Select returns the dialer which DialChain tries first
+func Select(dialerNames []string) string {
+	for _, dialerName := range dialerNames {
+		if !CoolingDown(dialerName) {
+			return dialerName
+		}
+	}
+	if len(dialerNames) > 0 {
+		return dialerNames[0]
+	}
+	return ""
+}
+
+// DialChain tries the dialers in the given order until a connection gets
+// established. Dialers which failed recently are skipped for the CoolDown
+// period, unless all of them are cooling down.
+func DialChain(dialerNames []string, network, addr string) (net.Conn, error) {
+	if len(dialerNames) == 1 {
+		return Dial(dialerNames[0], network, addr)
+	}
+
+	candidates := make([]string, 0, len(dialerNames))
+	for _, dialerName := range dialerNames {
+		if CoolingDown(dialerName) {
+			logger.L.Printf("dial %s: skipping dialer '%s' (cooling down)\n", addr, dialerName)
+			continue
+		}
+		candidates = append(candidates, dialerName)
+	}
+	if len(candidates) == 0 {
+		logger.L.Printf("dial %s: all dialers are cooling down, trying all of them\n", addr)
+		candidates = dialerNames
+	}
+
+	var errs []string
+	for i, dialerName := range candidates {
+		conn, err := Dial(dialerName, network, addr)
+		if err == nil {
+			reportSuccess(dialerName)
+			if i > 0 {
+				logger.L.Printf("dial %s: failed over to dialer '%s'\n", addr, dialerName)
+			}
+			return conn, nil
+		}
+		logger.L.Printf("dial %s: dialer '%s' failed: %v\n", addr, dialerName, err)
+		reportFailure(dialerName, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", dialerName, err))
+	}
+	return nil, fmt.Errorf("dial %s failed with all dialers (%s)", addr, strings.Join(errs, "; "))
+}
@@ -0,0 +1,190 @@
+package dialer
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testDialer struct {
+	err   error
+	calls int
+}
+
+func (d *testDialer) Dial(network, addr string) (net.Conn, error) {
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func addTestDialer(t *testing.T, name string, d Dialer) {
+	t.Helper()
+	info := DialerInfo{impl: d}
+	info.Name = name
+	dialers[name] = info
+	t.Cleanup(func() {
+		delete(dialers, name)
+		reportSuccess(name)
+	})
+}
+
+func fakeNow(t *testing.T) *time.Time {
+	t.Helper()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+	return &now
+}
+
+func TestDialChain_FailOver(t *testing.T) {
+	now := fakeNow(t)
+	a := &testDialer{err: errors.New("ssh server down")}
+	b := &testDialer{}
+	addTestDialer(t, "test-a", a)
+	addTestDialer(t, "test-b", b)
+	chain := []string{"test-a", "test-b"}
+
+	conn, err := DialChain(chain, "tcp", "10.0.0.1:22")
+	if err != nil {
+		t.Fatalf("DialChain failed: %v", err)
+	}
+	conn.Close()
+	if a.calls != 1 || b.calls != 1 {
+		t.Fatalf("expected one call per dialer, got %d and %d", a.calls, b.calls)
+	}
+	if !CoolingDown("test-a") || Select(chain) != "test-b" {
+		t.Fatal("the failed dialer should cool down")
+	}
+
+	conn, _ = DialChain(chain, "tcp", "10.0.0.1:22")
+	conn.Close()
+	if a.calls != 1 {
+		t.Error("a cooling down dialer should be skipped")
+	}
+
+	*now = now.Add(CoolDown)
+	a.err = nil
+	conn, _ = DialChain(chain, "tcp", "10.0.0.1:22")
+	conn.Close()
+	if a.calls != 2 || CoolingDown("test-a") {
+		t.Error("the dialer should be used again after the cool-down period")
+	}
+}
+
+func TestDialChain_AllCoolingDown(t *testing.T) {
+	fakeNow(t)
+	a := &testDialer{err: errors.New("down")}
+	b := &testDialer{err: errors.New("down")}
+	addTestDialer(t, "test-a", a)
+	addTestDialer(t, "test-b", b)
+	chain := []string{"test-a", "test-b"}
+
+	if _, err := DialChain(chain, "tcp", "10.0.0.1:22"); err == nil {
+		t.Fatal("DialChain should fail if all dialers fail")
+	}
+	b.err = nil
+	conn, err := DialChain(chain, "tcp", "10.0.0.1:22")
+	if err != nil {
+		t.Fatalf("all dialers should be tried if all of them are cooling down: %v", err)
+	}
+	conn.Close()
+}
+
+func TestDialChain_DestinationErrors(t *testing.T) {
+	fakeNow(t)
+	a := &testDialer{err: &ssh.OpenChannelError{Reason: ssh.ConnectionFailed}}
+	addTestDialer(t, "test-a", a)
+	addTestDialer(t, "test-b", &testDialer{})
+
+	conn, err := DialChain([]string{"test-a", "test-b"}, "tcp", "10.0.0.1:22")
+	if err != nil {
+		t.Fatalf("DialChain failed: %v", err)
+	}
+	conn.Close()
+	if CoolingDown("test-a") {
+		t.Error("errors of the remote side must not trip the circuit breaker")
+	}
+
+	reportFailure(DirectDialer, errors.New("connection refused"))
+	if CoolingDown(DirectDialer) {
+		t.Error("the direct dialer must not cool down")
+	}
+}
+
+func TestDial_UnknownDialer(t *testing.T) {
+	if _, err := Dial("test-does-not-exist", "tcp", "10.0.0.1:22"); err == nil {
+		t.Error("Dial should fail for unknown dialers")
+	}
+}
+
+func TestDialChain_SSHDialers(t *testing.T) {
+	fakeNow(t)
+	setupInteractiveDialer(t)
+	defer func(orig *SSHDialer) { sshDialer = orig }(sshDialer)
+	sshDialer = nil
+	defer func(orig DialerInfo, ok bool) {
+		if ok {
+			dialers["default"] = orig
+		} else {
+			delete(dialers, "default")
+		}
+	}(GetDialer("default"))
+
+	// nobody listens on the server of the first dialer
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	// the server of the second dialer closes the connection
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	accepted := make(chan bool, 10)
+	go func() {
+		for {
+			conn, err := up.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- true
+			conn.Close()
+		}
+	}()
+
+	for name, addr := range map[string]string{"test-down": down.Addr().String(), "test-up": up.Addr().String()} {
+		if err := AddDialer(name, "user@"+addr); err != nil {
+			t.Fatal(err)
+		}
+		defer reportSuccess(name)
+		defer delete(dialers, name)
+	}
+	if dialers["test-down"].impl == dialers["test-up"].impl {
+		t.Fatal("the ssh dialers share their connection")
+	}
+
+	// the first dialer only tries its own server
+	if _, err := Dial("test-down", "tcp", "10.0.0.1:22"); err == nil {
+		t.Fatal("the dialer without ssh server succeeded")
+	}
+	if len(accepted) != 0 {
+		t.Fatal("the first dialer connected to the server of the second one")
+	}
+
+	// the chain fails over to the second dialer, which reaches its server
+	if _, err := DialChain([]string{"test-down", "test-up"}, "tcp", "10.0.0.1:22"); err == nil {
+		t.Fatal("the handshake with the test server succeeded")
+	}
+	if !CoolingDown("test-down") || len(accepted) != 1 {
+		t.Errorf("the chain did not fail over to the second dialer (%d connections)", len(accepted))
+	}
+}
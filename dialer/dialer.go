@@ -1,10 +1,13 @@
 package dialer
 
 import (
+	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/dueckminor/go-sshtunnel/control"
+	"golang.org/x/crypto/ssh"
 )
 
 // Dialer is a generic interface which is used to establish a net.Conn
@@ -18,17 +21,69 @@ type DialerInfo struct {
 	impl Dialer
 }
 
+// stateReporter is implemented by dialers which maintain a connection
+type stateReporter interface {
+	State() string
+}
+
+// DirectDialer is the name of the builtin dialer which establishes
+// connections without using a tunnel
+const DirectDialer = "direct"
+
+// hostLookup is implemented by dialers which are able to resolve host names
+// on the remote side
+type hostLookup interface {
+	LookupHost(host string) ([]net.IP, error)
+}
+
 var (
 	dialers   = make(map[string]DialerInfo)
 	sshDialer *SSHDialer
 )
 
+func init() {
+	info := DialerInfo{impl: &net.Dialer{Timeout: 30 * time.Second}}
+	info.Name = DirectDialer
+	info.Type = DirectDialer
+	dialers[DirectDialer] = info
+}
+
 // Dial uses the selected dialer to establish a network connection
 func Dial(dialerName, network, addr string) (net.Conn, error) {
 	if dialer, ok := dialers[dialerName]; ok {
 		return dialer.impl.Dial(network, addr)
 	}
-	return nil, nil
+	return nil, fmt.Errorf("there is no dialer with name '%s'", dialerName)
+}
+
+// LookupHost resolves a host name on the remote side of a dialer
+func LookupHost(dialerName, host string) ([]net.IP, error) {
+	info, ok := dialers[dialerName]
+	if !ok {
+		return nil, fmt.Errorf("there is no dialer with name '%s'", dialerName)
+	}
+	if lookup, ok := info.impl.(hostLookup); ok {
+		return lookup.LookupHost(host)
+	}
+	if info.Name == DirectDialer {
+		return net.LookupIP(host)
+	}
+	return nil, fmt.Errorf("the dialer '%s' does not support remote lookups", dialerName)
+}
+
+// GetDialer returns the dialer with the given name
+func GetDialer(dialerName string) (info DialerInfo, ok bool) {
+	info, ok = dialers[dialerName]
+	return info, ok
+}
+
+// State returns the connection state of the dialer. It is empty for dialers
+// which don't maintain a connection.
+func (info DialerInfo) State() string {
+	if reporter, ok := info.impl.(stateReporter); ok {
+		return reporter.State()
+	}
+	return ""
 }
 
 func AddSSHKey(encodedKey string, passPhrase string) error {
@@ -77,12 +132,23 @@ func AddDialer(dialerName, uri string) (err error) {
 		return nil
 	}
 
-	makeSSHDialer()
+	// each named dialer has its own ssh connection, only the dialer
+	// created by makeSSHDialer is extended by further servers
+	d := makeSSHDialer()
+	if info, ok := dialers[dialerName]; d == nil || !ok || info.impl != Dialer(d) {
+		keys := d
+		if d, err = NewSSHDialer(5); err != nil {
+			return err
+		}
+		if keys != nil {
+			d.config.Auth = []ssh.AuthMethod{ssh.PublicKeysCallback(keys.Signers)}
+		}
+	}
 	for _, u := range strings.Split(uri, ",") {
-		sshDialer.AddDialer(u)
+		d.AddDialer(u)
 	}
 
-	info := DialerInfo{impl: sshDialer}
+	info := DialerInfo{impl: d}
 	info.Name = dialerName
 	info.Type = "ssh"
 	info.Destination = uri
@@ -104,5 +170,7 @@ func Marshall(info DialerInfo) (result control.Dialer, err error) {
 	result.Name = info.Name
 	result.Destination = info.Destination
 	result.Type = info.Type
+	result.State = info.State()
+	result.CoolingDown = CoolingDown(info.Name)
 	return result, nil
 }
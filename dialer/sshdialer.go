@@ -114,6 +114,11 @@ func (sshDialer *SSHDialer) AddSSHKey(encodedKey string, passPhrase string) erro
 	return nil
 }
 
+// Signers returns the keys added by AddSSHKey
+func (sshDialer *SSHDialer) Signers() ([]ssh.Signer, error) {
+	return sshDialer.signers, nil
+}
+
 func (sshDialer *SSHDialer) GetSSHKeys() (keys []control.SSHKey, err error) {
 	for _, signer := range sshDialer.signers {
 		pub := signer.PublicKey()
@@ -191,12 +196,83 @@ func (sshDialer *SSHDialer) Dial(network, addr string) (net.Conn, error) {
 	return client.Dial(network, addr)
 }
 
-func (sshDialer *SSHDialer) Connect() (*ssh.Client, error) {
+// LookupHost resolves a host name on the ssh server by running getent
+func (sshDialer *SSHDialer) LookupHost(host string) ([]net.IP, error) {
+	if !isValidHostName(host) {
+		return nil, fmt.Errorf("'%s' is not a valid host name", host)
+	}
+
+	client, err := sshDialer.Connect()
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	output, err := session.Output("getent ahosts " + host)
+	if err != nil {
+		return nil, fmt.Errorf("remote lookup of '%s' failed: %w", host, err)
+	}
+	return parseGetentOutput(string(output), host)
+}
+
+// parseGetentOutput parses the output of "getent ahosts", which contains
+// lines like "10.1.2.3  STREAM host.example.com"
+func parseGetentOutput(output, host string) (ips []net.IP, err error) {
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || seen[fields[0]] {
+			continue
+		}
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			seen[fields[0]] = true
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("remote lookup of '%s' returned no addresses", host)
+	}
+	return ips, nil
+}
+
+// isValidHostName checks that a host name can be passed safely to a shell
+func isValidHostName(host string) bool {
+	if len(host) == 0 || len(host) > 253 || host[0] == '-' {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// State returns "connected" if the ssh connection is established, the status
+// of the running connector while connecting and "disconnected" otherwise
+func (sshDialer *SSHDialer) State() string {
 	sshDialer.lock.RLock()
-	if nil != sshDialer.client {
-		return sshDialer.client, nil
+	defer sshDialer.lock.RUnlock()
+	if sshDialer.client != nil {
+		return "connected"
+	}
+	if sshDialer.sshConnector != nil {
+		return string(sshDialer.sshConnector.Status())
 	}
+	return "disconnected"
+}
+
+func (sshDialer *SSHDialer) Connect() (*ssh.Client, error) {
+	sshDialer.lock.RLock()
+	client := sshDialer.client
 	sshDialer.lock.RUnlock()
+	if nil != client {
+		return client, nil
+	}
 
 	sshConnector := sshDialer.GetConnector(false)
 
@@ -204,24 +280,29 @@ func (sshDialer *SSHDialer) Connect() (*ssh.Client, error) {
 		sshConnector.Wait()
 	}
 
-	if sshDialer.client != nil {
-		return sshDialer.client, nil
+	sshDialer.lock.RLock()
+	client = sshDialer.client
+	sshDialer.lock.RUnlock()
+	if client != nil {
+		return client, nil
 	}
+	sshConnector.lock.RLock()
+	defer sshConnector.lock.RUnlock()
 	return nil, sshConnector.err
 }
 
 func (sshDialer *SSHDialer) GetConnector(interactive bool) *SSHConnector {
-	sshDialer.lock.RLock()
+	sshDialer.lock.Lock()
+	defer sshDialer.lock.Unlock()
+
 	if nil != sshDialer.sshConnector {
 		if interactive {
+			sshDialer.sshConnector.lock.Lock()
 			sshDialer.sshConnector.interactive = true
+			sshDialer.sshConnector.lock.Unlock()
 		}
 		return sshDialer.sshConnector
 	}
-	sshDialer.lock.RUnlock()
-
-	sshDialer.lock.Lock()
-	defer sshDialer.lock.Unlock()
 
 	sshDialer.sshConnector = &SSHConnector{
 		interactive: interactive,
@@ -235,9 +316,17 @@ func (sshDialer *SSHDialer) GetConnector(interactive bool) *SSHConnector {
 }
 
 func (sshConnector *SSHConnector) Status() control.ConnectStatus {
+	sshConnector.lock.RLock()
+	defer sshConnector.lock.RUnlock()
 	return sshConnector.status
 }
 
+func (sshConnector *SSHConnector) setStatus(status control.ConnectStatus) {
+	sshConnector.lock.Lock()
+	defer sshConnector.lock.Unlock()
+	sshConnector.status = status
+}
+
 func (sshConnector *SSHConnector) MessageCount() int {
 	sshConnector.lock.RLock()
 	defer sshConnector.lock.RUnlock()
@@ -263,6 +352,12 @@ func (sshConnector *SSHConnector) SetPassphrase(passphrase string) error {
 }
 
 func (sshConnector *SSHConnector) Done() bool {
+	sshConnector.lock.RLock()
+	defer sshConnector.lock.RUnlock()
+	return sshConnector.doneLocked()
+}
+
+func (sshConnector *SSHConnector) doneLocked() bool {
 	return sshConnector.status == control.ConnectStatusSucceeded ||
 		sshConnector.status == control.ConnectStatusFailed
 }
@@ -303,11 +398,19 @@ func (sshConnector *SSHConnector) Printf(format string, args ...interface{}) {
 func (sshConnector *SSHConnector) connect() {
 	var sshHost string
 	defer func() {
+		sshDialer := sshConnector.sshDialer
+		sshDialer.lock.Lock()
+		if sshDialer.sshConnector == sshConnector {
+			sshDialer.sshConnector = nil
+		}
+		sshDialer.lock.Unlock()
+
+		sshConnector.lock.Lock()
+		defer sshConnector.lock.Unlock()
 		if sshConnector.status != control.ConnectStatusSucceeded {
 			sshConnector.status = control.ConnectStatusFailed
 		}
-		sshConnector.sshDialer.sshConnector = nil
-		sshConnector.notifyWaiting()
+		sshConnector.notifyWaitingLocked()
 	}()
 
 	// The following code does the same as:
@@ -353,7 +456,10 @@ func (sshConnector *SSHConnector) connect() {
 		// Host is not in known_hosts at all.
 		fingerprint := ssh.FingerprintSHA256(key)
 
-		if !sshConnector.interactive {
+		sshConnector.lock.RLock()
+		interactive := sshConnector.interactive
+		sshConnector.lock.RUnlock()
+		if !interactive {
 			// Non-interactive: fail with a helpful message.
 			sshConnector.Printf(
 				"Host %s is not in known_hosts (fingerprint: %s).\n"+
@@ -404,18 +510,26 @@ func (sshConnector *SSHConnector) connect() {
 	}
 
 	cfg.Auth = append(sshConnector.sshDialer.config.Auth, ssh.PasswordCallback(func() (secret string, err error) {
-		sshConnector.status = control.ConnectStatusNeedPassphrase
-		for !sshConnector.Done() {
+		sshConnector.setStatus(control.ConnectStatusNeedPassphrase)
+		for {
+			sshConnector.lock.Lock()
+			if sshConnector.doneLocked() {
+				sshConnector.lock.Unlock()
+				return "", nil
+			}
 			if len(sshConnector.passphrase) > 0 {
 				passphrase := sshConnector.passphrase
 				sshConnector.passphrase = ""
 				sshConnector.status = control.ConnectStatusHandshake
-				sshConnector.notifyWaiting()
+				sshConnector.notifyWaitingLocked()
+				sshConnector.lock.Unlock()
 				return passphrase, nil
 			}
-			sshConnector.Wait()
+			// register before unlocking, so that SetPassphrase can't be missed
+			w := sshConnector.waitLocked()
+			sshConnector.lock.Unlock()
+			<-w
 		}
-		return "", nil
 	}))
 
 	socket := os.Getenv("SSH_AUTH_SOCK")
@@ -436,7 +550,11 @@ func (sshConnector *SSHConnector) connect() {
 		return nil
 	}
 
-	for _, addr := range sshDialer.addresses {
+	sshConnector.sshDialer.lock.RLock()
+	addresses := sshConnector.sshDialer.addresses
+	sshConnector.sshDialer.lock.RUnlock()
+
+	for _, addr := range addresses {
 		if len(addr.user) > 0 {
 			cfg.User = addr.user
 		}
@@ -444,15 +562,15 @@ func (sshConnector *SSHConnector) connect() {
 		sshHost = addr.host
 
 		sshConnector.Printf("Trying to connect to %s@%s\n", cfg.User, sshHost)
-		sshConnector.status = control.ConnectStatusConnecting
+		sshConnector.setStatus(control.ConnectStatusConnecting)
 
-		conn, err = net.DialTimeout("tcp", addr.host, sshDialer.config.Timeout)
+		conn, err = net.DialTimeout("tcp", addr.host, cfg.Timeout)
 		if err != nil {
 			sshConnector.Printf("Connect to %s@%s failed. Reason: %v\n", cfg.User, sshHost, err)
 			continue
 		}
 
-		sshConnector.status = control.ConnectStatusHandshake
+		sshConnector.setStatus(control.ConnectStatusHandshake)
 
 		var c ssh.Conn
 		var chans <-chan ssh.NewChannel
@@ -464,17 +582,24 @@ func (sshConnector *SSHConnector) connect() {
 			continue
 		}
 		sshConnector.Printf("Handshake with %s@%s succeeded\n", cfg.User, sshHost)
+		// the client is set before the status, Connect reads it when the
+		// connector is done
+		sshConnector.sshDialer.lock.Lock()
 		sshConnector.sshDialer.client = ssh.NewClient(c, chans, reqs)
+		sshConnector.sshDialer.lock.Unlock()
+		sshConnector.lock.Lock()
 		sshConnector.status = control.ConnectStatusSucceeded
 		sshConnector.err = nil
+		sshConnector.lock.Unlock()
 		return
 	}
-}
 
-func (sshConnector *SSHConnector) notifyWaiting() {
+	if err == nil {
+		err = errors.New("no ssh server has been configured")
+	}
 	sshConnector.lock.Lock()
-	defer sshConnector.lock.Unlock()
-	sshConnector.notifyWaitingLocked()
+	sshConnector.err = fmt.Errorf("failed to connect to ssh server: %w", err)
+	sshConnector.lock.Unlock()
 }
 
 func (sshConnector *SSHConnector) notifyWaitingLocked() {
@@ -485,20 +610,25 @@ func (sshConnector *SSHConnector) notifyWaitingLocked() {
 }
 
 func (sshConnector *SSHConnector) Wait() error {
-	if sshConnector.Done() {
+	sshConnector.lock.Lock()
+	if sshConnector.doneLocked() {
+		defer sshConnector.lock.Unlock()
 		return sshConnector.err
 	}
-
-	w := make(chan bool)
-
-	sshConnector.lock.Lock()
-	sshConnector.waiting = append(sshConnector.waiting, w)
+	w := sshConnector.waitLocked()
 	sshConnector.lock.Unlock()
 
 	<-w
 	return nil
 }
 
+// waitLocked registers a channel which receives the next notification
+func (sshConnector *SSHConnector) waitLocked() chan bool {
+	w := make(chan bool)
+	sshConnector.waiting = append(sshConnector.waiting, w)
+	return w
+}
+
 func isKeyError(err error, target **knownhosts.KeyError) bool {
 	var ke *knownhosts.KeyError
 	ok := errors.As(err, &ke)
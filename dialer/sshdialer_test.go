@@ -277,3 +277,23 @@ func TestIsKeyError(t *testing.T) {
 		t.Error("isKeyError should return false for non-KeyError")
 	}
 }
+
+func TestParseGetentOutput(t *testing.T) {
+	output := "10.1.2.3        STREAM intranet.corp.example\n" +
+		"10.1.2.3        DGRAM\n" +
+		"fd00::3         STREAM\n"
+	ips, err := parseGetentOutput(output, "intranet.corp.example")
+	if err != nil {
+		t.Fatalf("parseGetentOutput failed: %v", err)
+	}
+	if len(ips) != 2 || ips[0].String() != "10.1.2.3" || ips[1].String() != "fd00::3" {
+		t.Errorf("unexpected addresses: %v", ips)
+	}
+
+	if _, err := parseGetentOutput("", "unknown.corp.example"); err == nil {
+		t.Error("parseGetentOutput should fail without addresses")
+	}
+	if isValidHostName("host; rm -rf /") || isValidHostName("-x") || !isValidHostName("intranet.corp.example") {
+		t.Error("isValidHostName does not reject unsafe host names")
+	}
+}
@@ -1,4 +1,3 @@
-// +build linux
 package originaldest
 
 import (
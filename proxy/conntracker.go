@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/logger"
+)
+
+// DrainTimeout is the time a closing proxy waits for in-flight connections
+// before they get closed forcibly
+var DrainTimeout = 10 * time.Second
+
+// connTracker keeps track of the connections handled by a proxy, so that
+// they can be drained when the proxy gets closed
+type connTracker struct {
+	lock    sync.Mutex
+	conns   map[net.Conn]bool
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// track registers a connection. It returns false if the proxy is closing and
+// the connection must not be handled anymore.
+func (tracker *connTracker) track(conn net.Conn) bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.closing {
+		return false
+	}
+	if tracker.conns == nil {
+		tracker.conns = make(map[net.Conn]bool)
+	}
+	tracker.conns[conn] = true
+	tracker.wg.Add(1)
+	return true
+}
+
+// untrack must be called once for each tracked connection after it has been
+// handled completely
+func (tracker *connTracker) untrack(conn net.Conn) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.conns[conn] {
+		delete(tracker.conns, conn)
+		tracker.wg.Done()
+	}
+}
+
+// serve handles a connection in a new goroutine
+func (tracker *connTracker) serve(conn net.Conn, handler func(conn net.Conn)) {
+	if !tracker.track(conn) {
+		conn.Close()
+		return
+	}
+	go func() {
+		defer tracker.untrack(conn)
+		handler(conn)
+	}()
+}
+
+// drain rejects new connections and waits until all tracked connections are
+// finished. Connections which are still open after the timeout get closed,
+// then drain waits for their handlers once more for the same time.
+func (tracker *connTracker) drain(timeout time.Duration) {
+	tracker.lock.Lock()
+	tracker.closing = true
+	tracker.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		tracker.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	tracker.lock.Lock()
+	conns := make([]net.Conn, 0, len(tracker.conns))
+	for conn := range tracker.conns {
+		conns = append(conns, conn)
+	}
+	tracker.lock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	// a handler which ignores the closed connection must not block closing
+	// the proxy forever
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.L.Printf("proxy: %d connections are still busy after closing them\n", len(conns))
+	}
+}
+
+// trackHijacked is used as http.Server.ConnState hook. Connections hijacked
+// from an http.Server (CONNECT tunnels, upgraded connections) are tracked
+// until they are closed. The listener of the server must be wrapped by
+// closeNotifyingListener.
+func (tracker *connTracker) trackHijacked(conn net.Conn, state http.ConnState) {
+	if state != http.StateHijacked {
+		return
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// the closeNotifyingConn below the TLS layer gets untracked
+		conn = tlsConn.NetConn()
+	}
+	if !tracker.track(conn) {
+		conn.Close()
+	}
+}
+
+// closeNotifyingListener untracks connections when they get closed
+type closeNotifyingListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (listener closeNotifyingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &closeNotifyingConn{Conn: conn, tracker: listener.tracker}, nil
+}
+
+type closeNotifyingConn struct {
+	net.Conn
+	tracker *connTracker
+}
+
+func (conn *closeNotifyingConn) Close() error {
+	err := conn.Conn.Close()
+	conn.tracker.untrack(conn)
+	return err
+}
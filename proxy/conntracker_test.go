@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConnTrackerDrain(t *testing.T) {
+	var tracker connTracker
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	finished := make(chan bool, 1)
+	tracker.serve(server, func(conn net.Conn) {
+		buffer := make([]byte, 1)
+		conn.Read(buffer) //nolint:errcheck
+		finished <- true
+	})
+
+	start := time.Now()
+	tracker.drain(50 * time.Millisecond)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("drain returned before the timeout")
+	}
+	select {
+	case <-finished:
+	default:
+		t.Errorf("the connection has not been closed by drain")
+	}
+
+	server2, client2 := net.Pipe()
+	defer client2.Close()
+	tracker.serve(server2, func(conn net.Conn) {
+		t.Errorf("a connection has been handled after drain")
+	})
+}
+
+func TestSocks5ProxyClose(t *testing.T) {
+	p, err := NewProxy("socks5", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := p.GetPort()
+	if p.GetAddress() != "127.0.0.1:"+strconv.Itoa(port) {
+		t.Errorf("the proxy listens on '%s' instead of the loopback address", p.GetAddress())
+	}
+	if len(getRunningProxies("socks5")) != 1 {
+		t.Errorf("the proxy has not been registered")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(getRunningProxies("socks5")) != 0 {
+		t.Errorf("the proxy is still registered after Close")
+	}
+
+	// the port must be available again
+	p, err = NewProxy("socks5", Config{Listen: strconv.Itoa(port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+}
@@ -0,0 +1,326 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Defaults of the DNS cache options
+const (
+	DefaultDNSCacheSize   = 1000
+	DefaultDNSCacheMaxTTL = 24 * time.Hour
+)
+
+// dnsPrefetchHits is the number of hits after which an entry is refreshed
+// before it expires. Entries are refreshed when less than a tenth of their
+// TTL is left.
+const dnsPrefetchHits = 3
+
+// DNSCacheEntry describes a cached response
+type DNSCacheEntry struct {
+	// Proxy is the address of the DNS proxy
+	Proxy string
+	Name  string
+	Type  string
+	// Negative is set for cached NXDOMAIN and NODATA responses (RFC 2308)
+	Negative bool
+	Rcode    string
+	TTL      time.Duration
+	Hits     int
+}
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+}
+
+type dnsCacheEntry struct {
+	key      dnsCacheKey
+	response *dns.Msg
+	negative bool
+	stored   time.Time
+	expires  time.Time
+	hits     int
+	// prefetching is set while the entry gets refreshed
+	prefetching bool
+}
+
+// dnsCache caches the responses of a DNS upstream. The least recently used
+// entries are removed if the cache is full.
+type dnsCache struct {
+	maxEntries int
+	maxTTL     time.Duration
+
+	lock    sync.Mutex
+	entries map[dnsCacheKey]*list.Element
+	lru     *list.List
+
+	// now is replaced by tests
+	now func() time.Time
+}
+
+func newDNSCache(maxEntries int, maxTTL time.Duration) *dnsCache {
+	return &dnsCache{
+		maxEntries: maxEntries,
+		maxTTL:     maxTTL,
+		entries:    make(map[dnsCacheKey]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+// cacheKey returns the key of a query. Only queries with a single question
+// are cached.
+func cacheKey(query *dns.Msg) (dnsCacheKey, bool) {
+	if len(query.Question) != 1 {
+		return dnsCacheKey{}, false
+	}
+	q := query.Question[0]
+	key := dnsCacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+	if opt := query.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return key, true
+}
+
+// get returns a copy of a cached response with the TTLs reduced by the time
+// it has been cached. prefetch is set if the entry should be refreshed.
+func (cache *dnsCache) get(query *dns.Msg) (response *dns.Msg, prefetch bool) {
+	key, ok := cacheKey(query)
+	if !ok || cache.maxEntries <= 0 {
+		return nil, false
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*dnsCacheEntry)
+	now := cache.now()
+	if !now.Before(entry.expires) {
+		cache.remove(element)
+		return nil, false
+	}
+	cache.lru.MoveToFront(element)
+	entry.hits++
+
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	response = entry.response.Copy()
+	response.Id = query.Id
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl -= age
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+
+	ttl := entry.expires.Sub(entry.stored)
+	if entry.hits >= dnsPrefetchHits && !entry.prefetching && entry.expires.Sub(now) < ttl/10 {
+		entry.prefetching = true
+		prefetch = true
+	}
+	return response, prefetch
+}
+
+// put adds a response to the cache. Responses which are not cacheable are
+// ignored.
+func (cache *dnsCache) put(query *dns.Msg, response *dns.Msg) {
+	key, ok := cacheKey(query)
+	if !ok || cache.maxEntries <= 0 || response.Truncated {
+		return
+	}
+	ttl, negative, ok := cacheTTL(response)
+	if !ok {
+		return
+	}
+	if ttl > cache.maxTTL {
+		ttl = cache.maxTTL
+	}
+
+	now := cache.now()
+	entry := &dnsCacheEntry{
+		key:      key,
+		response: response.Copy(),
+		negative: negative,
+		stored:   now,
+		expires:  now.Add(ttl),
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		// keep the popularity of refreshed entries
+		entry.hits = element.Value.(*dnsCacheEntry).hits
+		cache.remove(element)
+	}
+	cache.entries[key] = cache.lru.PushFront(entry)
+	for cache.lru.Len() > cache.maxEntries {
+		cache.remove(cache.lru.Back())
+	}
+}
+
+// prefetchFailed allows another attempt to refresh the entry of query
+func (cache *dnsCache) prefetchFailed(query *dns.Msg) {
+	key, ok := cacheKey(query)
+	if !ok {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		element.Value.(*dnsCacheEntry).prefetching = false
+	}
+}
+
+// remove must be called with the lock held
+func (cache *dnsCache) remove(element *list.Element) {
+	cache.lru.Remove(element)
+	delete(cache.entries, element.Value.(*dnsCacheEntry).key)
+}
+
+// flush removes all entries for name (including all its subdomains) or all
+// entries if name is empty. It returns the number of removed entries.
+func (cache *dnsCache) flush(name string) int {
+	name = strings.ToLower(dns.Fqdn(name))
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	removed := 0
+	for key, element := range cache.entries {
+		if name == "." || key.name == name || strings.HasSuffix(key.name, "."+name) {
+			cache.remove(element)
+			removed++
+		}
+	}
+	return removed
+}
+
+// list returns all entries which are not expired yet, the most recently used
+// first
+func (cache *dnsCache) list() []DNSCacheEntry {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	now := cache.now()
+	result := make([]DNSCacheEntry, 0, cache.lru.Len())
+	for element := cache.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*dnsCacheEntry)
+		if !now.Before(entry.expires) {
+			continue
+		}
+		result = append(result, DNSCacheEntry{
+			Name:     entry.key.name,
+			Type:     dns.TypeToString[entry.key.qtype],
+			Negative: entry.negative,
+			Rcode:    dns.RcodeToString[entry.response.Rcode],
+			TTL:      entry.expires.Sub(now).Truncate(time.Second),
+			Hits:     entry.hits,
+		})
+	}
+	return result
+}
+
+// cacheTTL returns how long a response may be cached. Positive responses
+// are cached for the smallest TTL of their records. NXDOMAIN and NODATA
+// responses are cached for the TTL of the SOA record in the authority
+// section, limited by its MINIMUM field (RFC 2308). Negative responses
+// without SOA record and all other responses are not cached.
+func cacheTTL(response *dns.Msg) (ttl time.Duration, negative bool, ok bool) {
+	switch {
+	case response.Rcode == dns.RcodeSuccess && len(response.Answer) > 0:
+		minTTL := ^uint32(0)
+		for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+			for _, rr := range section {
+				if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl < minTTL {
+					minTTL = rr.Header().Ttl
+				}
+			}
+		}
+		if minTTL == 0 {
+			return 0, false, false
+		}
+		return time.Duration(minTTL) * time.Second, false, true
+	case response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError:
+		for _, rr := range response.Ns {
+			if soa, isSOA := rr.(*dns.SOA); isSOA {
+				minTTL := soa.Hdr.Ttl
+				if soa.Minttl < minTTL {
+					minTTL = soa.Minttl
+				}
+				if minTTL == 0 {
+					return 0, true, false
+				}
+				return time.Duration(minTTL) * time.Second, true, true
+			}
+		}
+	}
+	return 0, false, false
+}
+
+// ListDNSCache returns the cached responses of all running DNS proxies
+func ListDNSCache() (entries []DNSCacheEntry) {
+	for _, p := range getRunningProxies("dns") {
+		proxy := p.(*dnsProxy)
+		for _, entry := range proxy.cache.list() {
+			entry.Proxy = proxy.GetAddress()
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// FlushDNSCache removes the cached responses for name and all its subdomains
+// from the caches of all running DNS proxies. If name is empty, the caches
+// are cleared. It returns the number of removed responses.
+func FlushDNSCache(name string) (removed int) {
+	for _, p := range getRunningProxies("dns") {
+		removed += p.(*dnsProxy).cache.flush(name)
+	}
+	return removed
+}
+
+// query answers a query using the local records, from the cache or by the
+// upstream of its zone. Popular entries are refreshed in the background
+// before they expire. The source is the target of the upstream or one of
+// dnsSourceLocal and dnsSourceCache.
+func (proxy *dnsProxy) query(ctx context.Context, query *dns.Msg) (response *dns.Msg, source string, err error) {
+	if response, err = proxy.answerLocal(ctx, query); response != nil || err != nil {
+		return response, dnsSourceLocal, err
+	}
+	response, prefetch := proxy.cache.get(query)
+	if response != nil {
+		if prefetch {
+			go proxy.prefetch(query.Copy())
+		}
+		return response, dnsSourceCache, nil
+	}
+	response, source, err = proxy.upstreamFor(query).exchange(ctx, query)
+	if err != nil {
+		return nil, source, err
+	}
+	proxy.cache.put(query, response)
+	return response, source, nil
+}
+
+func (proxy *dnsProxy) prefetch(query *dns.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsExchangeTimeout)
+	defer cancel()
+	response, _, err := proxy.upstreamFor(query).exchange(ctx, query)
+	if err != nil {
+		proxy.cache.prefetchFailed(query)
+		return
+	}
+	proxy.cache.put(query, response)
+}
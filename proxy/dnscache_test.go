@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestDNSCache(maxEntries int) (*dnsCache, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := newDNSCache(maxEntries, DefaultDNSCacheMaxTTL)
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+func testDNSExchange(t *testing.T, name string, qtype uint16, records ...string) (query *dns.Msg, response *dns.Msg) {
+	t.Helper()
+	query = new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	response = new(dns.Msg)
+	response.SetReply(query)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Answer = append(response.Answer, rr)
+	}
+	return query, response
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	cache, now := newTestDNSCache(10)
+	query, response := testDNSExchange(t, "host.corp.example.", dns.TypeA,
+		"host.corp.example. 60 IN A 10.0.0.1",
+		"host.corp.example. 120 IN A 10.0.0.2")
+	cache.put(query, response)
+
+	*now = now.Add(20 * time.Second)
+	query.Id = 4711
+	cached, _ := cache.get(query)
+	if cached == nil {
+		t.Fatal("the response has not been cached")
+	}
+	if cached.Id != 4711 {
+		t.Errorf("got ID %d, expected the ID of the query", cached.Id)
+	}
+	if ttl := cached.Answer[0].Header().Ttl; ttl != 40 {
+		t.Errorf("got TTL %d, expected 40", ttl)
+	}
+	if ttl := cached.Answer[1].Header().Ttl; ttl != 100 {
+		t.Errorf("got TTL %d, expected 100", ttl)
+	}
+
+	// the response expires with its smallest TTL
+	*now = now.Add(40 * time.Second)
+	if cached, _ := cache.get(query); cached != nil {
+		t.Errorf("the response has not expired")
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	cache, now := newTestDNSCache(10)
+	query, response := testDNSExchange(t, "missing.corp.example.", dns.TypeA)
+	response.Rcode = dns.RcodeNameError
+
+	// without SOA record, negative responses are not cached
+	cache.put(query, response)
+	if cached, _ := cache.get(query); cached != nil {
+		t.Errorf("a negative response without SOA record has been cached")
+	}
+
+	soa, err := dns.NewRR("corp.example. 3600 IN SOA ns.corp.example. admin.corp.example. 1 7200 900 1209600 30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Ns = append(response.Ns, soa)
+	cache.put(query, response)
+
+	entries := cache.list()
+	if len(entries) != 1 || !entries[0].Negative || entries[0].Rcode != "NXDOMAIN" || entries[0].TTL != 30*time.Second {
+		t.Fatalf("unexpected cache entries: %+v", entries)
+	}
+	*now = now.Add(30 * time.Second)
+	if cached, _ := cache.get(query); cached != nil {
+		t.Errorf("the negative response has not expired after the SOA minimum")
+	}
+}
+
+func TestDNSCacheLRU(t *testing.T) {
+	cache, _ := newTestDNSCache(2)
+	a, responseA := testDNSExchange(t, "a.corp.example.", dns.TypeA, "a.corp.example. 60 IN A 10.0.0.1")
+	b, responseB := testDNSExchange(t, "b.corp.example.", dns.TypeA, "b.corp.example. 60 IN A 10.0.0.2")
+	c, responseC := testDNSExchange(t, "c.corp.example.", dns.TypeA, "c.corp.example. 60 IN A 10.0.0.3")
+
+	cache.put(a, responseA)
+	cache.put(b, responseB)
+	// a is used more recently than b, so b gets removed
+	cache.get(a)
+	cache.put(c, responseC)
+
+	if cached, _ := cache.get(b); cached != nil {
+		t.Errorf("the least recently used response has not been removed")
+	}
+	for _, query := range []*dns.Msg{a, c} {
+		if cached, _ := cache.get(query); cached == nil {
+			t.Errorf("%s has been removed", query.Question[0].Name)
+		}
+	}
+}
+
+func TestDNSCacheFlush(t *testing.T) {
+	cache, _ := newTestDNSCache(10)
+	for _, name := range []string{"corp.example.", "host.corp.example.", "other.example."} {
+		query, response := testDNSExchange(t, name, dns.TypeA, name+" 60 IN A 10.0.0.1")
+		cache.put(query, response)
+	}
+	if removed := cache.flush("Corp.Example"); removed != 2 {
+		t.Errorf("removed %d entries, expected 2", removed)
+	}
+	if entries := cache.list(); len(entries) != 1 || entries[0].Name != "other.example." {
+		t.Errorf("unexpected cache entries: %+v", entries)
+	}
+	if removed := cache.flush(""); removed != 1 {
+		t.Errorf("removed %d entries, expected 1", removed)
+	}
+}
+
+func TestResolveDNSCached(t *testing.T) {
+	upstream := startDNSUpstream(t, 1)
+
+	p, err := NewProxy("dns", Config{Listen: "127.0.0.1:0", Parameters: upstream.addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// the responses of the DNS proxy are used by ResolveDNS
+	query := new(dns.Msg)
+	query.SetQuestion("host.corp.example.", dns.TypeA)
+	if _, _, err := (&dns.Client{Net: "udp"}).Exchange(query, p.GetAddress()); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := ResolveDNS(context.Background(), "host.corp.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.0" {
+		t.Errorf("resolved to %s, expected 10.0.0.0", ip)
+	}
+	if queries := upstream.queries.Load(); queries != 1 {
+		t.Errorf("the upstream got %d queries, expected 1", queries)
+	}
+
+	entries := ListDNSCache()
+	if len(entries) != 1 || entries[0].Proxy != p.GetAddress() || entries[0].Hits != 1 {
+		t.Errorf("unexpected cache entries: %+v", entries)
+	}
+	if removed := FlushDNSCache(""); removed != 1 {
+		t.Errorf("removed %d entries, expected 1", removed)
+	}
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/miekg/dns"
+)
+
+// dohUpstream sends DNS queries to a DNS over HTTPS server (RFC 8484). The
+// connections are established by a dialer and kept alive by the transport.
+type dohUpstream struct {
+	url string
+
+	lock   sync.Mutex
+	dialer dialer.Dialer
+	// closed is set by close, no connections are established afterwards
+	closed bool
+
+	transport *http.Transport
+	client    *http.Client
+}
+
+func newDoHUpstream(url string, d dialer.Dialer, rootCAs *x509.CertPool) *dohUpstream {
+	upstream := &dohUpstream{url: url, dialer: d}
+	upstream.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			upstream.lock.Lock()
+			d, closed := upstream.dialer, upstream.closed
+			upstream.lock.Unlock()
+			if closed {
+				return nil, errDNSUpstreamClosed
+			}
+			return d.Dial(network, addr)
+		},
+		TLSClientConfig: &tls.Config{
+			RootCAs:    rootCAs,
+			MinVersion: tls.VersionTLS12,
+		},
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: dnsExchangeTimeout,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	upstream.client = &http.Client{
+		Transport: upstream.transport,
+		Timeout:   dnsExchangeTimeout,
+	}
+	return upstream
+}
+
+// setDialer replaces the dialer. The idle connections get closed, as they
+// have been established by the old dialer.
+func (upstream *dohUpstream) setDialer(d dialer.Dialer) {
+	upstream.lock.Lock()
+	upstream.dialer = d
+	upstream.lock.Unlock()
+	upstream.transport.CloseIdleConnections()
+}
+
+// close closes the idle connections. Connections of queries which are still
+// in flight get closed when the queries are finished.
+func (upstream *dohUpstream) close() {
+	upstream.lock.Lock()
+	upstream.closed = true
+	upstream.lock.Unlock()
+	upstream.transport.CloseIdleConnections()
+}
+
+// closeIfClosed closes the connection a query has returned to the idle pool
+// after the upstream has been closed
+func (upstream *dohUpstream) closeIfClosed() {
+	upstream.lock.Lock()
+	closed := upstream.closed
+	upstream.lock.Unlock()
+	if closed {
+		upstream.transport.CloseIdleConnections()
+	}
+}
+
+// Exchange posts a query to the upstream and returns the response
+func (upstream *dohUpstream) Exchange(ctx context.Context, query *dns.Msg) (response *dns.Msg, rtt time.Duration, err error) {
+	// the ID should be 0 to make the responses cacheable by HTTP caches
+	request := query.Copy()
+	request.Id = 0
+	data, err := request.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	start := time.Now()
+	resp, err := upstream.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer upstream.closeIfClosed()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("the DNS upstream '%s' returned '%s'", upstream.url, resp.Status)
+	}
+	data, err = io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt = time.Since(start)
+
+	response = new(dns.Msg)
+	if err = response.Unpack(data); err != nil {
+		return nil, 0, err
+	}
+	response.Id = query.Id
+	return response, rtt, nil
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultFakeIPExpiry is the default time after which an unused mapping of
+// a fake IP address is released
+const DefaultFakeIPExpiry = time.Hour
+
+// dnsFakeIPTTL is the TTL of answers with fake IP addresses. It is short,
+// so that clients don't use addresses which have been released.
+const dnsFakeIPTTL = 60
+
+// fakeIPPool assigns IPv4 addresses of a reserved network (like
+// 198.18.0.0/15) to host names. Connections to these addresses are mapped
+// back to the host names by the transparent proxies. If all addresses are
+// in use, the least recently used mapping is released.
+type fakeIPPool struct {
+	network *net.IPNet
+	// domains restricts the names which get fake addresses, all names get
+	// them if it is empty
+	domains []string
+	expiry  time.Duration
+
+	lock   sync.Mutex
+	byName map[string]*list.Element
+	byIP   map[uint32]*list.Element
+	lru    *list.List
+	// next is the offset of the next address which gets assigned
+	next uint32
+
+	// now is replaced by tests
+	now func() time.Time
+}
+
+type fakeIPEntry struct {
+	name     string
+	ip       uint32
+	lastUsed time.Time
+}
+
+func newFakeIPPool(cidr string, domains []string, expiry time.Duration) (*fakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if network.IP.To4() == nil {
+		return nil, fmt.Errorf("the fake IP network '%s' is not an IPv4 network", cidr)
+	}
+	if ones, _ := network.Mask.Size(); ones > 30 {
+		return nil, fmt.Errorf("the fake IP network '%s' is too small", cidr)
+	}
+	for i, domain := range domains {
+		domains[i] = normalizeZone(domain)
+	}
+	return &fakeIPPool{
+		network: network,
+		domains: domains,
+		expiry:  expiry,
+		byName:  make(map[string]*list.Element),
+		byIP:    make(map[uint32]*list.Element),
+		lru:     list.New(),
+		next:    1,
+		now:     time.Now,
+	}, nil
+}
+
+// size returns the number of usable addresses. The first and the last
+// address of the network are not used.
+func (pool *fakeIPPool) size() uint32 {
+	ones, bits := pool.network.Mask.Size()
+	return 1<<uint(bits-ones) - 2
+}
+
+func (pool *fakeIPPool) base() uint32 {
+	return binary.BigEndian.Uint32(pool.network.IP.To4())
+}
+
+func (pool *fakeIPPool) toIP(ip uint32) net.IP {
+	result := make(net.IP, 4)
+	binary.BigEndian.PutUint32(result, ip)
+	return result
+}
+
+// matches checks if name gets a fake address
+func (pool *fakeIPPool) matches(name string) bool {
+	if len(pool.domains) == 0 {
+		return true
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, domain := range pool.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// assign returns the fake address of name. A new address is assigned, if
+// the name has none yet.
+func (pool *fakeIPPool) assign(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	now := pool.now()
+	pool.releaseExpired(now)
+
+	if element, ok := pool.byName[name]; ok {
+		entry := element.Value.(*fakeIPEntry)
+		entry.lastUsed = now
+		pool.lru.MoveToFront(element)
+		return pool.toIP(entry.ip)
+	}
+
+	var ip uint32
+	if uint32(pool.lru.Len()) < pool.size() {
+		for {
+			ip = pool.base() + pool.next
+			pool.next = pool.next%pool.size() + 1
+			if _, used := pool.byIP[ip]; !used {
+				break
+			}
+		}
+	} else {
+		// reuse the address of the least recently used mapping
+		ip = pool.lru.Back().Value.(*fakeIPEntry).ip
+		pool.release(pool.lru.Back())
+	}
+
+	entry := &fakeIPEntry{name: name, ip: ip, lastUsed: now}
+	element := pool.lru.PushFront(entry)
+	pool.byName[name] = element
+	pool.byIP[ip] = element
+	return pool.toIP(ip)
+}
+
+// lookup returns the name which has been assigned to ip
+func (pool *fakeIPPool) lookup(ip net.IP) (name string, ok bool) {
+	ip = ip.To4()
+	if ip == nil || !pool.network.Contains(ip) {
+		return "", false
+	}
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	now := pool.now()
+	pool.releaseExpired(now)
+	element, ok := pool.byIP[binary.BigEndian.Uint32(ip)]
+	if !ok {
+		return "", false
+	}
+	entry := element.Value.(*fakeIPEntry)
+	entry.lastUsed = now
+	pool.lru.MoveToFront(element)
+	return entry.name, true
+}
+
+// releaseExpired must be called with the lock held
+func (pool *fakeIPPool) releaseExpired(now time.Time) {
+	for element := pool.lru.Back(); element != nil; element = pool.lru.Back() {
+		if now.Sub(element.Value.(*fakeIPEntry).lastUsed) < pool.expiry {
+			return
+		}
+		pool.release(element)
+	}
+}
+
+// release must be called with the lock held
+func (pool *fakeIPPool) release(element *list.Element) {
+	entry := element.Value.(*fakeIPEntry)
+	pool.lru.Remove(element)
+	delete(pool.byName, entry.name)
+	delete(pool.byIP, entry.ip)
+}
+
+// reverseIPv4 returns the address of a name in the in-addr.arpa domain
+func reverseIPv4(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	if !strings.HasSuffix(name, ".in-addr.arpa.") {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+	if len(labels) != 4 {
+		return nil
+	}
+	return net.ParseIP(labels[3] + "." + labels[2] + "." + labels[1] + "." + labels[0]).To4()
+}
+
+// answerFakeIP answers A queries for the names of the fake IP pool with fake
+// addresses and AAAA queries without records, so that clients use the
+// fake addresses. PTR queries for the pool are answered using the assigned
+// names. It returns nil for all other queries.
+func (proxy *dnsProxy) answerFakeIP(query *dns.Msg) *dns.Msg {
+	pool := proxy.fakeIPs
+	if pool == nil || len(query.Question) != 1 || query.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := query.Question[0]
+
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Authoritative = true
+	response.RecursionAvailable = true
+
+	switch question.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		// local records take precedence
+		if !pool.matches(question.Name) || lookupDNSHosts(question.Name) != nil {
+			return nil
+		}
+		if question.Qtype == dns.TypeA {
+			response.Answer = append(response.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: dnsFakeIPTTL},
+				A:   pool.assign(question.Name),
+			})
+		}
+	case dns.TypePTR:
+		ip := reverseIPv4(question.Name)
+		if ip == nil || !pool.network.Contains(ip) {
+			return nil
+		}
+		name, ok := pool.lookup(ip)
+		if !ok {
+			response.Rcode = dns.RcodeNameError
+			return response
+		}
+		response.Answer = append(response.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: dnsFakeIPTTL},
+			Ptr: name,
+		})
+	default:
+		return nil
+	}
+	return response
+}
+
+// lookupFakeIP returns the host name which has been assigned to the IP
+// address of addr (host:port) by one of the running DNS proxies
+func lookupFakeIP(addr string) (host string, ok bool) {
+	ipString, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		return "", false
+	}
+	for _, p := range getRunningProxies("dns") {
+		if pool := p.(*dnsProxy).fakeIPs; pool != nil {
+			if name, ok := pool.lookup(ip); ok {
+				return strings.TrimSuffix(name, "."), true
+			}
+		}
+	}
+	return "", false
+}
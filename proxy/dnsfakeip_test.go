@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	// a /30 network has two usable addresses
+	pool, err := newFakeIPPool("198.18.0.0/30", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pool.now = func() time.Time { return now }
+
+	if ip := pool.assign("a.corp.example"); ip.String() != "198.18.0.1" {
+		t.Errorf("a got %s, expected 198.18.0.1", ip)
+	}
+	if ip := pool.assign("b.corp.example."); ip.String() != "198.18.0.2" {
+		t.Errorf("b got %s, expected 198.18.0.2", ip)
+	}
+	if ip := pool.assign("A.corp.example"); ip.String() != "198.18.0.1" {
+		t.Errorf("a got the new address %s", ip)
+	}
+
+	// the address of the least recently used name is reused
+	if ip := pool.assign("c.corp.example"); ip.String() != "198.18.0.2" {
+		t.Errorf("c got %s, expected 198.18.0.2", ip)
+	}
+	if name, ok := pool.lookup(net.ParseIP("198.18.0.2")); !ok || name != "c.corp.example." {
+		t.Errorf("198.18.0.2 is mapped to '%s', expected c.corp.example.", name)
+	}
+
+	// unused mappings expire
+	now = now.Add(time.Hour)
+	if name, ok := pool.lookup(net.ParseIP("198.18.0.1")); ok {
+		t.Errorf("198.18.0.1 is still mapped to '%s'", name)
+	}
+
+	for _, cidr := range []string{"198.18.0.0/31", "fd00::/64", "invalid"} {
+		if _, err := newFakeIPPool(cidr, nil, time.Hour); err == nil {
+			t.Errorf("the fake IP network '%s' has been accepted", cidr)
+		}
+	}
+}
+
+func TestDNSProxyFakeIP(t *testing.T) {
+	upstream := startDNSUpstream(t, 1)
+
+	p, err := NewProxy("dns", Config{
+		Listen:     "127.0.0.1:0",
+		Parameters: upstream.addr,
+		Options:    map[string]string{"fake-ip": "198.18.0.0/15", "fake-ip-domains": "corp.example"},
+		Dialer:     &countingDialer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		query := new(dns.Msg)
+		query.SetQuestion(name, qtype)
+		response, _, err := (&dns.Client{Net: "udp"}).Exchange(query, p.GetAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	response := exchange("www.corp.example.", dns.TypeA)
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "198.18.0.1" {
+		t.Fatalf("unexpected response %v", response)
+	}
+	if response := exchange("www.corp.example.", dns.TypeAAAA); response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+		t.Errorf("unexpected AAAA response %v", response)
+	}
+	response = exchange("1.0.18.198.in-addr.arpa.", dns.TypePTR)
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.PTR).Ptr != "www.corp.example." {
+		t.Errorf("unexpected PTR response %v", response)
+	}
+	if response := exchange("2.0.18.198.in-addr.arpa.", dns.TypePTR); response.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected PTR response for an unused address %v", response)
+	}
+	if upstream.queries.Load() != 0 {
+		t.Errorf("the upstream got %d queries", upstream.queries.Load())
+	}
+
+	// other domains are forwarded
+	response = exchange("www.example.", dns.TypeA)
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "10.0.0.0" {
+		t.Errorf("unexpected response %v", response)
+	}
+
+	// the transparent proxies map fake addresses back to the host name
+	if host, ok := lookupFakeIP("198.18.0.1:443"); !ok || host != "www.corp.example" {
+		t.Errorf("198.18.0.1 is mapped to '%s'", host)
+	}
+	// ResolveDNS returns the real address
+	ip, err := ResolveDNS(context.Background(), "www.corp.example")
+	if err != nil || ip.String() != "10.0.0.0" {
+		t.Errorf("ResolveDNS returned %v (%v), expected 10.0.0.0", ip, err)
+	}
+}
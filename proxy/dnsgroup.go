@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/dueckminor/go-sshtunnel/logger"
+	"github.com/miekg/dns"
+)
+
+// strategies choosing the upstream of a DNS proxy with several upstreams
+const (
+	// DNSStrategyFailover sends a query to the first healthy upstream and
+	// to the next one if it fails
+	DNSStrategyFailover = "failover"
+	// DNSStrategyFastest is like DNSStrategyFailover, but the upstreams are
+	// ordered by their round trip time, which is probed periodically
+	DNSStrategyFastest = "fastest"
+	// DNSStrategyRace sends a query to all healthy upstreams in parallel and
+	// uses the first response
+	DNSStrategyRace = "race"
+)
+
+// DefaultDNSProbeInterval is the default interval in which the upstreams of
+// a DNS proxy are probed
+const DefaultDNSProbeInterval = 30 * time.Second
+
+// DNSUpstreamStatus describes an upstream of a DNS proxy
+type DNSUpstreamStatus struct {
+	Target string
+	// Dialer is the name of the dialer of the upstream. It is empty if the
+	// dialer of the DNS proxy is used.
+	Dialer  string
+	Healthy bool
+	// RTT is the smoothed round trip time, it is 0 if it has not been
+	// measured yet
+	RTT time.Duration
+	// LastError is the reason why the upstream is unhealthy
+	LastError string
+}
+
+// dnsUpstreamTarget is an upstream in the parameters of the DNS proxy
+type dnsUpstreamTarget struct {
+	target string
+	dialer string
+}
+
+func (target dnsUpstreamTarget) String() string {
+	if len(target.dialer) == 0 {
+		return target.target
+	}
+	return target.target + "@" + target.dialer
+}
+
+// parseDNSUpstreams parses a comma separated list of upstreams. Each
+// upstream is an address (see makeTargetAddr, a host without port gets the
+// port 53), optionally followed by "@dialer" to connect using a named
+// dialer.
+func parseDNSUpstreams(parameters string) ([]dnsUpstreamTarget, error) {
+	if len(strings.TrimSpace(parameters)) == 0 {
+		target, err := makeTargetAddr("")
+		return []dnsUpstreamTarget{{target: target}}, err
+	}
+	var targets []dnsUpstreamTarget
+	for _, part := range strings.Split(parameters, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			return nil, fmt.Errorf("empty DNS upstream in '%s'", parameters)
+		}
+		var dialerName string
+		if at := strings.LastIndex(part, "@"); at >= 0 {
+			dialerName = part[at+1:]
+			part = part[:at]
+			if len(dialerName) == 0 {
+				return nil, fmt.Errorf("the DNS upstream '%s' has no dialer", part)
+			}
+		}
+		if len(part) > 0 && !strings.Contains(part, "://") {
+			part = withDefaultDNSPort(part)
+		}
+		target, err := makeTargetAddr(part)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, dnsUpstreamTarget{target: target, dialer: dialerName})
+	}
+	return targets, nil
+}
+
+// dnsUpstreamGroup sends queries to one of its members, which are chosen by
+// the strategy. Members which fail are marked as unhealthy and are only used
+// if all others fail too, until a probe or a query succeeds again.
+type dnsUpstreamGroup struct {
+	strategy      string
+	probeInterval time.Duration
+	members       []*dnsGroupMember
+
+	// lock guards the health of the members
+	lock sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type dnsGroupMember struct {
+	dnsUpstreamTarget
+	upstream dnsExchanger
+
+	healthy   bool
+	rtt       time.Duration
+	lastError string
+}
+
+// newDNSUpstreamGroup creates the upstreams of the targets. Targets without
+// dialer are connected using d. If there are several targets, they are
+// probed in the background until the group is closed.
+func newDNSUpstreamGroup(targets []dnsUpstreamTarget, strategy string, probeInterval time.Duration, d dialer.Dialer, rootCAs *x509.CertPool) *dnsUpstreamGroup {
+	group := &dnsUpstreamGroup{
+		strategy:      strategy,
+		probeInterval: probeInterval,
+		done:          make(chan struct{}),
+	}
+	for _, target := range targets {
+		var memberDialer dialer.Dialer = namedDialer(target.dialer)
+		if len(target.dialer) == 0 {
+			memberDialer = d
+		}
+		group.members = append(group.members, &dnsGroupMember{
+			dnsUpstreamTarget: target,
+			upstream:          newDNSExchanger(target.target, memberDialer, rootCAs),
+			healthy:           true,
+		})
+	}
+	if len(group.members) > 1 && probeInterval > 0 {
+		go group.probeLoop()
+	}
+	return group
+}
+
+// setDialer replaces the dialer of the members without a dialer of their
+// own
+func (group *dnsUpstreamGroup) setDialer(d dialer.Dialer) {
+	for _, member := range group.members {
+		if len(member.dialer) == 0 {
+			member.upstream.setDialer(d)
+		}
+	}
+}
+
+// close stops probing and closes the connections to the members
+func (group *dnsUpstreamGroup) close() {
+	group.closeOnce.Do(func() {
+		close(group.done)
+	})
+	for _, member := range group.members {
+		member.upstream.close()
+	}
+}
+
+// status returns the status of the members
+func (group *dnsUpstreamGroup) status() []DNSUpstreamStatus {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	result := make([]DNSUpstreamStatus, len(group.members))
+	for i, member := range group.members {
+		result[i] = DNSUpstreamStatus{
+			Target:    member.target,
+			Dialer:    member.dialer,
+			Healthy:   member.healthy,
+			RTT:       member.rtt,
+			LastError: member.lastError,
+		}
+	}
+	return result
+}
+
+// candidates returns the healthy members in the order in which they are
+// used and the unhealthy ones
+func (group *dnsUpstreamGroup) candidates() (healthy []*dnsGroupMember, unhealthy []*dnsGroupMember) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	for _, member := range group.members {
+		if member.healthy {
+			healthy = append(healthy, member)
+		} else {
+			unhealthy = append(unhealthy, member)
+		}
+	}
+	if group.strategy == DNSStrategyFastest {
+		// members which have not been measured yet come last
+		sort.SliceStable(healthy, func(i, j int) bool {
+			if healthy[i].rtt == 0 || healthy[j].rtt == 0 {
+				return healthy[j].rtt == 0 && healthy[i].rtt != 0
+			}
+			return healthy[i].rtt < healthy[j].rtt
+		})
+	}
+	return healthy, unhealthy
+}
+
+// update records the result of an exchange with member
+func (group *dnsUpstreamGroup) update(member *dnsGroupMember, rtt time.Duration, err error) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	if err != nil {
+		if member.healthy && len(group.members) > 1 {
+			logger.L.Printf("DNS: the upstream '%s' is unhealthy: %v\n", member.target, err)
+		}
+		member.healthy = false
+		member.lastError = err.Error()
+		return
+	}
+	if !member.healthy {
+		logger.L.Printf("DNS: the upstream '%s' is healthy again\n", member.target)
+	}
+	member.healthy = true
+	member.lastError = ""
+	if member.rtt == 0 {
+		member.rtt = rtt
+	} else {
+		member.rtt = (3*member.rtt + rtt) / 4
+	}
+}
+
+// exchange sends query to the members chosen by the strategy. It returns
+// the target of the member which answered, or of the last one which failed.
+func (group *dnsUpstreamGroup) exchange(ctx context.Context, query *dns.Msg) (response *dns.Msg, target string, err error) {
+	healthy, unhealthy := group.candidates()
+	if group.strategy == DNSStrategyRace && len(healthy) > 1 {
+		response, target, err = group.race(ctx, query, healthy)
+		if err == nil || ctx.Err() != nil {
+			return response, target, err
+		}
+		healthy = nil
+	}
+	for _, member := range append(healthy, unhealthy...) {
+		var rtt time.Duration
+		response, rtt, err = member.upstream.Exchange(ctx, query)
+		if ctx.Err() != nil {
+			// the query has been canceled, the member is not to blame
+			return nil, member.target, ctx.Err()
+		}
+		group.update(member, rtt, err)
+		if err == nil {
+			return response, member.target, nil
+		}
+		target = member.target
+	}
+	return nil, target, err
+}
+
+// race sends query to all members and returns the first response
+func (group *dnsUpstreamGroup) race(ctx context.Context, query *dns.Msg, members []*dnsGroupMember) (response *dns.Msg, target string, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		member   *dnsGroupMember
+		response *dns.Msg
+		rtt      time.Duration
+		err      error
+	}
+	results := make(chan result, len(members))
+	for _, member := range members {
+		go func(member *dnsGroupMember) {
+			response, rtt, err := member.upstream.Exchange(ctx, query)
+			results <- result{member, response, rtt, err}
+		}(member)
+	}
+	for range members {
+		r := <-results
+		if ctx.Err() != nil {
+			return nil, r.member.target, ctx.Err()
+		}
+		group.update(r.member, r.rtt, r.err)
+		if r.err == nil {
+			return r.response, r.member.target, nil
+		}
+		target, err = r.member.target, r.err
+	}
+	return nil, target, err
+}
+
+// probeLoop probes the members until the group is closed
+func (group *dnsUpstreamGroup) probeLoop() {
+	ticker := time.NewTicker(group.probeInterval)
+	defer ticker.Stop()
+	for {
+		group.probe()
+		select {
+		case <-group.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe sends a query for the root name servers to the unhealthy members,
+// or to all members to measure their round trip time if the strategy is
+// DNSStrategyFastest
+func (group *dnsUpstreamGroup) probe() {
+	healthy, unhealthy := group.candidates()
+	members := unhealthy
+	if group.strategy == DNSStrategyFastest {
+		members = append(healthy, unhealthy...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsExchangeTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, member := range members {
+		wg.Add(1)
+		go func(member *dnsGroupMember) {
+			defer wg.Done()
+			query := new(dns.Msg)
+			query.SetQuestion(".", dns.TypeNS)
+			_, rtt, err := member.upstream.Exchange(ctx, query)
+			select {
+			case <-group.done:
+				// the group has been closed while probing
+			default:
+				group.update(member, rtt, err)
+			}
+		}(member)
+	}
+	wg.Wait()
+}
+
+// DNSUpstreams returns the status of the upstreams of a DNS proxy. It
+// returns nil for other proxies.
+func DNSUpstreams(p Proxy) []DNSUpstreamStatus {
+	if proxy, ok := p.(*dnsProxy); ok {
+		return proxy.upstream.status()
+	}
+	return nil
+}
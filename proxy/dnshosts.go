@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// dnsHostTTL is the TTL of the answers for local records
+const dnsHostTTL = 60
+
+// dnsMaxCNAMEs limits the length of CNAME chains
+const dnsMaxCNAMEs = 8
+
+// DNSHost is a local record which is answered by the DNS proxies instead of
+// forwarding the query
+type DNSHost struct {
+	// Name is a domain name. A leading "*." makes it a wildcard, which
+	// matches all subdomains without records of their own.
+	Name string
+	// Type is one of "A", "AAAA", "CNAME" or "PTR"
+	Type  string
+	Value string
+	// Source is the hosts file the record has been loaded from. It is empty
+	// for records added by AddDNSHost.
+	Source string
+}
+
+var (
+	dnsHostsLock sync.RWMutex
+	dnsHosts     = make(map[string][]DNSHost)
+)
+
+// AddDNSHost adds a local record. If the type is empty, it is derived from
+// the value: IP addresses get A or AAAA records, host names CNAME records.
+// For A and AAAA records of names without wildcard, the PTR record is added
+// as well.
+func AddDNSHost(host DNSHost) error {
+	records, err := host.records()
+	if err != nil {
+		return err
+	}
+	dnsHostsLock.Lock()
+	defer dnsHostsLock.Unlock()
+	for _, record := range records {
+		if err = addDNSHost(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// records validates host and returns it together with its PTR record
+func (host DNSHost) records() ([]DNSHost, error) {
+	host.Name = normalizeZone(host.Name)
+	if _, ok := dns.IsDomainName(host.Name); !ok || host.Name == "." || strings.Contains(strings.TrimPrefix(host.Name, "*."), "*") {
+		return nil, fmt.Errorf("invalid host name '%s'", host.Name)
+	}
+	host.Type = strings.ToUpper(host.Type)
+	ip := net.ParseIP(host.Value)
+	if len(host.Type) == 0 {
+		switch {
+		case ip == nil:
+			host.Type = "CNAME"
+		case ip.To4() != nil:
+			host.Type = "A"
+		default:
+			host.Type = "AAAA"
+		}
+	}
+
+	switch host.Type {
+	case "A", "AAAA":
+		if ip == nil || (ip.To4() != nil) != (host.Type == "A") {
+			return nil, fmt.Errorf("invalid %s record '%s' for '%s'", host.Type, host.Value, host.Name)
+		}
+		host.Value = ip.String()
+		if strings.HasPrefix(host.Name, "*.") {
+			return []DNSHost{host}, nil
+		}
+		reverse, _ := dns.ReverseAddr(host.Value)
+		ptr := DNSHost{Name: reverse, Type: "PTR", Value: host.Name, Source: host.Source}
+		return []DNSHost{host, ptr}, nil
+	case "CNAME", "PTR":
+		host.Value = normalizeZone(host.Value)
+		if _, ok := dns.IsDomainName(host.Value); !ok || host.Value == "." {
+			return nil, fmt.Errorf("invalid %s record '%s' for '%s'", host.Type, host.Value, host.Name)
+		}
+		return []DNSHost{host}, nil
+	}
+	return nil, fmt.Errorf("unsupported record type '%s'", host.Type)
+}
+
+// addDNSHost must be called with the lock held
+func addDNSHost(host DNSHost) error {
+	records := dnsHosts[host.Name]
+	for i, record := range records {
+		if (record.Type == "CNAME") != (host.Type == "CNAME") {
+			return fmt.Errorf("'%s' can't have a CNAME record and other records", host.Name)
+		}
+		if record.Type == host.Type && (record.Value == host.Value || host.Type == "CNAME") {
+			records[i] = host
+			return nil
+		}
+	}
+	dnsHosts[host.Name] = append(records, host)
+	return nil
+}
+
+// RemoveDNSHost removes all local records of name and the PTR records
+// pointing to it
+func RemoveDNSHost(name string) error {
+	name = normalizeZone(name)
+	dnsHostsLock.Lock()
+	defer dnsHostsLock.Unlock()
+	if _, ok := dnsHosts[name]; !ok {
+		return fmt.Errorf("there is no local DNS record for '%s'", name)
+	}
+	delete(dnsHosts, name)
+	removeDNSHosts(func(host DNSHost) bool {
+		return host.Type == "PTR" && host.Value == name
+	})
+	return nil
+}
+
+// removeDNSHosts must be called with the lock held
+func removeDNSHosts(remove func(host DNSHost) bool) {
+	for name, records := range dnsHosts {
+		kept := records[:0]
+		for _, record := range records {
+			if !remove(record) {
+				kept = append(kept, record)
+			}
+		}
+		if len(kept) == 0 {
+			delete(dnsHosts, name)
+		} else {
+			dnsHosts[name] = kept
+		}
+	}
+}
+
+// ListDNSHosts returns all local records sorted by name
+func ListDNSHosts() []DNSHost {
+	dnsHostsLock.RLock()
+	defer dnsHostsLock.RUnlock()
+	var result []DNSHost
+	for _, records := range dnsHosts {
+		result = append(result, records...)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Type < result[j].Type
+	})
+	return result
+}
+
+// LoadDNSHosts reads a file in the format of /etc/hosts ("ip name
+// [alias...]") and replaces the records previously loaded from it. It
+// returns the number of host names.
+func LoadDNSHosts(filename string) (int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	hosts, err := parseDNSHosts(string(data), filename)
+	if err != nil {
+		return 0, err
+	}
+
+	var records []DNSHost
+	for _, host := range hosts {
+		hostRecords, err := host.records()
+		if err != nil {
+			return 0, err
+		}
+		records = append(records, hostRecords...)
+	}
+
+	dnsHostsLock.Lock()
+	defer dnsHostsLock.Unlock()
+	removeDNSHosts(func(host DNSHost) bool {
+		return host.Source == filename
+	})
+	for _, record := range records {
+		if err = addDNSHost(record); err != nil {
+			return 0, err
+		}
+	}
+	return len(hosts), nil
+}
+
+// parseDNSHosts parses the lines of a hosts file. Only the first name of a
+// line gets a PTR record, aliases are added as CNAME records.
+func parseDNSHosts(data string, source string) (hosts []DNSHost, err error) {
+	for i, line := range strings.Split(data, "\n") {
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("line %d: expected 'ip name [alias...]'", i+1)
+		}
+		hosts = append(hosts, DNSHost{Name: fields[1], Value: fields[0], Source: source})
+		for _, alias := range fields[2:] {
+			hosts = append(hosts, DNSHost{Name: alias, Type: "CNAME", Value: fields[1], Source: source})
+		}
+	}
+	return hosts, nil
+}
+
+// lookupDNSHosts returns a copy of the local records of name. If there are
+// no records for name itself, the records of the most specific matching
+// wildcard are returned.
+func lookupDNSHosts(name string) []DNSHost {
+	name = strings.ToLower(dns.Fqdn(name))
+	dnsHostsLock.RLock()
+	defer dnsHostsLock.RUnlock()
+	if records, ok := dnsHosts[name]; ok {
+		return append([]DNSHost(nil), records...)
+	}
+	for {
+		dot := strings.Index(name, ".")
+		if dot < 0 || dot == len(name)-1 {
+			return nil
+		}
+		name = name[dot+1:]
+		if records, ok := dnsHosts["*."+name]; ok {
+			return append([]DNSHost(nil), records...)
+		}
+	}
+}
+
+// answerLocal answers a query using the local records. It returns nil if
+// there are no records for the name of the query. The targets of CNAME
+// records without local records are resolved using the upstream.
+func (proxy *dnsProxy) answerLocal(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	if len(query.Question) != 1 || query.Question[0].Qclass != dns.ClassINET {
+		return nil, nil
+	}
+	question := query.Question[0]
+	records := lookupDNSHosts(question.Name)
+	if records == nil {
+		return nil, nil
+	}
+
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Authoritative = true
+	response.RecursionAvailable = true
+
+	name := question.Name
+	for chain := 0; records != nil; chain++ {
+		if chain == dnsMaxCNAMEs {
+			response.Rcode = dns.RcodeServerFailure
+			return response, nil
+		}
+		var cname string
+		for _, record := range records {
+			if record.Type != dns.TypeToString[question.Qtype] && record.Type != "CNAME" {
+				continue
+			}
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, dnsHostTTL, record.Type, record.Value))
+			if err != nil {
+				return nil, err
+			}
+			response.Answer = append(response.Answer, rr)
+			if record.Type == "CNAME" && question.Qtype != dns.TypeCNAME {
+				cname = record.Value
+			}
+		}
+		if len(cname) == 0 {
+			return response, nil
+		}
+		name = cname
+		records = lookupDNSHosts(name)
+	}
+
+	// the target of the CNAME record is resolved by the upstream
+	targetQuery := query.Copy()
+	targetQuery.Question[0].Name = name
+	targetResponse, _, err := proxy.query(ctx, targetQuery)
+	if err != nil {
+		return nil, err
+	}
+	response.Answer = append(response.Answer, targetResponse.Answer...)
+	response.Rcode = targetResponse.Rcode
+	return response, nil
+}
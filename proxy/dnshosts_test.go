@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func addTestDNSHost(t *testing.T, host DNSHost) {
+	t.Helper()
+	if err := AddDNSHost(host); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { RemoveDNSHost(host.Name) })
+}
+
+func TestAddDNSHost(t *testing.T) {
+	addTestDNSHost(t, DNSHost{Name: "API.customer.internal", Value: "10.0.0.5"})
+
+	hosts := ListDNSHosts()
+	if len(hosts) != 2 ||
+		hosts[0] != (DNSHost{Name: "5.0.0.10.in-addr.arpa.", Type: "PTR", Value: "api.customer.internal."}) ||
+		hosts[1] != (DNSHost{Name: "api.customer.internal.", Type: "A", Value: "10.0.0.5"}) {
+		t.Errorf("unexpected hosts: %+v", hosts)
+	}
+
+	invalid := []DNSHost{
+		{Name: "api.customer.internal", Value: "www.customer.internal"},
+		{Name: "www.customer.internal", Type: "A", Value: "2001:db8::1"},
+		{Name: "www.customer.internal", Type: "MX", Value: "mail.customer.internal"},
+		{Name: "w*.customer.internal", Value: "10.0.0.6"},
+	}
+	for _, host := range invalid {
+		if err := AddDNSHost(host); err == nil {
+			t.Errorf("%+v has been accepted", host)
+		}
+	}
+
+	// the PTR record is removed together with the host
+	if err := RemoveDNSHost("api.customer.internal"); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := ListDNSHosts(); len(hosts) != 0 {
+		t.Errorf("unexpected hosts: %+v", hosts)
+	}
+}
+
+func TestLoadDNSHosts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts")
+	write := func(data string) {
+		if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		write("")
+		LoadDNSHosts(file)
+	})
+
+	write("# test\n10.0.0.5 api.customer.internal api # alias\n2001:db8::5\tapi6.customer.internal\n")
+	if hosts, err := LoadDNSHosts(file); err != nil || hosts != 3 {
+		t.Fatalf("loaded %d hosts (%v), expected 3", hosts, err)
+	}
+	if records := lookupDNSHosts("api."); len(records) != 1 || records[0].Type != "CNAME" || records[0].Value != "api.customer.internal." {
+		t.Errorf("unexpected records of the alias: %+v", records)
+	}
+
+	// reloading replaces the records of the file
+	write("10.0.0.6 api.customer.internal\n")
+	if hosts, err := LoadDNSHosts(file); err != nil || hosts != 1 {
+		t.Fatalf("loaded %d hosts (%v), expected 1", hosts, err)
+	}
+	if hosts := ListDNSHosts(); len(hosts) != 2 || hosts[1].Value != "10.0.0.6" || hosts[1].Source != file {
+		t.Errorf("unexpected hosts: %+v", hosts)
+	}
+
+	write("api.customer.internal 10.0.0.6\n")
+	if _, err := LoadDNSHosts(file); err == nil {
+		t.Errorf("an invalid hosts file has been loaded")
+	}
+}
+
+func TestDNSProxyHosts(t *testing.T) {
+	upstream := startDNSUpstream(t, 1)
+
+	p, err := NewProxy("dns", Config{Listen: "127.0.0.1:0", Parameters: upstream.addr, Dialer: &countingDialer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	addTestDNSHost(t, DNSHost{Name: "api.customer.internal", Value: "10.1.0.5"})
+	addTestDNSHost(t, DNSHost{Name: "*.dev.customer.internal", Value: "10.1.0.6"})
+	addTestDNSHost(t, DNSHost{Name: "www.customer.internal", Value: "api.customer.internal"})
+	addTestDNSHost(t, DNSHost{Name: "cdn.customer.internal", Value: "cdn.example"})
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		query := new(dns.Msg)
+		query.SetQuestion(name, qtype)
+		response, _, err := (&dns.Client{Net: "udp"}).Exchange(query, p.GetAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		answers []string
+	}{
+		{"api.customer.internal.", dns.TypeA, []string{"10.1.0.5"}},
+		{"api.customer.internal.", dns.TypeAAAA, nil},
+		{"x.y.dev.customer.internal.", dns.TypeA, []string{"10.1.0.6"}},
+		{"www.customer.internal.", dns.TypeA, []string{"api.customer.internal.", "10.1.0.5"}},
+		{"5.0.1.10.in-addr.arpa.", dns.TypePTR, []string{"api.customer.internal."}},
+	}
+	for _, test := range tests {
+		response := exchange(test.name, test.qtype)
+		if response.Rcode != dns.RcodeSuccess || len(response.Answer) != len(test.answers) {
+			t.Errorf("%s: unexpected response %v", test.name, response)
+			continue
+		}
+		if len(response.Answer) > 0 && response.Answer[0].Header().Name != test.name {
+			t.Errorf("%s: the answer has the name %s", test.name, response.Answer[0].Header().Name)
+		}
+		for i, rr := range response.Answer {
+			var value string
+			switch rr := rr.(type) {
+			case *dns.A:
+				value = rr.A.String()
+			case *dns.CNAME:
+				value = rr.Target
+			case *dns.PTR:
+				value = rr.Ptr
+			}
+			if value != test.answers[i] {
+				t.Errorf("%s: got answer %s, expected %s", test.name, value, test.answers[i])
+			}
+		}
+	}
+	if queries := upstream.queries.Load(); queries != 0 {
+		t.Errorf("the upstream got %d queries for local records", queries)
+	}
+
+	// the target of a CNAME record without local records is forwarded
+	response := exchange("cdn.customer.internal.", dns.TypeA)
+	if len(response.Answer) != 2 || response.Answer[1].Header().Name != "cdn.example." || upstream.queries.Load() != 1 {
+		t.Errorf("unexpected response %v", response)
+	}
+
+	ip, err := ResolveDNS(context.Background(), "www.customer.internal")
+	if err != nil || ip.String() != "10.1.0.5" {
+		t.Errorf("ResolveDNS returned %v (%v), expected 10.1.0.5", ip, err)
+	}
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/logger"
+	"github.com/miekg/dns"
+)
+
+// DefaultDNSLogSize is the number of queries kept in the DNS query log
+const DefaultDNSLogSize = 1000
+
+// sources of responses which are not answered by an upstream
+const (
+	dnsSourceCache  = "cache"
+	dnsSourceLocal  = "local"
+	dnsSourceFakeIP = "fake-ip"
+)
+
+// DNSLogEntry records a query answered by a DNS proxy
+type DNSLogEntry struct {
+	// Seq numbers the entries of the log, it starts at 1
+	Seq  uint64
+	Time time.Time
+	// Proxy is the address of the DNS proxy
+	Proxy string
+	// Client is the IP address of the client
+	Client string
+	Name   string
+	Type   string
+	Rcode  string
+	// Upstream is the target which answered the query, "local" for local
+	// records or "fake-ip" for fake IP addresses. It is empty if the
+	// response has been cached.
+	Upstream string
+	Latency  time.Duration
+	Cached   bool
+	// Error is set if the query could not be answered
+	Error string
+}
+
+// DNSLogFilter selects entries of the DNS query log. Empty fields match all
+// entries.
+type DNSLogFilter struct {
+	// Since selects the entries with a higher sequence number
+	Since uint64
+	// Name selects the queries for a domain and its subdomains
+	Name   string
+	Type   string
+	Rcode  string
+	Client string
+	Proxy  string
+	// Limit selects the last entries matching the filter
+	Limit int
+}
+
+func (filter DNSLogFilter) matches(entry *DNSLogEntry) bool {
+	if entry.Seq <= filter.Since {
+		return false
+	}
+	if len(filter.Name) > 0 {
+		name := normalizeZone(filter.Name)
+		if entry.Name != name && !strings.HasSuffix(entry.Name, "."+name) {
+			return false
+		}
+	}
+	return (len(filter.Type) == 0 || strings.EqualFold(filter.Type, entry.Type)) &&
+		(len(filter.Rcode) == 0 || strings.EqualFold(filter.Rcode, entry.Rcode)) &&
+		(len(filter.Client) == 0 || filter.Client == entry.Client) &&
+		(len(filter.Proxy) == 0 || filter.Proxy == entry.Proxy)
+}
+
+// dnsQueryLog keeps the last entries in a ring buffer
+type dnsQueryLog struct {
+	lock    sync.Mutex
+	entries []DNSLogEntry
+	seq     uint64
+}
+
+var dnsLog = newDNSQueryLog(DefaultDNSLogSize)
+
+func newDNSQueryLog(size int) *dnsQueryLog {
+	return &dnsQueryLog{entries: make([]DNSLogEntry, size)}
+}
+
+// add assigns the sequence number to entry and stores it, replacing the
+// oldest entry if the log is full
+func (log *dnsQueryLog) add(entry *DNSLogEntry) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	log.seq++
+	entry.Seq = log.seq
+	log.entries[int((log.seq-1)%uint64(len(log.entries)))] = *entry
+}
+
+// list returns the entries matching filter ordered by their sequence number
+func (log *dnsQueryLog) list(filter DNSLogFilter) []DNSLogEntry {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	size := uint64(len(log.entries))
+	first := uint64(1)
+	if log.seq > size {
+		first = log.seq - size + 1
+	}
+	result := []DNSLogEntry{}
+	for seq := first; seq <= log.seq; seq++ {
+		entry := &log.entries[int((seq-1)%size)]
+		if filter.matches(entry) {
+			result = append(result, *entry)
+		}
+	}
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[len(result)-filter.Limit:]
+	}
+	return result
+}
+
+// ListDNSLog returns the entries of the DNS query log matching filter
+func ListDNSLog(filter DNSLogFilter) []DNSLogEntry {
+	return dnsLog.list(filter)
+}
+
+// dnsLogFile appends the entries of a DNS proxy to a file, one JSON object
+// per line
+type dnsLogFile struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// dnsLogRecord is the format of the lines of a dnsLogFile
+type dnsLogRecord struct {
+	Time      time.Time `json:"time"`
+	Proxy     string    `json:"proxy"`
+	Client    string    `json:"client"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Rcode     string    `json:"rcode"`
+	Upstream  string    `json:"upstream,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+	Cached    bool      `json:"cached,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func openDNSLogFile(filename string) (*dnsLogFile, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsLogFile{file: file}, nil
+}
+
+func (logFile *dnsLogFile) write(entry *DNSLogEntry) {
+	data, err := json.Marshal(dnsLogRecord{
+		Time:      entry.Time,
+		Proxy:     entry.Proxy,
+		Client:    entry.Client,
+		Name:      entry.Name,
+		Type:      entry.Type,
+		Rcode:     entry.Rcode,
+		Upstream:  entry.Upstream,
+		LatencyMS: float64(entry.Latency) / float64(time.Millisecond),
+		Cached:    entry.Cached,
+		Error:     entry.Error,
+	})
+	if err != nil {
+		return
+	}
+	logFile.lock.Lock()
+	defer logFile.lock.Unlock()
+	if _, err = logFile.file.Write(append(data, '\n')); err != nil {
+		logger.L.Println("DNS: writing the query log failed:", err)
+	}
+}
+
+func (logFile *dnsLogFile) close() error {
+	logFile.lock.Lock()
+	defer logFile.lock.Unlock()
+	return logFile.file.Close()
+}
+
+// logQuery adds a query answered by the proxy to the DNS query log and to
+// the log file of the proxy
+func (proxy *dnsProxy) logQuery(client net.Addr, query *dns.Msg, response *dns.Msg, source string, latency time.Duration, err error) {
+	entry := &DNSLogEntry{
+		Time:    time.Now(),
+		Proxy:   proxy.GetAddress(),
+		Latency: latency,
+		Cached:  source == dnsSourceCache,
+	}
+	if !entry.Cached {
+		entry.Upstream = source
+	}
+	if client != nil {
+		entry.Client = client.String()
+		if host, _, splitErr := net.SplitHostPort(entry.Client); splitErr == nil {
+			entry.Client = host
+		}
+	}
+	if len(query.Question) > 0 {
+		entry.Name = strings.ToLower(query.Question[0].Name)
+		entry.Type = dns.TypeToString[query.Question[0].Qtype]
+	}
+	switch {
+	case err != nil:
+		entry.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+		entry.Error = err.Error()
+	case response != nil:
+		entry.Rcode = dns.RcodeToString[response.Rcode]
+	}
+
+	dnsLog.add(entry)
+	if proxy.logFile != nil {
+		proxy.logFile.write(entry)
+	}
+}
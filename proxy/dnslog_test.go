@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSQueryLogRing(t *testing.T) {
+	log := newDNSQueryLog(3)
+	for _, name := range []string{"a.corp.example.", "b.other.example.", "c.corp.example.", "d.corp.example."} {
+		log.add(&DNSLogEntry{Name: name, Type: "A", Rcode: "NOERROR"})
+	}
+
+	// the oldest entry has been replaced
+	entries := log.list(DNSLogFilter{})
+	if len(entries) != 3 || entries[0].Seq != 2 || entries[2].Name != "d.corp.example." {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+
+	entries = log.list(DNSLogFilter{Name: "corp.example"})
+	if len(entries) != 2 || entries[0].Name != "c.corp.example." {
+		t.Errorf("unexpected entries for corp.example: %+v", entries)
+	}
+	entries = log.list(DNSLogFilter{Name: "corp.example", Limit: 1})
+	if len(entries) != 1 || entries[0].Name != "d.corp.example." {
+		t.Errorf("unexpected last entry for corp.example: %+v", entries)
+	}
+	entries = log.list(DNSLogFilter{Since: 3, Type: "a", Rcode: "noerror"})
+	if len(entries) != 1 || entries[0].Seq != 4 {
+		t.Errorf("unexpected entries since 3: %+v", entries)
+	}
+}
+
+func TestDNSProxyLog(t *testing.T) {
+	upstream := startDNSUpstream(t, 1)
+	logFile := filepath.Join(t.TempDir(), "queries.jsonl")
+
+	p, err := NewProxy("dns", Config{
+		Listen:     "127.0.0.1:0",
+		Parameters: upstream.addr,
+		Options:    map[string]string{"log-file": logFile},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion("host.corp.example.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		if _, _, err := (&dns.Client{Net: "udp"}).Exchange(query, p.GetAddress()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries := ListDNSLog(DNSLogFilter{Proxy: p.GetAddress()})
+	if len(entries) != 2 {
+		t.Fatalf("got %d log entries, expected 2", len(entries))
+	}
+	first, second := entries[0], entries[1]
+	if first.Client != "127.0.0.1" || first.Name != "host.corp.example." || first.Type != "A" ||
+		first.Rcode != "NOERROR" || first.Upstream != upstream.addr || first.Cached {
+		t.Errorf("unexpected entry of the first query: %+v", first)
+	}
+	if !second.Cached || len(second.Upstream) != 0 {
+		t.Errorf("the second query has not been answered from the cache: %+v", second)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines in the log file, expected 2", len(lines))
+	}
+	var record dnsLogRecord
+	if err = json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Name != "host.corp.example." || record.Upstream != upstream.addr || record.Proxy != p.GetAddress() {
+		t.Errorf("unexpected record in the log file: %s", lines[0])
+	}
+}
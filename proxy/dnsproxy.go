@@ -2,74 +2,192 @@ package proxy
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/dueckminor/go-sshtunnel/logger"
 	"github.com/dueckminor/go-sshtunnel/rules"
 	"github.com/miekg/dns"
 )
 
-var timeFormat = "2006-01-02 15:04:05"
-
-var dnsTarget = ""
-var dnsDialer dialer.Dialer
-
 func init() {
 	RegisterProxyFactory("dns", newDNSProxy)
+	rules.DNSResolver = ResolveDNS
+}
+
+// findDNSProxy returns the running DNS proxy with the given address
+// (host:port) or port. If name is empty, the DNS proxy which has been started
+// first is returned. It returns nil if there is no such proxy.
+func findDNSProxy(name string) *dnsProxy {
+	for _, p := range getRunningProxies("dns") {
+		proxy := p.(*dnsProxy)
+		if len(name) == 0 || name == proxy.GetAddress() || name == strconv.Itoa(proxy.GetPort()) {
+			return proxy
+		}
+	}
+	return nil
+}
+
+// checkDNSProxy returns an error if there is no DNS proxy with the given
+// address or port
+func checkDNSProxy(name string) error {
+	if len(name) > 0 && findDNSProxy(name) == nil {
+		return fmt.Errorf("there is no DNS proxy with address '%s'", name)
+	}
+	return nil
+}
+
+// GetDNSTarget returns the address to which the DNS proxy started first
+// forwards requests. It is empty if no DNS proxy is running.
+func GetDNSTarget() string {
+	if proxy := findDNSProxy(""); proxy != nil {
+		return proxy.target
+	}
+	return ""
 }
 
+// ResolveDNS resolves a host name using the DNS proxy selected by the
+// context (see withDNSProxy) or the DNS proxy started first. The responses
+// are shared with the cache of the DNS proxy.
 func ResolveDNS(ctx context.Context, name string) (net.IP, error) {
-	dialer := dnsDialer
-	if dialer == nil {
-		dialer = rules.GetDefaultRuleSet()
-		dnsDialer = dialer
-	}
-	customR := net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			return dialer.Dial("tcp", dnsTarget)
-		},
-	}
-	ips, err := customR.LookupIP(ctx, "ip", name)
-	if err != nil {
-		return nil, err
+	dnsName, _ := ctx.Value(dnsProxyKey{}).(string)
+	return resolveDNSWith(ctx, dnsName, name)
+}
+
+// dnsProxyKey is the context key of the DNS proxy selected by a proxy
+type dnsProxyKey struct{}
+
+// withDNSProxy returns a context in which ResolveDNS uses the DNS proxy
+// selected by dnsName (see findDNSProxy). The rule sets pass the context of
+// a connection to ResolveDNS when they resolve host names.
+func withDNSProxy(ctx context.Context, dnsName string) context.Context {
+	if len(dnsName) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, dnsProxyKey{}, dnsName)
+}
+
+// resolveDNSWith resolves a host name using the DNS proxy selected by dnsName
+// (see findDNSProxy)
+func resolveDNSWith(ctx context.Context, dnsName string, name string) (net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ip, nil
+	}
+	proxy := findDNSProxy(dnsName)
+	if proxy == nil {
+		return nil, fmt.Errorf("there is no DNS proxy to resolve '%s'", name)
+	}
+	return proxy.resolve(ctx, name)
+}
+
+// resolve returns the first IPv4 address of name, or the first IPv6 address
+// if there is no IPv4 address
+func (proxy *dnsProxy) resolve(ctx context.Context, name string) (net.IP, error) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		query := new(dns.Msg)
+		query.SetQuestion(dns.Fqdn(name), qtype)
+		response, _, err := proxy.query(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		if response.Rcode == dns.RcodeNameError {
+			break
+		}
+		if response.Rcode != dns.RcodeSuccess {
+			return nil, &net.DNSError{Err: dns.RcodeToString[response.Rcode], Name: name}
+		}
+		for _, rr := range response.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				return rr.A, nil
+			case *dns.AAAA:
+				return rr.AAAA, nil
+			}
+		}
 	}
-	return ips[0], nil
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// answer answers a query of a client. Unlike query, it uses the fake IP
+// addresses.
+func (proxy *dnsProxy) answer(ctx context.Context, query *dns.Msg) (response *dns.Msg, source string, err error) {
+	if response = proxy.answerFakeIP(query); response != nil {
+		return response, dnsSourceFakeIP, nil
+	}
+	return proxy.query(ctx, query)
 }
 
 type dnsProxy struct {
 	Dialer dialer.Dialer
-	Port   int
+
+	target string
+	// dialerName is set if the upstreams are dialed by a named dialer
+	// instead of the rule set
+	dialerName string
+	// rootCAs verify the certificates of DNS over TLS and DNS over HTTPS
+	// upstreams, the system pool is used if it is nil
+	rootCAs *x509.CertPool
+	// upstream forwards the requests to the targets using Dialer
+	upstream *dnsUpstreamGroup
+	cache    *dnsCache
+	// fakeIPs is set if the proxy answers with fake IP addresses
+	fakeIPs *fakeIPPool
+	// logFile is set if the queries are appended to a file
+	logFile *dnsLogFile
+	// zoneUpstreams are the upstreams of the DNS zones, created on demand
+	zoneLock      sync.Mutex
+	zoneUpstreams map[string]*dnsUpstreamGroup
+	// server listens on UDP, tcpServer on the same port using TCP
+	server    *dns.Server
+	tcpServer *dns.Server
 }
 
 func (proxy *dnsProxy) GetPort() int {
-	return proxy.Port
+	return addrPort(proxy.server.PacketConn.LocalAddr())
+}
+
+func (proxy *dnsProxy) GetAddress() string {
+	return proxy.server.PacketConn.LocalAddr().String()
 }
 
 func (proxy *dnsProxy) SetDialer(dialer dialer.Dialer) {
-	dnsDialer = dialer
+	if len(proxy.dialerName) > 0 {
+		// the named dialer doesn't depend on the profile
+		return
+	}
 	proxy.Dialer = dialer
+	proxy.upstream.setDialer(dialer)
+	proxy.closeZoneUpstreams()
 }
 
-func getFreeUDPPort() (int, error) {
-	addr, err := net.ResolveUDPAddr("udp", "localhost:0")
-	if err != nil {
-		return 0, err
+func (proxy *dnsProxy) Close() error {
+	removeRunningProxy(proxy)
+	ctx, cancel := context.WithTimeout(context.Background(), DrainTimeout)
+	defer cancel()
+	tcpErr := proxy.tcpServer.ShutdownContext(ctx)
+	err := proxy.server.ShutdownContext(ctx)
+	proxy.upstream.close()
+	proxy.closeZoneUpstreams()
+	if proxy.logFile != nil {
+		proxy.logFile.close()
 	}
-
-	l, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer l.Close()
-
-	return l.LocalAddr().(*net.UDPAddr).Port, nil
+	return tcpErr
 }
 
 func makeTargetAddr(parameters string) (target string, err error) {
+	if strings.Contains(parameters, "://") {
+		return makeTargetURL(parameters)
+	}
 	host, port, err := net.SplitHostPort(parameters)
 	if (err != nil) && parameters != "" {
 		return "", err
@@ -80,46 +198,223 @@ func makeTargetAddr(parameters string) (target string, err error) {
 	if port == "" {
 		port = "53"
 	}
-	return host + ":" + port, nil
+	return net.JoinHostPort(host, port), nil
 }
 
-func newDNSProxy(parameters string) (Proxy, error) {
-	port, err := getFreeUDPPort()
-	if err != nil {
+func newDNSProxy(config Config) (Proxy, error) {
+	return startDNSProxy(nil, config)
+}
+
+// NewDNSProxy starts a DNS proxy listening on the given port of all
+// interfaces
+func NewDNSProxy(dialer dialer.Dialer, port int, parameters string) (Proxy, error) {
+	return startDNSProxy(dialer, Config{Listen: strconv.Itoa(port), Parameters: parameters})
+}
+
+// The parameters of the dns proxy are a comma separated list of upstreams.
+// Each upstream is an address (host:port) or the URL of a DNS over TLS
+// (tls://host[:port]) or DNS over HTTPS (https://host[:port][/path]) server,
+// optionally followed by "@dialer" to connect using a named dialer.
+//
+// Options of the dns proxy:
+//
+//	dialer:          the name of the dialer used to connect to the upstreams
+//	                 without dialer (default: the dialer selected by the
+//	                 rules)
+//	ca:              a PEM file with the CAs of DNS over TLS and DNS over
+//	                 HTTPS upstreams (default: the system pool)
+//	cache-size:      the maximum number of cached responses
+//	                 (default: DefaultDNSCacheSize, 0 disables the cache)
+//	cache-max-ttl:   the maximum time a response is cached
+//	                 (default: DefaultDNSCacheMaxTTL)
+//	fake-ip:         an IPv4 network (like 198.18.0.0/15). If it is set, A
+//	                 queries are answered with addresses of this network,
+//	                 which the transparent proxies map back to host names.
+//	fake-ip-domains: a comma separated list of the domains which get fake
+//	                 IP addresses (default: all)
+//	fake-ip-expiry:  the time after which an unused fake IP address is
+//	                 released (default: DefaultFakeIPExpiry)
+//	log-file:        a file to which the queries are appended as JSON lines
+//	                 (see dnsLogRecord)
+//	strategy:        how the upstream of a query is chosen: DNSStrategyFailover
+//	                 (default), DNSStrategyFastest or DNSStrategyRace
+//	probe-interval:  the interval in which unhealthy upstreams (or all
+//	                 upstreams using DNSStrategyFastest) are probed
+//	                 (default: DefaultDNSProbeInterval)
+func startDNSProxy(dialer dialer.Dialer, config Config) (Proxy, error) {
+	if err := config.checkOptions("dialer", "ca", "cache-size", "cache-max-ttl",
+		"fake-ip", "fake-ip-domains", "fake-ip-expiry", "log-file",
+		"strategy", "probe-interval"); err != nil {
 		return nil, err
 	}
+	if config.Dialer != nil || dialer == nil {
+		dialer = config.dialer()
+	}
+	dialerName := config.Options["dialer"]
+	if len(dialerName) > 0 {
+		dialer = namedDialer(dialerName)
+	}
+	var rootCAs *x509.CertPool
+	if caFile := config.Options["ca"]; len(caFile) > 0 {
+		var err error
+		rootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return NewDNSProxy(nil, port, parameters)
-}
+	cacheSize := DefaultDNSCacheSize
+	if value, ok := config.Options["cache-size"]; ok {
+		var err error
+		cacheSize, err = strconv.Atoi(value)
+		if err != nil || cacheSize < 0 {
+			return nil, fmt.Errorf("invalid value of option 'cache-size': '%s'", value)
+		}
+	}
+	cacheMaxTTL := DefaultDNSCacheMaxTTL
+	if value, ok := config.Options["cache-max-ttl"]; ok {
+		var err error
+		cacheMaxTTL, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of option 'cache-max-ttl': %v", err)
+		}
+	}
 
-func NewDNSProxy(dialer dialer.Dialer, port int, parameters string) (Proxy, error) {
-	target, err := makeTargetAddr(parameters)
+	var fakeIPs *fakeIPPool
+	if cidr, ok := config.Options["fake-ip"]; ok {
+		var domains []string
+		if value := config.Options["fake-ip-domains"]; len(value) > 0 {
+			domains = strings.Split(value, ",")
+		}
+		expiry := DefaultFakeIPExpiry
+		if value, ok := config.Options["fake-ip-expiry"]; ok {
+			var err error
+			expiry, err = time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of option 'fake-ip-expiry': %v", err)
+			}
+		}
+		var err error
+		fakeIPs, err = newFakeIPPool(cidr, domains, expiry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of option 'fake-ip': %v", err)
+		}
+	}
+
+	strategy := DNSStrategyFailover
+	if value, ok := config.Options["strategy"]; ok {
+		switch value {
+		case DNSStrategyFailover, DNSStrategyFastest, DNSStrategyRace:
+			strategy = value
+		default:
+			return nil, fmt.Errorf("invalid value of option 'strategy': '%s'", value)
+		}
+	}
+	probeInterval := DefaultDNSProbeInterval
+	if value, ok := config.Options["probe-interval"]; ok {
+		var err error
+		probeInterval, err = time.ParseDuration(value)
+		if err != nil || probeInterval <= 0 {
+			return nil, fmt.Errorf("invalid value of option 'probe-interval': '%s'", value)
+		}
+	}
+
+	targets, err := parseDNSUpstreams(config.Parameters)
 	if err != nil {
 		return nil, err
 	}
+	targetStrings := make([]string, len(targets))
+	for i, target := range targets {
+		targetStrings[i] = target.String()
+	}
+	target := strings.Join(targetStrings, ",")
 
 	fmt.Fprintln(os.Stderr, "newDNSProxy:", target)
 
-	listenAddr := fmt.Sprintf(":%d", port)
+	network, listenAddr, err := listenAddress(config.Listen, AnyHost)
+	if err != nil {
+		return nil, err
+	}
+	if network != "tcp" {
+		return nil, fmt.Errorf("the DNS proxy can't listen on '%s'", listenAddr)
+	}
 
 	proxy := &dnsProxy{}
-	proxy.Port = port
-	dnsTarget = target
-	dnsDialer = dialer
+	proxy.target = target
+	proxy.dialerName = dialerName
+	proxy.rootCAs = rootCAs
+	proxy.cache = newDNSCache(cacheSize, cacheMaxTTL)
+	proxy.fakeIPs = fakeIPs
 	proxy.Dialer = dialer
-	go forwardDNS(listenAddr, target)
+
+	if logFile := config.Options["log-file"]; len(logFile) > 0 {
+		proxy.logFile, err = openDNSLogFile(logFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	proxy.upstream = newDNSUpstreamGroup(targets, strategy, probeInterval, dialer, rootCAs)
+
+	err = forwardDNS(listenAddr, proxy)
+	if err != nil {
+		proxy.upstream.close()
+		if proxy.logFile != nil {
+			proxy.logFile.close()
+		}
+		return nil, err
+	}
+
 	return proxy, nil
 }
 
-func forwardDNS(listenAddr, targetAddr string) error {
-	fmt.Printf("Forward DNS requests to: %s\n", targetAddr)
+// listenDNS creates the UDP and the TCP listener of a DNS proxy on the same
+// port. If the port is chosen by the system, it may be in use for TCP, so
+// another one is tried.
+func listenDNS(listenAddr string) (conn net.PacketConn, listener net.Listener, err error) {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for attempt := 0; attempt < 10; attempt++ {
+		conn, err = net.ListenPacket("udp", listenAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		udpPort := strconv.Itoa(addrPort(conn.LocalAddr()))
+		listener, err = net.Listen("tcp", net.JoinHostPort(host, udpPort))
+		if err == nil {
+			return conn, listener, nil
+		}
+		conn.Close()
+		if port != "0" {
+			break
+		}
+	}
+	return nil, nil, err
+}
+
+// forwardDNS starts the servers of the proxy. They are set before they are
+// started, as the handler uses them.
+func forwardDNS(listenAddr string, proxy *dnsProxy) error {
+	fmt.Printf("Forward DNS requests to: %s\n", proxy.target)
+
+	conn, listener, err := listenDNS(listenAddr)
+	if err != nil {
+		return err
+	}
 
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
 		defer func() {
 			if err := recover(); err != nil {
-				fmt.Println("panic occurred:", err)
+				logger.L.Println("DNS: panic occurred:", err)
 			}
 		}()
+		start := time.Now()
+
+		// responses to TCP clients are never truncated
+		_, isTCP := w.RemoteAddr().(*net.TCPAddr)
 
 		msgSize := uint16(dns.MinMsgSize)
 		//check if the client accepts a different udp message size
@@ -130,80 +425,36 @@ func forwardDNS(listenAddr, targetAddr string) error {
 
 		switch r.Opcode {
 		case dns.OpcodeQuery:
-
-			dnsClient := new(dns.Client)
-			dnsClient.WriteTimeout = 10 * time.Second
-			dnsClient.ReadTimeout = 10 * time.Second
-			dnsClient.Net = "tcp"
-
-			fmt.Println("----- REQUEST -----")
-			fmt.Println("Time:", time.Now().Format(timeFormat))
-			fmt.Println("LocalAddr:", w.LocalAddr())
-			fmt.Println("RemoteAddr:", w.RemoteAddr())
-			fmt.Println("OPT PackageSize:", msgSize)
-			fmt.Println(r)
-
-			response, runtime, err := dnsClient.Exchange(r, targetAddr)
+			response, source, err := proxy.answer(context.Background(), r)
+			proxy.logQuery(w.RemoteAddr(), r, response, source, time.Since(start), err)
 			if err != nil {
-				fmt.Println("----- ERROR -----")
-				fmt.Println("Time:", time.Now().Format(timeFormat))
-				fmt.Println(err)
+				failure := new(dns.Msg)
+				failure.SetRcode(r, dns.RcodeServerFailure)
+				w.WriteMsg(failure) //nolint:errcheck
+				return
 			}
 
-			fmt.Println("----- RESPONSE -----")
-			fmt.Println("Time:", time.Now().Format(timeFormat))
-			fmt.Println("Runtime:", runtime)
-			fmt.Println("LocalAddr:", w.LocalAddr())
-			fmt.Println("RemoteAddr:", w.RemoteAddr())
-			fmt.Println("Response:", response)
-
-			// as we get the response via TCP and have to send it to our client
-			// via UDP, the message size MUST NOT exceed 512 bytes.
-			// In case we get w longer response, we have to mark it as truncated
-			// and remove as many records as needed to get a message which
-			// is not longer than 512 bytes.
-			// use truncate function to compress or truncate packages.
-			response.Truncate(int(msgSize))
-
-			for {
-
-				data, err := response.Pack()
-				if err != nil {
-					fmt.Println("----- ERROR -----")
-					fmt.Println(err)
-					break
-				}
-				if len(data) <= int(msgSize) {
-					fmt.Println("----- DEFAULT UDP MESSAGE -----")
-					fmt.Println("Time:", time.Now().Format(timeFormat))
-					fmt.Println("Length:", len(data))
-					fmt.Println("Compressed:", response.Compress)
-
-					if _, err = w.Write(data); err != nil {
-						fmt.Println("----- ERROR -----")
-						fmt.Println(err)
-					}
-
-					break
-				}
-				if len(response.Answer) == 0 {
-					fmt.Println("Truncation is required, but not possible")
-					if _, err = w.Write(data); err != nil {
-						fmt.Println("----- ERROR -----")
-					}
-					break
-				}
-				fmt.Println("Truncate:", len(data))
-				fmt.Println("Answer: ", len(response.Answer))
-				fmt.Println("Length:", len(data))
+			if !isTCP {
+				// as we get the response via TCP and have to send it to our
+				// client via UDP, the message must not exceed the size
+				// accepted by the client. Records are removed and the
+				// response is marked as truncated, so that the client
+				// retries using TCP.
+				response.Truncate(int(msgSize))
+			}
+			if err = w.WriteMsg(response); err != nil {
+				logger.L.Printf("DNS: sending the response to '%v' failed: %v\n", w.RemoteAddr(), err)
 			}
 		}
 	})
-	server := &dns.Server{Addr: listenAddr, Net: "udp"}
-	err := server.ListenAndServe()
-	if err != nil {
-		panic(err)
-	}
+	var started sync.WaitGroup
+	started.Add(2)
+	proxy.server = &dns.Server{PacketConn: conn, Handler: mux, NotifyStartedFunc: started.Done}
+	proxy.tcpServer = &dns.Server{Listener: listener, Handler: mux, NotifyStartedFunc: started.Done}
+	go proxy.server.ActivateAndServe()    //nolint:errcheck
+	go proxy.tcpServer.ActivateAndServe() //nolint:errcheck
+	// the servers can't be shut down before they are started
+	started.Wait()
 	return nil
 }
 
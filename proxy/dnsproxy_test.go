@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// dnsTestUpstream is a DNS server on TCP which answers each A query with
+// the given number of records
+type dnsTestUpstream struct {
+	addr    string
+	records int
+	queries atomic.Int32
+
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func startDNSUpstream(t *testing.T, records int) *dnsTestUpstream {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dnsTestUpstream{addr: listener.Addr().String(), records: records}
+	t.Cleanup(func() {
+		listener.Close()
+		upstream.dropConnections()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream.lock.Lock()
+			upstream.conns = append(upstream.conns, conn)
+			upstream.lock.Unlock()
+			go upstream.serve(&dns.Conn{Conn: conn})
+		}
+	}()
+	return upstream
+}
+
+func (upstream *dnsTestUpstream) serve(conn *dns.Conn) {
+	var writeLock sync.Mutex
+	for {
+		query, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		upstream.queries.Add(1)
+		// answer concurrently, so that the responses may be out of order
+		go func() {
+			response := new(dns.Msg)
+			response.SetReply(query)
+			for i := 0; i < upstream.records; i++ {
+				rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 10.0.%d.%d", query.Question[0].Name, i/256, i%256))
+				response.Answer = append(response.Answer, rr)
+			}
+			writeLock.Lock()
+			conn.WriteMsg(response)
+			writeLock.Unlock()
+		}()
+	}
+}
+
+// connections returns the number of accepted connections
+func (upstream *dnsTestUpstream) connections() int {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	return len(upstream.conns)
+}
+
+func (upstream *dnsTestUpstream) dropConnections() {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	for _, conn := range upstream.conns {
+		conn.Close()
+	}
+}
+
+func TestDNSProxyTCP(t *testing.T) {
+	upstream := startDNSUpstream(t, 100)
+
+	p, err := NewProxy("dns", Config{Listen: "127.0.0.1:0", Parameters: upstream.addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion("big.corp.example.", dns.TypeA)
+
+	response, _, err := (&dns.Client{Net: "udp"}).Exchange(query, p.GetAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Truncated || len(response.Answer) == 100 {
+		t.Errorf("the UDP response has not been truncated")
+	}
+
+	response, _, err = (&dns.Client{Net: "tcp"}).Exchange(query, p.GetAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Truncated || len(response.Answer) != 100 {
+		t.Errorf("got %d records over TCP (truncated: %v), expected 100", len(response.Answer), response.Truncated)
+	}
+}
+
+func TestDNSProxyUpstream(t *testing.T) {
+	upstream := startDNSUpstream(t, 1)
+	dialer := &countingDialer{}
+
+	p, err := NewProxy("dns", Config{Listen: "127.0.0.1:0", Parameters: upstream.addr, Dialer: dialer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	resolve := func(name string) {
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		response, _, err := (&dns.Client{Net: "udp"}).Exchange(query, p.GetAddress())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(response.Answer) != 1 || response.Answer[0].Header().Name != name {
+			t.Errorf("unexpected response for %s: %v", name, response)
+		}
+	}
+
+	// concurrent queries are pipelined on a single connection
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resolve(fmt.Sprintf("host%d.corp.example.", i))
+		}(i)
+	}
+	wg.Wait()
+	if dials := dialer.dials.Load(); dials != 1 {
+		t.Errorf("the upstream has been dialed %d times, expected 1", dials)
+	}
+
+	// a new connection is established if the old one has been dropped
+	upstream.dropConnections()
+	resolve("again.corp.example.")
+	if upstream.connections() != 2 {
+		t.Errorf("got %d upstream connections, expected 2", upstream.connections())
+	}
+}
+
+// startDNSOverHTTPS starts a DNS over HTTPS server answering each A query
+// with one record. It returns the server and the file of its CA.
+func startDNSOverHTTPS(t *testing.T) (server *httptest.Server, caFile string) {
+	t.Helper()
+	server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		query := new(dns.Msg)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" || query.Unpack(data) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		response := new(dns.Msg)
+		response.SetReply(query)
+		rr, _ := dns.NewRR(query.Question[0].Name + " 60 IN A 10.0.0.1")
+		response.Answer = append(response.Answer, rr)
+		data, _ = response.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(data)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	caFile = filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return server, caFile
+}
+
+func TestDNSProxyEncryptedUpstreams(t *testing.T) {
+	dohServer, caFile := startDNSOverHTTPS(t)
+
+	// the DNS over TLS server uses the certificate of the DoH server
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", dohServer.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dotServer := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 10.0.0.2")
+		response.Answer = append(response.Answer, rr)
+		w.WriteMsg(response)
+	})}
+	go dotServer.ActivateAndServe()
+	defer dotServer.Shutdown()
+
+	tests := []struct {
+		target string
+		ip     string
+	}{
+		{dohServer.URL, "10.0.0.1"},
+		{"tls://" + listener.Addr().String(), "10.0.0.2"},
+	}
+	for _, test := range tests {
+		d := &countingDialer{}
+		p, err := NewProxy("dns", Config{
+			Listen:     "127.0.0.1:0",
+			Parameters: test.target,
+			Options:    map[string]string{"ca": caFile, "cache-size": "0"},
+			Dialer:     d,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			query := new(dns.Msg)
+			query.SetQuestion(fmt.Sprintf("host%d.corp.example.", i), dns.TypeA)
+			response, _, err := (&dns.Client{Net: "udp"}).Exchange(query, p.GetAddress())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != test.ip {
+				t.Errorf("%s: unexpected response %v", test.target, response)
+			}
+		}
+		// the connection is reused
+		if dials := d.dials.Load(); dials != 1 {
+			t.Errorf("%s: the upstream has been dialed %d times, expected 1", test.target, dials)
+		}
+		p.Close()
+	}
+
+	// the certificate isn't trusted without the CA
+	p, err := NewProxy("dns", Config{Listen: "127.0.0.1:0", Parameters: dohServer.URL, Dialer: &countingDialer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	query := new(dns.Msg)
+	query.SetQuestion("host.corp.example.", dns.TypeA)
+	response, _, err := (&dns.Client{Net: "udp"}).Exchange(query, p.GetAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got %s for an untrusted upstream, expected SERVFAIL", dns.RcodeToString[response.Rcode])
+	}
+}
+
+func TestMakeTargetAddr(t *testing.T) {
+	tests := map[string]string{
+		"":                           "127.0.0.53:53",
+		"10.0.0.2:5353":              "10.0.0.2:5353",
+		"tls://dns.example":          "tls://dns.example:853",
+		"tls://[2001:db8::1]:8853":   "tls://[2001:db8::1]:8853",
+		"https://dns.example":        "https://dns.example/dns-query",
+		"https://dns.example:8443/q": "https://dns.example:8443/q",
+		"http://dns.example":         "",
+		"tls://":                     "",
+	}
+	for parameters, expected := range tests {
+		target, err := makeTargetAddr(parameters)
+		if target != expected || (err == nil) != (expected != "") {
+			t.Errorf("'%s': got '%s' (%v), expected '%s'", parameters, target, err, expected)
+		}
+	}
+}
+
+func TestDNSProxyInstances(t *testing.T) {
+	upstream1 := startDNSUpstream(t, 1)
+	upstream2 := startDNSUpstream(t, 1)
+
+	p1, err := NewProxy("dns", Config{Listen: "127.0.0.1:0", Parameters: upstream1.addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p1.Close()
+	p2, err := NewProxy("dns", Config{Listen: "127.0.0.1:0", Parameters: upstream2.addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p2.Close()
+
+	// the DNS proxy started first is the default
+	if target := GetDNSTarget(); target != upstream1.addr {
+		t.Errorf("got DNS target %s, expected %s", target, upstream1.addr)
+	}
+	if _, err = ResolveDNS(context.Background(), "host.corp.example"); err != nil {
+		t.Fatal(err)
+	}
+	if upstream1.queries.Load() != 1 || upstream2.queries.Load() != 0 {
+		t.Errorf("the default DNS proxy hasn't used its own upstream")
+	}
+
+	// the second one is selected by its address or its port, it has its own
+	// cache
+	for _, name := range []string{p2.GetAddress(), strconv.Itoa(p2.GetPort())} {
+		if _, err = resolveDNSWith(context.Background(), name, "host.corp.example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if upstream1.queries.Load() != 1 || upstream2.queries.Load() != 1 {
+		t.Errorf("got %d and %d upstream queries, expected 1 and 1",
+			upstream1.queries.Load(), upstream2.queries.Load())
+	}
+
+	// proxies select the second one for the rules by the context of their
+	// connections
+	ctx := withDNSProxy(context.Background(), p2.GetAddress())
+	ip, err := ResolveDNS(ctx, "other.corp.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.0" || upstream2.queries.Load() != 2 {
+		t.Errorf("got %v using %d upstream queries, expected 10.0.0.0 using 2", ip, upstream2.queries.Load())
+	}
+
+	_, err = NewProxy("socks5", Config{Dialer: &countingDialer{}, Options: map[string]string{"dns": "127.0.0.1:1"}})
+	if err == nil {
+		t.Errorf("a socks5 proxy has been started with an unknown DNS proxy")
+	}
+
+	// after the first one has been closed, the second one is the default
+	p1.Close()
+	if target := GetDNSTarget(); target != upstream2.addr {
+		t.Errorf("got DNS target %s, expected %s", target, upstream2.addr)
+	}
+}
@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/miekg/dns"
+)
+
+// dnsExchangeTimeout limits the time waiting for an upstream response
+var dnsExchangeTimeout = 10 * time.Second
+
+var errDNSConnClosed = errors.New("the connection to the DNS upstream has been closed")
+
+var errDNSUpstreamClosed = errors.New("the DNS upstream has been closed")
+
+// dnsExchanger sends queries to an upstream DNS server
+type dnsExchanger interface {
+	Exchange(ctx context.Context, query *dns.Msg) (response *dns.Msg, rtt time.Duration, err error)
+	setDialer(d dialer.Dialer)
+	close()
+}
+
+// makeTargetURL validates the URL of a DNS over TLS (tls://host[:port]) or
+// DNS over HTTPS (https://host[:port][/path]) upstream and adds the default
+// port or path
+func makeTargetURL(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if len(u.Hostname()) == 0 {
+		return "", fmt.Errorf("the DNS upstream '%s' has no host", target)
+	}
+	switch u.Scheme {
+	case "tls":
+		port := u.Port()
+		if len(port) == 0 {
+			port = "853"
+		}
+		return "tls://" + net.JoinHostPort(u.Hostname(), port), nil
+	case "https":
+		if len(u.Path) == 0 {
+			u.Path = "/dns-query"
+		}
+		return u.String(), nil
+	}
+	return "", fmt.Errorf("unsupported scheme of the DNS upstream '%s'", target)
+}
+
+// newDNSExchanger creates the upstream for a target returned by
+// makeTargetAddr. The certificates of DNS over TLS and DNS over HTTPS
+// upstreams are verified using rootCAs, or the system pool if it is nil.
+func newDNSExchanger(target string, d dialer.Dialer, rootCAs *x509.CertPool) dnsExchanger {
+	switch {
+	case strings.HasPrefix(target, "https://"):
+		return newDoHUpstream(target, d, rootCAs)
+	case strings.HasPrefix(target, "tls://"):
+		upstream := newDNSUpstream(strings.TrimPrefix(target, "tls://"), d)
+		host, _, _ := net.SplitHostPort(upstream.addr)
+		upstream.tlsConfig = &tls.Config{
+			ServerName: host,
+			RootCAs:    rootCAs,
+			MinVersion: tls.VersionTLS12,
+		}
+		return upstream
+	}
+	return newDNSUpstream(target, d)
+}
+
+// namedDialer dials using a dialer registered in the dialer package
+type namedDialer string
+
+func (d namedDialer) Dial(network, addr string) (net.Conn, error) {
+	return dialer.Dial(string(d), network, addr)
+}
+
+// dnsUpstream exchanges DNS messages with an upstream server using TCP
+// connections established by a dialer. Queries are pipelined on a single
+// connection (RFC 7766), which is reused until it breaks.
+type dnsUpstream struct {
+	addr string
+	// tlsConfig is set for DNS over TLS upstreams (RFC 7858)
+	tlsConfig *tls.Config
+
+	lock   sync.Mutex
+	dialer dialer.Dialer
+	conn   *dnsUpstreamConn
+	// closed is set by close, no connections are established afterwards
+	closed bool
+}
+
+// dnsUpstreamConn is a connection to a DNS upstream. Responses are matched
+// to the queries using the message ID, which is unique per connection.
+type dnsUpstreamConn struct {
+	conn *dns.Conn
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	nextID  uint16
+	closed  bool
+}
+
+func newDNSUpstream(addr string, d dialer.Dialer) *dnsUpstream {
+	return &dnsUpstream{addr: addr, dialer: d}
+}
+
+// setDialer replaces the dialer. The current connection gets closed, as it
+// has been established by the old dialer.
+func (upstream *dnsUpstream) setDialer(d dialer.Dialer) {
+	upstream.lock.Lock()
+	upstream.dialer = d
+	upstream.lock.Unlock()
+	upstream.closeConn()
+}
+
+// close closes the current connection. Queries which are still in flight
+// fail instead of establishing a new one.
+func (upstream *dnsUpstream) close() {
+	upstream.lock.Lock()
+	upstream.closed = true
+	upstream.lock.Unlock()
+	upstream.closeConn()
+}
+
+// closeConn closes the current connection
+func (upstream *dnsUpstream) closeConn() {
+	upstream.lock.Lock()
+	conn := upstream.conn
+	upstream.conn = nil
+	upstream.lock.Unlock()
+	if conn != nil {
+		conn.close()
+	}
+}
+
+// getConn returns the current connection or establishes a new one
+func (upstream *dnsUpstream) getConn() (*dnsUpstreamConn, error) {
+	upstream.lock.Lock()
+	defer upstream.lock.Unlock()
+	if upstream.closed {
+		return nil, errDNSUpstreamClosed
+	}
+	if upstream.conn != nil && !upstream.conn.isClosed() {
+		return upstream.conn, nil
+	}
+	conn, err := upstream.dialer.Dial("tcp", upstream.addr)
+	if err != nil {
+		return nil, err
+	}
+	if upstream.tlsConfig != nil {
+		tlsConn := tls.Client(conn, upstream.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(dnsExchangeTimeout))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	upstream.conn = &dnsUpstreamConn{
+		conn:    &dns.Conn{Conn: conn},
+		pending: make(map[uint16]chan *dns.Msg),
+	}
+	go upstream.conn.readResponses()
+	return upstream.conn, nil
+}
+
+// Exchange sends a query to the upstream and waits for the response. If the
+// connection breaks, the query is repeated once using a new connection.
+func (upstream *dnsUpstream) Exchange(ctx context.Context, query *dns.Msg) (response *dns.Msg, rtt time.Duration, err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *dnsUpstreamConn
+		conn, err = upstream.getConn()
+		if err != nil {
+			return nil, 0, err
+		}
+		start := time.Now()
+		response, err = conn.exchange(ctx, query)
+		if err != errDNSConnClosed {
+			return response, time.Since(start), err
+		}
+	}
+	return nil, 0, err
+}
+
+func (conn *dnsUpstreamConn) isClosed() bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.closed
+}
+
+// close closes the connection, all pending exchanges fail
+func (conn *dnsUpstreamConn) close() {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	conn.conn.Close()
+	for id, response := range conn.pending {
+		close(response)
+		delete(conn.pending, id)
+	}
+}
+
+func (conn *dnsUpstreamConn) exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	// the ID of the query is replaced by one which is unique on this
+	// connection
+	responseChan := make(chan *dns.Msg, 1)
+	conn.lock.Lock()
+	if conn.closed {
+		conn.lock.Unlock()
+		return nil, errDNSConnClosed
+	}
+	id := conn.nextID
+	for _, used := conn.pending[id]; used; _, used = conn.pending[id] {
+		id++
+	}
+	conn.nextID = id + 1
+	conn.pending[id] = responseChan
+	conn.lock.Unlock()
+
+	defer func() {
+		conn.lock.Lock()
+		delete(conn.pending, id)
+		conn.lock.Unlock()
+	}()
+
+	request := query.Copy()
+	request.Id = id
+
+	conn.writeLock.Lock()
+	conn.conn.SetWriteDeadline(time.Now().Add(dnsExchangeTimeout))
+	err := conn.conn.WriteMsg(request)
+	conn.writeLock.Unlock()
+	if err != nil {
+		conn.close()
+		return nil, errDNSConnClosed
+	}
+
+	timer := time.NewTimer(dnsExchangeTimeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-responseChan:
+		if !ok {
+			return nil, errDNSConnClosed
+		}
+		response.Id = query.Id
+		return response, nil
+	case <-timer.C:
+		return nil, errors.New("timeout waiting for the DNS upstream")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readResponses dispatches the responses to the pending exchanges until the
+// connection breaks
+func (conn *dnsUpstreamConn) readResponses() {
+	defer conn.close()
+	for {
+		response, err := conn.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		conn.lock.Lock()
+		if responseChan, ok := conn.pending[response.Id]; ok {
+			select {
+			case responseChan <- response:
+			default:
+				// duplicate response
+			}
+		}
+		conn.lock.Unlock()
+	}
+}
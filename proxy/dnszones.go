@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DNSZone forwards the queries for a domain (and all its subdomains) to a
+// different upstream than the target of the DNS proxy (split-horizon DNS)
+type DNSZone struct {
+	// Zone is a domain name like "corp.example" or "10.in-addr.arpa"
+	Zone string
+	// Target is the address (host:port) of the upstream for the zone or the
+	// URL of a DNS over TLS or DNS over HTTPS upstream
+	Target string
+	// Dialer is the name of the dialer used to connect to the target. If it
+	// is empty, the dialer of the DNS proxy is used.
+	Dialer string
+}
+
+var (
+	dnsZonesLock sync.RWMutex
+	dnsZones     = make(map[string]DNSZone)
+)
+
+// AddDNSZone adds or replaces a zone which is used by all DNS proxies
+func AddDNSZone(zone DNSZone) error {
+	zone.Zone = normalizeZone(zone.Zone)
+	if _, ok := dns.IsDomainName(zone.Zone); !ok || zone.Zone == "." {
+		return fmt.Errorf("invalid DNS zone '%s'", zone.Zone)
+	}
+	if len(zone.Target) == 0 {
+		return fmt.Errorf("the DNS zone '%s' has no target", zone.Zone)
+	}
+	if strings.Contains(zone.Target, "://") {
+		target, err := makeTargetURL(zone.Target)
+		if err != nil {
+			return err
+		}
+		zone.Target = target
+	} else {
+		zone.Target = withDefaultDNSPort(zone.Target)
+	}
+
+	dnsZonesLock.Lock()
+	dnsZones[zone.Zone] = zone
+	dnsZonesLock.Unlock()
+	dnsZonesChanged(zone.Zone)
+	return nil
+}
+
+// RemoveDNSZone removes a zone added by AddDNSZone
+func RemoveDNSZone(name string) error {
+	name = normalizeZone(name)
+	dnsZonesLock.Lock()
+	if _, ok := dnsZones[name]; !ok {
+		dnsZonesLock.Unlock()
+		return fmt.Errorf("there is no DNS zone with name '%s'", name)
+	}
+	delete(dnsZones, name)
+	dnsZonesLock.Unlock()
+	dnsZonesChanged(name)
+	return nil
+}
+
+// ListDNSZones returns the zones added by AddDNSZone sorted by name
+func ListDNSZones() []DNSZone {
+	dnsZonesLock.RLock()
+	defer dnsZonesLock.RUnlock()
+	result := make([]DNSZone, 0, len(dnsZones))
+	for _, zone := range dnsZones {
+		result = append(result, zone)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Zone < result[j].Zone
+	})
+	return result
+}
+
+// withDefaultDNSPort adds the port 53 to an address without port. IPv6
+// addresses may be enclosed in brackets.
+func withDefaultDNSPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), "53")
+}
+
+func normalizeZone(zone string) string {
+	return strings.ToLower(dns.Fqdn(strings.TrimSpace(zone)))
+}
+
+// lookupDNSZone returns the most specific zone containing name
+func lookupDNSZone(name string) (zone DNSZone, ok bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	dnsZonesLock.RLock()
+	defer dnsZonesLock.RUnlock()
+	for {
+		if zone, ok = dnsZones[name]; ok {
+			return zone, true
+		}
+		dot := strings.Index(name, ".")
+		if dot < 0 || dot == len(name)-1 {
+			return DNSZone{}, false
+		}
+		name = name[dot+1:]
+	}
+}
+
+// dnsZonesChanged drops the connections to the zone upstreams and the cached
+// responses of the zone, as they may have been answered by another upstream
+func dnsZonesChanged(zone string) {
+	for _, p := range getRunningProxies("dns") {
+		proxy := p.(*dnsProxy)
+		proxy.closeZoneUpstreams()
+		proxy.cache.flush(zone)
+	}
+}
+
+// DNSTargetFor returns the address to which the DNS proxy forwards the
+// queries for name. It is empty if no DNS proxy has been started.
+func DNSTargetFor(name string) string {
+	target := GetDNSTarget()
+	if len(target) == 0 {
+		return ""
+	}
+	if zone, ok := lookupDNSZone(name); ok {
+		return zone.Target
+	}
+	return target
+}
+
+// upstreamFor returns the upstream which answers query
+func (proxy *dnsProxy) upstreamFor(query *dns.Msg) *dnsUpstreamGroup {
+	if len(query.Question) != 1 {
+		return proxy.upstream
+	}
+	zone, ok := lookupDNSZone(query.Question[0].Name)
+	if !ok {
+		return proxy.upstream
+	}
+
+	key := zone.Dialer + "|" + zone.Target
+	proxy.zoneLock.Lock()
+	defer proxy.zoneLock.Unlock()
+	if upstream, ok := proxy.zoneUpstreams[key]; ok {
+		return upstream
+	}
+	targets := []dnsUpstreamTarget{{target: zone.Target, dialer: zone.Dialer}}
+	upstream := newDNSUpstreamGroup(targets, DNSStrategyFailover, 0, proxy.Dialer, proxy.rootCAs)
+	if proxy.zoneUpstreams == nil {
+		proxy.zoneUpstreams = make(map[string]*dnsUpstreamGroup)
+	}
+	proxy.zoneUpstreams[key] = upstream
+	return upstream
+}
+
+// closeZoneUpstreams closes the connections to the zone upstreams. They are
+// re-established on demand.
+func (proxy *dnsProxy) closeZoneUpstreams() {
+	proxy.zoneLock.Lock()
+	upstreams := proxy.zoneUpstreams
+	proxy.zoneUpstreams = nil
+	proxy.zoneLock.Unlock()
+	for _, upstream := range upstreams {
+		upstream.close()
+	}
+}
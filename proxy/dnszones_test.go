@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func addTestDNSZone(t *testing.T, zone DNSZone) {
+	t.Helper()
+	if err := AddDNSZone(zone); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { RemoveDNSZone(zone.Zone) })
+}
+
+func TestLookupDNSZone(t *testing.T) {
+	addTestDNSZone(t, DNSZone{Zone: "corp.example", Target: "10.0.0.2"})
+	addTestDNSZone(t, DNSZone{Zone: "Lab.Corp.Example.", Target: "10.0.1.2:5353", Dialer: "lab"})
+	addTestDNSZone(t, DNSZone{Zone: "v6.example", Target: "[::1]"})
+
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"corp.example.", "10.0.0.2:53"},
+		{"www.corp.example", "10.0.0.2:53"},
+		{"host.lab.corp.example.", "10.0.1.2:5353"},
+		{"HOST.LAB.CORP.EXAMPLE.", "10.0.1.2:5353"},
+		{"host.v6.example.", "[::1]:53"},
+		{"notcorp.example.", ""},
+		{"example.", ""},
+	}
+	for _, test := range tests {
+		zone, ok := lookupDNSZone(test.name)
+		if zone.Target != test.target || ok != (test.target != "") {
+			t.Errorf("%s: got zone %+v, expected target '%s'", test.name, zone, test.target)
+		}
+	}
+
+	if err := AddDNSZone(DNSZone{Zone: ".", Target: "10.0.0.2"}); err == nil {
+		t.Errorf("the root zone has been accepted")
+	}
+	if err := AddDNSZone(DNSZone{Zone: "corp.example"}); err == nil {
+		t.Errorf("a zone without target has been accepted")
+	}
+}
+
+func TestDNSProxyZones(t *testing.T) {
+	public := startDNSUpstream(t, 1)
+	corp := startDNSUpstream(t, 1)
+	d := &countingDialer{}
+
+	p, err := NewProxy("dns", Config{Listen: "127.0.0.1:0", Parameters: public.addr, Dialer: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	addTestDNSZone(t, DNSZone{Zone: "corp.example", Target: corp.addr, Dialer: "direct"})
+
+	resolve := func(name string) {
+		t.Helper()
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		if _, _, err := (&dns.Client{Net: "udp"}).Exchange(query, p.GetAddress()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolve("www.example.")
+	resolve("www.corp.example.")
+	if _, err := ResolveDNS(context.Background(), "db.corp.example"); err != nil {
+		t.Fatal(err)
+	}
+	if public.queries.Load() != 1 || corp.queries.Load() != 2 {
+		t.Errorf("got %d public and %d corp queries, expected 1 and 2", public.queries.Load(), corp.queries.Load())
+	}
+	// the zone uses its own dialer
+	if dials := d.dials.Load(); dials != 1 {
+		t.Errorf("the dialer of the proxy has been used %d times, expected 1", dials)
+	}
+	if target := DNSTargetFor("db.corp.example"); target != corp.addr {
+		t.Errorf("got target %s for the zone, expected %s", target, corp.addr)
+	}
+
+	// the cached responses of a removed zone are dropped
+	if err := RemoveDNSZone("corp.example"); err != nil {
+		t.Fatal(err)
+	}
+	resolve("www.corp.example.")
+	if public.queries.Load() != 2 || corp.queries.Load() != 2 {
+		t.Errorf("got %d public and %d corp queries, expected 2 and 2", public.queries.Load(), corp.queries.Load())
+	}
+}
+
+func TestDNSZoneUpstreamClosed(t *testing.T) {
+	corp := startDNSUpstream(t, 1)
+	d := &countingDialer{}
+
+	p, err := NewProxy("dns", Config{Listen: "127.0.0.1:0", Parameters: unusedAddress(t), Dialer: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	addTestDNSZone(t, DNSZone{Zone: "corp.example", Target: corp.addr})
+	query := testDNSQuery("www.corp.example.")
+	upstream := p.(*dnsProxy).upstreamFor(query)
+	if _, _, err := upstream.exchange(context.Background(), query); err != nil {
+		t.Fatal(err)
+	}
+
+	// a query which is still in flight when the zones change doesn't
+	// reconnect the upstream which has been closed
+	dnsZonesChanged("corp.example.")
+	if _, _, err := upstream.exchange(context.Background(), query); err != errDNSUpstreamClosed {
+		t.Errorf("the closed upstream returned %v", err)
+	}
+	if dials := d.dials.Load(); dials != 1 {
+		t.Errorf("the upstream has been dialed %d times, expected 1", dials)
+	}
+}
@@ -2,47 +2,126 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dueckminor/go-sshtunnel/dialer"
-	"github.com/dueckminor/go-sshtunnel/rules"
+	"github.com/dueckminor/go-sshtunnel/logger"
 )
 
 type httpProxy struct {
 	Dialer dialer.Dialer
-	Port   int
+
+	listener net.Listener
+	server   *http.Server
+	// conns tracks the hijacked connections of CONNECT and Upgrade requests,
+	// which are not known to the http.Server anymore
+	conns connTracker
+
+	// transport keeps the connections of plain HTTP requests, which are
+	// established by the dialer of the proxy
+	transport    *dialerTransport
+	reverseProxy *httputil.ReverseProxy
+
+	// auth requires clients to authenticate using Proxy-Authorization
+	auth bool
+	// users are loaded from the users file of the proxy
+	users map[string]Socks5User
+	// allowList restricts the source addresses of clients
+	allowList []*net.IPNet
+	// tlsConfig is set if the proxy is an HTTPS proxy
+	tlsConfig *tls.Config
+	// dns selects the DNS proxy which resolves host names for rules with
+	// the resolve mode "dns" (see findDNSProxy)
+	dns string
 }
 
 func (proxy *httpProxy) GetPort() int {
-	return proxy.Port
+	return addrPort(proxy.listener.Addr())
+}
+
+func (proxy *httpProxy) GetAddress() string {
+	return proxy.listener.Addr().String()
 }
 
 func (proxy *httpProxy) SetDialer(dialer dialer.Dialer) {
 	proxy.Dialer = dialer
+	// pooled connections have been established by the old dialer
+	proxy.transport.CloseIdleConnections()
+}
+
+func (proxy *httpProxy) Close() error {
+	removeRunningProxy(proxy)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), DrainTimeout)
+	defer cancel()
+	err := proxy.server.Shutdown(ctx)
+	if err != nil {
+		proxy.server.Close()
+	}
+	proxy.conns.drain(DrainTimeout - time.Since(start))
+	proxy.transport.CloseIdleConnections()
+	return nil
 }
 
 func init() {
 	RegisterProxyFactory("http", newHttpProxy)
 }
 
-func newHttpProxy(parameters string) (Proxy, error) {
+// Options of the http proxy:
+//
+//	auth:  "true" requires Basic authentication using the users added by
+//	       AddSocks5User
+//	users: a users file (see loadSocks5Users), implies auth
+//	allow: a comma separated list of CIDR ranges from which clients may
+//	       connect
+//	tls, cert, key, client-ca: serve HTTPS (see serverTLSConfig)
+//	dns:   the address or port of the DNS proxy which resolves host names
+//	       for rules with the resolve mode "dns" (default: the DNS proxy
+//	       started first)
+func newHttpProxy(config Config) (Proxy, error) {
+	if err := config.checkOptions("auth", "users", "allow", "tls", "cert", "key", "client-ca", "dns"); err != nil {
+		return nil, err
+	}
+
 	proxy := &httpProxy{}
 	var err error
 
-	proxy.Dialer = rules.GetDefaultRuleSet()
+	proxy.Dialer = config.dialer()
 
-	port := 0
-	if len(parameters) > 0 {
-		port, err = strconv.Atoi(parameters)
+	if auth, ok := config.Options["auth"]; ok {
+		proxy.auth, err = strconv.ParseBool(auth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of option 'auth': %v", err)
+		}
+	}
+	if usersFile := config.Options["users"]; len(usersFile) > 0 {
+		proxy.users, err = loadSocks5Users(usersFile)
 		if err != nil {
 			return nil, err
 		}
+		proxy.auth = true
+	}
+	proxy.allowList, err = parseCIDRList(config.Options["allow"])
+	if err != nil {
+		return nil, err
+	}
+	proxy.dns = config.Options["dns"]
+	if err = checkDNSProxy(proxy.dns); err != nil {
+		return nil, err
 	}
 
-	err = proxy.start(port)
+	err = proxy.start(config.listenOrParameters(), config.Options)
 	if err != nil {
 		return nil, err
 	}
@@ -50,44 +129,135 @@ func newHttpProxy(parameters string) (Proxy, error) {
 	return proxy, nil
 }
 
-func (proxy *httpProxy) start(port int) (err error) {
-	listener, port, err := createTCPListener(port)
+func (proxy *httpProxy) start(listen string, options map[string]string) (err error) {
+	listener, err := createListener(listen, LoopbackHost)
 	if err != nil {
 		return err
 	}
+	proxy.tlsConfig, err = serverTLSConfig(options, listener.Addr())
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	proxy.listener = listener
 
-	proxy.Port = port
+	proxy.transport = &dialerTransport{proxy: proxy}
+	proxy.reverseProxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			// requests to a proxy use the absolute-form, which already
+			// contains the target. Hop-by-hop headers have been removed.
+			r.Out.URL = r.In.URL
+			r.Out.Host = r.In.Host
+		},
+		Transport: proxy.transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		},
+	}
 
 	server := &http.Server{
-		Addr: fmt.Sprintf(":%v", port),
+		ConnState: proxy.conns.trackHijacked,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect && r.Method != "RESOLVE" && !r.URL.IsAbs() {
+				// the PAC file is available without authentication
+				proxy.handleLocal(w, r)
+				return
+			}
+			user, ok := proxy.authorize(w, r)
+			if !ok {
+				return
+			}
 			if r.Method == "RESOLVE" {
 				proxy.handleResolve(w, r)
 			} else if r.Method == http.MethodConnect {
-				proxy.handleTunneling(w, r)
-			} else {
+				if proxy.mayConnect(w, user, r.Host) {
+					proxy.handleTunneling(w, r)
+				}
+			} else if proxy.mayConnect(w, user, targetAddr(r.URL)) {
 				proxy.handleHTTP(w, r)
 			}
 		}),
 	}
 
-	go func() {
-		defer listener.Close()
-		server.Serve(listener)
-	}()
+	proxy.server = server
+	var serverListener net.Listener = allowListener{Listener: listener, allowList: proxy.allowList}
+	serverListener = closeNotifyingListener{Listener: serverListener, tracker: &proxy.conns}
+	if proxy.tlsConfig != nil {
+		// the TLS handshake is done by the http.Server
+		serverListener = tls.NewListener(serverListener, proxy.tlsConfig)
+	}
+	go server.Serve(serverListener) //nolint:errcheck
 
 	return nil
 }
 
-func (proxy *httpProxy) handleTunneling(w http.ResponseWriter, r *http.Request) {
-	ip, err := ResolveDNS(context.Background(), r.URL.Hostname())
+// authorize checks the Proxy-Authorization header of a request. If the
+// proxy requires authentication and the request is not authorized, a 407
+// response is sent and false is returned.
+func (proxy *httpProxy) authorize(w http.ResponseWriter, r *http.Request) (*Socks5User, bool) {
+	if !proxy.auth {
+		return nil, true
+	}
+	name, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if ok {
+		user, known := lookupProxyUser(proxy.users, name)
+		if known && user.checkPassword(password) {
+			return &user, true
+		}
+		logger.L.Printf("HTTP: authentication of user '%s' failed\n", name)
+	}
+	w.Header().Set("Proxy-Authenticate", `Basic realm="sshtunnel"`)
+	http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+	return nil, false
+}
+
+// parseProxyAuthorization parses the credentials of a Basic
+// Proxy-Authorization header
+func parseProxyAuthorization(header string) (name, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// mayConnect checks if the user is allowed to use the dialers which handle
+// addr. If not, a 403 response is sent.
+func (proxy *httpProxy) mayConnect(w http.ResponseWriter, user *Socks5User, addr string) bool {
+	if user == nil || len(user.Dialers) == 0 {
+		return true
+	}
+	dialerNames := dialersFor(withDNSProxy(context.Background(), proxy.dns), proxy.Dialer, "tcp", addr)
+	if user.mayUse(dialerNames) {
+		return true
+	}
+	logger.L.Printf("HTTP: user '%s' is not allowed to connect to '%s' (dialers: %s)\n",
+		user.Name, addr, strings.Join(dialerNames, ","))
+	http.Error(w, "access denied", http.StatusForbidden)
+	return false
+}
+
+// targetAddr returns host:port of an absolute URL
+func targetAddr(u *url.URL) string {
+	if len(u.Port()) > 0 {
+		return u.Host
 	}
-	addr := fmt.Sprintf("%v:%v", ip, r.URL.Port())
+	port := "80"
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
 
-	dest_conn, err := proxy.Dialer.Dial("tcp", addr)
+// handleTunneling passes the host name of the target to the dialer, the
+// rules decide where it gets resolved
+func (proxy *httpProxy) handleTunneling(w http.ResponseWriter, r *http.Request) {
+	dest_conn, err := dialContext(withDNSProxy(r.Context(), proxy.dns), proxy.Dialer, "tcp", r.Host)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
@@ -101,7 +271,9 @@ func (proxy *httpProxy) handleTunneling(w http.ResponseWriter, r *http.Request)
 	}
 	client_conn, _, err := hijacker.Hijack()
 	if err != nil {
+		dest_conn.Close()
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
 
 	copy := func(destination io.WriteCloser, source io.ReadCloser) {
@@ -114,21 +286,97 @@ func (proxy *httpProxy) handleTunneling(w http.ResponseWriter, r *http.Request)
 	go copy(client_conn, dest_conn)
 }
 
+// dialerTransport keeps a pool of connections per list of dialers. An
+// http.Transport reuses idle connections by their target only, so after the
+// rules or the active profile have changed, connections established by
+// other dialers would still be used.
+type dialerTransport struct {
+	proxy *httpProxy
+
+	lock       sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func (t *dialerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := withDNSProxy(r.Context(), t.proxy.dns)
+	dialerNames := dialersFor(ctx, t.proxy.Dialer, "tcp", targetAddr(r.URL))
+	return t.transport(strings.Join(dialerNames, ",")).RoundTrip(r)
+}
+
+// transport returns the transport of a list of dialers
+func (t *dialerTransport) transport(dialerNames string) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if transport, ok := t.transports[dialerNames]; ok {
+		return transport
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialContext(withDNSProxy(ctx, t.proxy.dns), t.proxy.Dialer, network, addr)
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if t.transports == nil {
+		t.transports = make(map[string]*http.Transport)
+	}
+	t.transports[dialerNames] = transport
+	return transport
+}
+
+func (t *dialerTransport) CloseIdleConnections() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, transport := range t.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// handleHTTP forwards plain HTTP requests (including WebSocket upgrades)
 func (proxy *httpProxy) handleHTTP(w http.ResponseWriter, req *http.Request) {
-	resp, err := http.DefaultTransport.RoundTrip(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
+	proxy.reverseProxy.ServeHTTP(w, req)
+}
+
+// allowListener drops connections from clients which are not in the
+// allowList
+type allowListener struct {
+	net.Listener
+	allowList []*net.IPNet
+}
+
+func (listener allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if sourceAllowed(listener.allowList, conn.RemoteAddr()) {
+			return conn, nil
+		}
+		logger.L.Printf("HTTP: rejected connection from '%v'\n", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// handleLocal handles requests which are addressed to the proxy itself
+func (proxy *httpProxy) handleLocal(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/proxy.pac", "/wpad.dat":
+		proxy.handlePAC(w, req)
+	default:
+		http.NotFound(w, req)
 	}
-	defer resp.Body.Close()
-	proxy.copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
 }
 
 func (proxy *httpProxy) handleResolve(w http.ResponseWriter, req *http.Request) {
-	ip, err := ResolveDNS(context.Background(), req.Host)
-	fmt.Println(ip, err)
+	ip, err := resolveDNSWith(req.Context(), proxy.dns, req.Host)
+	if err != nil {
+		logger.L.Printf("HTTP: resolving '%s' failed: %v\n", req.Host, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	w.Header().Add("Host", ip.String())
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/dueckminor/go-sshtunnel/rules"
+)
+
+// countingDialer dials directly and counts the established connections
+type countingDialer struct {
+	dials atomic.Int32
+}
+
+func (dialer *countingDialer) Dial(network, addr string) (net.Conn, error) {
+	dialer.dials.Add(1)
+	return net.Dial(network, addr)
+}
+
+func TestHttpProxyForward(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("X-Custom")) != 0 {
+			t.Errorf("hop-by-hop header X-Custom has been forwarded")
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	dialer := &countingDialer{}
+	p, err := NewProxy("http", Config{Dialer: dialer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	proxyURL, _ := url.Parse("http://" + p.GetAddress())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer client.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+		req.Header.Set("Connection", "X-Custom")
+		req.Header.Set("X-Custom", "secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("got %q, expected \"hello\"", body)
+		}
+	}
+
+	if dials := dialer.dials.Load(); dials != 1 {
+		t.Errorf("the backend has been dialed %d times, expected 1", dials)
+	}
+}
+
+func TestHttpProxyRuleChange(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	// the dialer of the rule reaches the backend through another proxy
+	upstreamDialer := &countingDialer{}
+	upstream, err := NewProxy("socks5", Config{Dialer: upstreamDialer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	if err := dialer.AddDialer("http-rule-change", "socks5://"+upstream.GetAddress()); err != nil {
+		t.Fatal(err)
+	}
+
+	ruleSet := &rules.RuleSet{Name: "http-rule-change"}
+	p, err := NewProxy("http", Config{Dialer: ruleSet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	proxyURL, _ := url.Parse("http://" + p.GetAddress())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer client.CloseIdleConnections()
+
+	get := func() {
+		t.Helper()
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// the backend is dialed directly, the connection becomes idle
+	get()
+	addTestRule(t, ruleSet, control.Rule{CIDR: "127.0.0.0/8", Dialer: "http-rule-change"})
+	get()
+
+	if dials := upstreamDialer.dials.Load(); dials != 1 {
+		t.Errorf("the dialer of the new rule has been used %d times, expected 1", dials)
+	}
+}
+
+func TestHttpProxyUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer backend.Close()
+
+	p, err := NewProxy("http", Config{Dialer: &countingDialer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.GetAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET "+backend.URL+"/ws HTTP/1.1\r\nHost: "+
+		strings.TrimPrefix(backend.URL, "http://")+
+		"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, expected 101", resp.StatusCode)
+	}
+
+	io.WriteString(conn, "ping")
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ping" {
+		t.Errorf("got %q, expected \"ping\"", data)
+	}
+}
+
+func TestHttpProxyAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("Proxy-Authorization")) != 0 {
+			t.Errorf("the proxy credentials have been forwarded")
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	AddSocks5User(Socks5User{Name: "dave", Password: "secret"})
+	defer RemoveSocks5User("dave")
+
+	p, err := NewProxy("http", Config{
+		Options: map[string]string{"auth": "true"},
+		Dialer:  &countingDialer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	get := func(proxyURL string) *http.Response {
+		t.Helper()
+		u, _ := url.Parse(proxyURL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("http://" + p.GetAddress())
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("got status %d without credentials, expected 407", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Proxy-Authenticate"), "Basic ") {
+		t.Errorf("missing Basic challenge: %q", resp.Header.Get("Proxy-Authenticate"))
+	}
+	if resp = get("http://dave:wrong@" + p.GetAddress()); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("got status %d with a wrong password, expected 407", resp.StatusCode)
+	}
+	if resp = get("http://dave:secret@" + p.GetAddress()); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d with valid credentials, expected 200", resp.StatusCode)
+	}
+}
+
+// newTestCA creates a CA and a client certificate signed by it
+func newTestCA(t *testing.T) (caPEM []byte, client tls.Certificate) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caTemplate, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return caPEM, tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+}
+
+func TestHttpsProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	caPEM, clientCert := newTestCA(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewProxy("http", Config{
+		Options: map[string]string{"client-ca": caFile},
+		Dialer:  &countingDialer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	get := func(certificates []tls.Certificate) (*http.Response, error) {
+		proxyURL, _ := url.Parse("https://" + p.GetAddress())
+		transport := &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			// the proxy uses a self-signed certificate
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certificates},
+		}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get(backend.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	if _, err := get(nil); err == nil {
+		t.Errorf("the proxy accepted a client without certificate")
+	}
+	resp, err := get([]tls.Certificate{clientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, expected 200", resp.StatusCode)
+	}
+}
+
+func TestHttpsProxyCloseAfterConnect(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+
+	p, err := NewProxy("http", Config{
+		Options: map[string]string{"tls": "true"},
+		Dialer:  &countingDialer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tls.Dial("tcp", p.GetAddress(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, expected 200", resp.StatusCode)
+	}
+
+	// the open tunnel is closed after the drain timeout
+	drainTimeout := DrainTimeout
+	DrainTimeout = 100 * time.Millisecond
+	defer func() { DrainTimeout = drainTimeout }()
+	closed := make(chan error, 1)
+	go func() { closed <- p.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the proxy hangs")
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/dueckminor/go-sshtunnel/rules"
+)
+
+// ruleSetOf returns the RuleSet a proxy dialer is bound to. Proxies which
+// are not bound to a specific RuleSet use the active one.
+func ruleSetOf(d dialer.Dialer) *rules.RuleSet {
+	if ruleSet, ok := d.(*rules.RuleSet); ok {
+		return ruleSet
+	}
+	return rules.GetActiveRuleSet()
+}
+
+// pacProxies returns the proxy list of a PAC file for clients which have
+// reached the http proxy using the address host:httpPort. The keyword is
+// "PROXY" or "HTTPS" for proxies using TLS. All running socks5 proxies are
+// added as a fallback.
+func pacProxies(keyword string, host string, httpPort int) string {
+	entries := []string{keyword + " " + net.JoinHostPort(host, strconv.Itoa(httpPort))}
+	for _, socks5 := range getRunningProxies("socks5") {
+		if socks5.GetPort() == 0 {
+			// listening on a unix socket
+			continue
+		}
+		entries = append(entries, "SOCKS5 "+net.JoinHostPort(host, strconv.Itoa(socks5.GetPort())))
+	}
+	return strings.Join(entries, "; ")
+}
+
+// generatePAC creates a proxy auto-config script from the rules of ruleSet.
+// Requests matching a rule which starts with the dialer "direct" and requests
+// not matching any rule are not proxied. All other requests are sent to the proxies.
+func generatePAC(ruleSet *rules.RuleSet, proxies string) string {
+	ruleList, _ := ruleSet.ListRules()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "// generated by sshtunnel from profile %s\n", strconv.Quote(ruleSet.Name))
+	sb.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, rule := range ruleList {
+		condition := pacCondition(rule)
+		if len(condition) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "\tif (%s) {\n\t\treturn %s;\n\t}\n", condition, strconv.Quote(pacResult(rule, proxies)))
+	}
+	sb.WriteString("\treturn \"DIRECT\";\n}\n")
+	return sb.String()
+}
+
+// pacResult maps the dialer chain of a rule to the proxy list of the PAC file.
+// A chain starting with the direct dialer is not proxied, a direct dialer at
+// a later position becomes the last fallback.
+func pacResult(rule rules.Rule, proxies string) string {
+	for i, dialerName := range rule.Dialers {
+		if dialerName == dialer.DirectDialer {
+			if i == 0 {
+				return "DIRECT"
+			}
+			return proxies + "; DIRECT"
+		}
+	}
+	return proxies
+}
+
+func pacCondition(rule rules.Rule) string {
+	if len(rule.Domain) > 0 {
+		return fmt.Sprintf("host == %s || dnsDomainIs(host, %s)",
+			strconv.Quote(rule.Domain), strconv.Quote("."+rule.Domain))
+	}
+	if rule.IPNet == nil {
+		return ""
+	}
+	if ip := rule.IPNet.IP.To4(); ip != nil {
+		return fmt.Sprintf("isInNet(host, %s, %s)",
+			strconv.Quote(ip.String()), strconv.Quote(net.IP(rule.IPNet.Mask).String()))
+	}
+	// isInNet only supports IPv4, the Microsoft extension isInNetEx is
+	// available in most browsers
+	return fmt.Sprintf("typeof isInNetEx == \"function\" && isInNetEx(host, %s)",
+		strconv.Quote(rule.IPNet.String()))
+}
+
+func (proxy *httpProxy) handlePAC(w http.ResponseWriter, req *http.Request) {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	if len(host) == 0 {
+		host = "127.0.0.1"
+	}
+	keyword := "PROXY"
+	if proxy.tlsConfig != nil {
+		keyword = "HTTPS"
+	}
+	pac := generatePAC(ruleSetOf(proxy.Dialer), pacProxies(keyword, host, proxy.GetPort()))
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(pac))
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+	"github.com/dueckminor/go-sshtunnel/rules"
+)
+
+func addTestRule(t *testing.T, ruleSet *rules.RuleSet, rule control.Rule) {
+	t.Helper()
+	r, err := rules.UnMarshall(rule)
+	if err != nil {
+		t.Fatalf("UnMarshall(%v) failed: %v", rule, err)
+	}
+	ruleSet.AddRule(r)
+}
+
+func TestGeneratePAC(t *testing.T) {
+	ruleSet := &rules.RuleSet{Name: "pac"}
+	addTestRule(t, ruleSet, control.Rule{CIDR: "10.0.0.0/8"})
+	addTestRule(t, ruleSet, control.Rule{Domain: "*.corp.example"})
+	addTestRule(t, ruleSet, control.Rule{CIDR: "192.168.1.0/24", Dialer: "direct"})
+	addTestRule(t, ruleSet, control.Rule{CIDR: "fd00::/8"})
+	addTestRule(t, ruleSet, control.Rule{CIDR: "172.16.0.0/12", Dialer: "bastion-a,bastion-b,direct"})
+
+	pac := generatePAC(ruleSet, "PROXY 127.0.0.1:3128")
+
+	expected := []string{
+		`function FindProxyForURL(url, host) {`,
+		`if (isInNet(host, "10.0.0.0", "255.0.0.0")) {` + "\n\t\treturn \"PROXY 127.0.0.1:3128\";",
+		`if (host == "corp.example" || dnsDomainIs(host, ".corp.example")) {`,
+		`if (isInNet(host, "192.168.1.0", "255.255.255.0")) {` + "\n\t\treturn \"DIRECT\";",
+		`isInNetEx(host, "fd00::/8")`,
+		`return "PROXY 127.0.0.1:3128; DIRECT";`,
+		`return "DIRECT";` + "\n}",
+	}
+	for _, e := range expected {
+		if !strings.Contains(pac, e) {
+			t.Errorf("PAC does not contain %q:\n%s", e, pac)
+		}
+	}
+
+	if strings.Index(pac, "10.0.0.0") > strings.Index(pac, "corp.example") {
+		t.Error("PAC does not preserve the order of the rules")
+	}
+}
+
+func TestGeneratePAC_FollowsRuleChanges(t *testing.T) {
+	ruleSet := &rules.RuleSet{Name: "pac"}
+	before := generatePAC(ruleSet, "PROXY 127.0.0.1:3128")
+	if strings.Contains(before, "PROXY") {
+		t.Errorf("PAC of an empty RuleSet should not contain proxies:\n%s", before)
+	}
+
+	addTestRule(t, ruleSet, control.Rule{CIDR: "10.1.2.3"})
+	after := generatePAC(ruleSet, "PROXY 127.0.0.1:3128")
+	if !strings.Contains(after, `isInNet(host, "10.1.2.3", "255.255.255.255")`) {
+		t.Errorf("PAC does not contain the new rule:\n%s", after)
+	}
+}
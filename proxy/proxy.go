@@ -1,28 +1,105 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/dueckminor/go-sshtunnel/rules"
 )
 
 // Proxy is the generic interface for proxies
 type Proxy interface {
 	GetPort() int
+	// GetAddress returns the address the proxy is bound to
+	GetAddress() string
 	SetDialer(dialer dialer.Dialer)
+	// Close stops accepting new connections and waits up to DrainTimeout
+	// until the connections in flight are finished
+	Close() error
+}
+
+// Config contains the settings of a proxy
+type Config struct {
+	// Listen is the address the proxy listens on. It is either host:port,
+	// a port or the path of a unix socket. If it is empty, the default of the
+	// proxy type is used.
+	Listen string
+	// Parameters are specific to the proxy type
+	Parameters string
+	// Options are named settings which are specific to the proxy type
+	Options map[string]string
+	// Dialer is used to establish connections. If it is nil, the rules of
+	// the active profile are used.
+	Dialer dialer.Dialer
+}
+
+func (config Config) dialer() dialer.Dialer {
+	if config.Dialer != nil {
+		return config.Dialer
+	}
+	return rules.Active()
+}
+
+// contextDialer is implemented by dialers which use the context of a
+// connection, like the rule sets
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dialContext establishes a connection using d. The context is only passed
+// to dialers implementing contextDialer.
+func dialContext(ctx context.Context, d dialer.Dialer, network, addr string) (net.Conn, error) {
+	if cd, ok := d.(contextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return d.Dial(network, addr)
+}
+
+// checkOptions returns an error if the config contains options which are not
+// supported by the proxy type
+func (config Config) checkOptions(supported ...string) error {
+outer:
+	for name := range config.Options {
+		for _, s := range supported {
+			if name == s {
+				continue outer
+			}
+		}
+		return fmt.Errorf("unsupported option '%s'", name)
+	}
+	return nil
+}
+
+// listenOrParameters returns the listen address of proxies which accept
+// their port or listen address as parameters
+func (config Config) listenOrParameters() string {
+	if len(config.Listen) > 0 {
+		return config.Listen
+	}
+	return config.Parameters
 }
 
 // NewProxy creates a new proxy
-func NewProxy(proxyType, proxyParameters string) (Proxy, error) {
+func NewProxy(proxyType string, config Config) (Proxy, error) {
 	if factory, ok := proxyFactories[proxyType]; ok {
-		return factory(proxyParameters)
+		proxy, err := factory(config)
+		if err == nil {
+			addRunningProxy(proxyType, proxy)
+		}
+		return proxy, err
 	}
 
-	return nil, fmt.Errorf("failed to create proxy with type '%s' and parameters '%s'", proxyType, proxyParameters)
+	return nil, fmt.Errorf("failed to create proxy with type '%s' and parameters '%s'", proxyType, config.Parameters)
 }
 
-type proxyFactory func(parameters string) (Proxy, error)
+type proxyFactory func(config Config) (Proxy, error)
 
 var proxyFactories = make(map[string]proxyFactory)
 
@@ -32,20 +109,131 @@ func RegisterProxyFactory(proxyType string, factory proxyFactory) {
 	proxyFactories[proxyType] = factory
 }
 
-func createTCPListener(portRequested int) (listener *net.TCPListener, port int, err error) {
-	address := fmt.Sprintf(":%d", portRequested)
+type runningProxy struct {
+	proxyType string
+	proxy     Proxy
+}
 
-	addr, err := net.ResolveTCPAddr("tcp4", address)
-	listener, err = net.ListenTCP("tcp4", addr)
-	if err != nil {
-		return nil, 0, err
+var (
+	runningProxiesLock sync.RWMutex
+	runningProxies     []runningProxy
+)
+
+func addRunningProxy(proxyType string, proxy Proxy) {
+	runningProxiesLock.Lock()
+	defer runningProxiesLock.Unlock()
+	runningProxies = append(runningProxies, runningProxy{
+		proxyType: proxyType,
+		proxy:     proxy,
+	})
+}
+
+func removeRunningProxy(proxy Proxy) {
+	runningProxiesLock.Lock()
+	defer runningProxiesLock.Unlock()
+	for i, p := range runningProxies {
+		if p.proxy == proxy {
+			runningProxies = append(runningProxies[:i:i], runningProxies[i+1:]...)
+			return
+		}
 	}
+}
 
-	addr, err = net.ResolveTCPAddr(listener.Addr().Network(), listener.Addr().String())
+// getRunningProxies returns all running proxies of the given type
+func getRunningProxies(proxyType string) (proxies []Proxy) {
+	runningProxiesLock.RLock()
+	defer runningProxiesLock.RUnlock()
+	for _, p := range runningProxies {
+		if p.proxyType == proxyType {
+			proxies = append(proxies, p.proxy)
+		}
+	}
+	return proxies
+}
+
+// forwardConnection copies data in both directions until one of the
+// connections is closed
+func forwardConnection(localConn, remoteConn net.Conn) (nSend, nReceived int64, err error) {
+	done := make(chan bool)
+
+	var errSend error
+	var errReceive error
+
+	go func() {
+		defer localConn.Close()
+		defer remoteConn.Close()
+		nReceived, errReceive = io.Copy(localConn, remoteConn)
+		done <- true
+	}()
+	go func() {
+		defer localConn.Close()
+		defer remoteConn.Close()
+		nSend, errSend = io.Copy(remoteConn, localConn)
+		done <- true
+	}()
+
+	_ = <-done
+	_ = <-done
+
+	if errSend != nil {
+		err = errSend
+	} else if errReceive != nil {
+		err = errReceive
+	}
+
+	return nSend, nReceived, err
+}
+
+// Default hosts of proxy listeners
+const (
+	// LoopbackHost only accepts connections from the local machine
+	LoopbackHost = "127.0.0.1"
+	// AnyHost accepts connections on all interfaces. It is used by proxies
+	// which receive redirected traffic from other machines.
+	AnyHost = ""
+)
+
+// listenAddress splits a listen address into network and address. The
+// defaultHost is used if listen is empty or just a port.
+func listenAddress(listen, defaultHost string) (network, address string, err error) {
+	if strings.Contains(listen, "/") {
+		return "unix", listen, nil
+	}
+	if len(listen) == 0 {
+		listen = "0"
+	}
+	if _, err := strconv.ParseUint(listen, 10, 16); err == nil {
+		return "tcp", net.JoinHostPort(defaultHost, listen), nil
+	}
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return "", "", fmt.Errorf("invalid listen address '%s': %v", listen, err)
+	}
+	return "tcp", listen, nil
+}
+
+// createListener creates the listener of a stream based proxy
+func createListener(listen, defaultHost string) (net.Listener, error) {
+	network, address, err := listenAddress(listen, defaultHost)
 	if err != nil {
-		listener.Close()
-		return nil, 0, err
+		return nil, err
+	}
+	if network == "unix" {
+		// remove stale sockets of previous runs
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
 	}
+	return net.Listen(network, address)
+}
 
-	return listener, addr.Port, nil
+// addrPort returns the port of a TCP or UDP address and 0 for all other
+// addresses
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	return 0
 }
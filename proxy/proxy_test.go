@@ -0,0 +1,31 @@
+package proxy
+
+import "testing"
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		listen  string
+		network string
+		address string
+	}{
+		{"", "tcp", "127.0.0.1:0"},
+		{"1080", "tcp", "127.0.0.1:1080"},
+		{"0.0.0.0:1080", "tcp", "0.0.0.0:1080"},
+		{"[::1]:1080", "tcp", "[::1]:1080"},
+		{"/tmp/sshtunnel-socks.sock", "unix", "/tmp/sshtunnel-socks.sock"},
+	}
+	for _, test := range tests {
+		network, address, err := listenAddress(test.listen, LoopbackHost)
+		if err != nil {
+			t.Errorf("listenAddress(%q) failed: %v", test.listen, err)
+			continue
+		}
+		if network != test.network || address != test.address {
+			t.Errorf("listenAddress(%q) = %s %s, expected %s %s", test.listen, network, address, test.network, test.address)
+		}
+	}
+
+	if _, _, err := listenAddress("localhost", LoopbackHost); err == nil {
+		t.Errorf("listenAddress accepted an address without port")
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// sniffTimeout limits the time waiting for the first bytes of a client.
+// Protocols where the server speaks first are delayed by it.
+var sniffTimeout = 300 * time.Millisecond
+
+const (
+	// maxTLSRecordSize is the size of a TLS record header and the largest
+	// plaintext fragment
+	maxTLSRecordSize = 5 + 16384
+	// maxHTTPHeaderSize limits the HTTP request headers which are sniffed
+	maxHTTPHeaderSize = 8192
+)
+
+// sniffHost peeks at the first bytes a client sends and returns the host
+// name of a TLS ClientHello (SNI) or of the Host header of an HTTP/1.x
+// request. The returned connection replays all bytes which have been read.
+func sniffHost(conn net.Conn) (host string, sniffedConn net.Conn) {
+	reader := bufio.NewReaderSize(conn, maxTLSRecordSize)
+	sniffedConn = &bufferedConn{Conn: conn, reader: reader}
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", sniffedConn
+	}
+	if first[0] == 0x16 {
+		return sniffTLS(reader), sniffedConn
+	}
+	if first[0] >= 'A' && first[0] <= 'Z' {
+		return sniffHTTP(reader), sniffedConn
+	}
+	return "", sniffedConn
+}
+
+// sniffTLS returns the server name of a ClientHello which is sent in a
+// single TLS record
+func sniffTLS(reader *bufio.Reader) string {
+	header, err := reader.Peek(5)
+	if err != nil {
+		return ""
+	}
+	length := int(header[3])<<8 | int(header[4])
+	record, err := reader.Peek(5 + length)
+	if err != nil {
+		return ""
+	}
+	return parseClientHelloSNI(record[5:])
+}
+
+// parseClientHelloSNI extracts the server_name extension (RFC 6066) of a
+// ClientHello handshake message
+func parseClientHelloSNI(data []byte) string {
+	s := cryptobyte.String(data)
+	var msgType uint8
+	var hello cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&hello) {
+		return ""
+	}
+	var sessionID, cipherSuites, compression, extensions cryptobyte.String
+	if !hello.Skip(2+32) ||
+		!hello.ReadUint8LengthPrefixed(&sessionID) ||
+		!hello.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!hello.ReadUint8LengthPrefixed(&compression) ||
+		!hello.ReadUint16LengthPrefixed(&extensions) {
+		return ""
+	}
+	for !extensions.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return ""
+		}
+		if extType != 0 {
+			continue
+		}
+		var names cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&names) {
+			return ""
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == 0 {
+				return string(name)
+			}
+		}
+	}
+	return ""
+}
+
+// sniffHTTP returns the host of the Host header of an HTTP/1.x request
+func sniffHTTP(reader *bufio.Reader) string {
+	var data []byte
+	for {
+		data, _ = reader.Peek(reader.Buffered())
+		if bytes.Contains(data, []byte("\r\n\r\n")) {
+			break
+		}
+		if len(data) >= maxHTTPHeaderSize {
+			return ""
+		}
+		// wait for more data
+		if _, err := reader.Peek(len(data) + 1); err != nil {
+			return ""
+		}
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		return req.Host
+	}
+	return host
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// sniffClient sends data using the client side of a pipe and sniffs it on
+// the server side
+func sniffClient(t *testing.T, client func(conn net.Conn)) (string, net.Conn) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	go client(clientConn)
+	host, conn := sniffHost(serverConn)
+	return host, conn
+}
+
+func TestSniffTLS(t *testing.T) {
+	host, conn := sniffClient(t, func(conn net.Conn) {
+		tls.Client(conn, &tls.Config{ServerName: "www.corp.example"}).Handshake()
+	})
+	defer conn.Close()
+	if host != "www.corp.example" {
+		t.Errorf("got host '%s', expected 'www.corp.example'", host)
+	}
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 0x16 {
+		t.Errorf("the ClientHello has not been replayed")
+	}
+}
+
+func TestSniffHTTP(t *testing.T) {
+	request := "GET / HTTP/1.1\r\nHost: intranet.corp.example:8080\r\n\r\n"
+	host, conn := sniffClient(t, func(conn net.Conn) {
+		io.WriteString(conn, request)
+	})
+	defer conn.Close()
+	if host != "intranet.corp.example" {
+		t.Errorf("got host '%s', expected 'intranet.corp.example'", host)
+	}
+	data := make([]byte, len(request))
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != request {
+		t.Errorf("got %q, expected %q", data, request)
+	}
+}
+
+func TestSniffOther(t *testing.T) {
+	host, conn := sniffClient(t, func(conn net.Conn) {
+		conn.Write([]byte{0, 1, 2, 3})
+	})
+	defer conn.Close()
+	if len(host) != 0 {
+		t.Errorf("got host '%s' for binary data", host)
+	}
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/dueckminor/go-sshtunnel/logger"
+)
+
+// SOCKS4 reply codes
+const (
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+type socks4Proxy struct {
+	Dialer dialer.Dialer
+
+	listener  net.Listener
+	conns     connTracker
+	allowList []*net.IPNet
+	// dns selects the DNS proxy which resolves host names for rules with
+	// the resolve mode "dns" (see findDNSProxy)
+	dns string
+}
+
+func (proxy *socks4Proxy) GetPort() int {
+	return addrPort(proxy.listener.Addr())
+}
+
+func (proxy *socks4Proxy) GetAddress() string {
+	return proxy.listener.Addr().String()
+}
+
+func (proxy *socks4Proxy) SetDialer(dialer dialer.Dialer) {
+	proxy.Dialer = dialer
+}
+
+func (proxy *socks4Proxy) Close() error {
+	removeRunningProxy(proxy)
+	err := proxy.listener.Close()
+	proxy.conns.drain(DrainTimeout)
+	return err
+}
+
+func init() {
+	RegisterProxyFactory("socks4", newSocks4Proxy)
+}
+
+// Options of the socks4 proxy:
+//
+//	allow: a comma separated list of CIDR ranges from which clients may
+//	       connect
+//	dns:   the address or port of the DNS proxy which resolves host names
+//	       for rules with the resolve mode "dns" (default: the DNS proxy
+//	       started first)
+func newSocks4Proxy(config Config) (Proxy, error) {
+	if err := config.checkOptions("allow", "dns"); err != nil {
+		return nil, err
+	}
+
+	proxy := &socks4Proxy{}
+	var err error
+
+	proxy.Dialer = config.dialer()
+
+	proxy.allowList, err = parseCIDRList(config.Options["allow"])
+	if err != nil {
+		return nil, err
+	}
+
+	proxy.dns = config.Options["dns"]
+	if err = checkDNSProxy(proxy.dns); err != nil {
+		return nil, err
+	}
+
+	proxy.listener, err = createListener(config.listenOrParameters(), LoopbackHost)
+	if err != nil {
+		return nil, err
+	}
+
+	go proxy.serve()
+	return proxy, nil
+}
+
+func (proxy *socks4Proxy) serve() {
+	for {
+		conn, err := proxy.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.L.Println("SOCKS4: accept failed:", err)
+			continue
+		}
+		if !sourceAllowed(proxy.allowList, conn.RemoteAddr()) {
+			logger.L.Printf("SOCKS4: rejected connection from '%v'\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		proxy.conns.serve(conn, func(conn net.Conn) {
+			defer conn.Close()
+			serveSocks4(conn, bufio.NewReader(conn), proxy.Dialer, proxy.dns) //nolint:errcheck
+		})
+	}
+}
+
+// serveSocks4 handles a SOCKS4 or SOCKS4a CONNECT request. The request is
+// read from reader, which may contain bytes already peeked from conn.
+func serveSocks4(conn net.Conn, reader *bufio.Reader, d dialer.Dialer, dnsName string) error {
+	addr, err := readSocks4Request(reader)
+	if err != nil {
+		sendSocks4Reply(conn, socks4Rejected, nil) //nolint:errcheck
+		logger.L.Println("SOCKS4:", err)
+		return err
+	}
+
+	fmt.Printf("SOCKS4: connect to '%v'...\n", addr)
+
+	target, err := dialContext(withDNSProxy(context.Background(), dnsName), d, "tcp", addr)
+	if err != nil {
+		sendSocks4Reply(conn, socks4Rejected, nil) //nolint:errcheck
+		logger.L.Printf("SOCKS4: connect to '%v' failed: %v\n", addr, err)
+		return err
+	}
+	defer target.Close()
+
+	localAddr, _ := target.LocalAddr().(*net.TCPAddr)
+	if err := sendSocks4Reply(conn, socks4Granted, localAddr); err != nil {
+		return err
+	}
+
+	// the client may have sent data together with the request
+	if n := reader.Buffered(); n > 0 {
+		data, _ := reader.Peek(n)
+		if _, err := target.Write(data); err != nil {
+			return err
+		}
+	}
+	_, _, err = forwardConnection(conn, target)
+	return err
+}
+
+// readSocks4Request reads a CONNECT request and returns the destination
+// address. SOCKS4a host names are not resolved, the rules decide where they
+// get resolved.
+func readSocks4Request(reader *bufio.Reader) (string, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != 4 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != 1 {
+		return "", fmt.Errorf("unsupported SOCKS4 command %d", header[1])
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(header[2:4])))
+	ip := net.IP(header[4:8])
+
+	// the user id is ignored
+	if _, err := readSocks4String(reader); err != nil {
+		return "", err
+	}
+
+	// SOCKS4a: 0.0.0.x (x != 0) is followed by a host name
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := readSocks4String(reader)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// maxSocks4String limits the length of the user id and the host name of a
+// request including the terminating NUL
+const maxSocks4String = 256
+
+// readSocks4String reads a NUL terminated string. It reads byte by byte, so
+// that clients can't make the proxy buffer strings of any length.
+func readSocks4String(reader *bufio.Reader) (string, error) {
+	s := make([]byte, 0, 32)
+	for len(s) < maxSocks4String {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(s), nil
+		}
+		s = append(s, b)
+	}
+	return "", errors.New("SOCKS4 request field too long")
+}
+
+// bufferedConn is a connection from which some bytes have already been read
+// into a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func sendSocks4Reply(w io.Writer, code byte, addr *net.TCPAddr) error {
+	reply := make([]byte, 8)
+	reply[1] = code
+	if addr != nil {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(reply[2:4], uint16(addr.Port))
+			copy(reply[4:], ip4)
+		}
+	}
+	_, err := w.Write(reply)
+	return err
+}
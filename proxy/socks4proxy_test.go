@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/dueckminor/go-sshtunnel/rules"
+)
+
+func startTCPEcho(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func socks4Echo(t *testing.T, proxyAddr string, request []byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the payload is sent together with the request
+	conn.Write(append(request, "ping"...))
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks4Granted {
+		t.Fatalf("got reply code %x, expected %x", reply[1], socks4Granted)
+	}
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ping" {
+		t.Errorf("got %q, expected \"ping\"", data)
+	}
+}
+
+func TestSocks4(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	port := uint16(echo.Addr().(*net.TCPAddr).Port)
+
+	socks4Request := binary.BigEndian.AppendUint16([]byte{4, 1}, port)
+	socks4Request = append(socks4Request, 127, 0, 0, 1)
+	socks4Request = append(socks4Request, "user\x00"...)
+
+	socks4aRequest := binary.BigEndian.AppendUint16([]byte{4, 1}, port)
+	socks4aRequest = append(socks4aRequest, 0, 0, 0, 1)
+	socks4aRequest = append(socks4aRequest, "user\x00localhost\x00"...)
+
+	for _, proxyType := range []string{"socks4", "socks5"} {
+		p, err := NewProxy(proxyType, Config{Dialer: &rules.RuleSet{Name: "socks4"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		socks4Echo(t, p.GetAddress(), socks4Request)
+		socks4Echo(t, p.GetAddress(), socks4aRequest)
+		p.Close()
+	}
+}
+
+func TestReadSocks4String(t *testing.T) {
+	s, err := readSocks4String(bufio.NewReader(strings.NewReader("user\x00rest")))
+	if err != nil || s != "user" {
+		t.Errorf("got %q (%v), expected \"user\"", s, err)
+	}
+	// the string is rejected before the terminating NUL has been received
+	long := strings.Repeat("x", maxSocks4String) + "\x00"
+	if _, err := readSocks4String(bufio.NewReader(strings.NewReader(long))); err == nil {
+		t.Errorf("a string of %d bytes has been accepted", len(long))
+	}
+}
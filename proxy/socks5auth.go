@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	// cSpell:ignore armon
+	socks5 "github.com/armon/go-socks5"
+	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/dueckminor/go-sshtunnel/logger"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Socks5User is a user who may authenticate at SOCKS5 proxies which require
+// authentication (RFC 1929)
+type Socks5User struct {
+	Name string
+	// Password is either plain text or a bcrypt hash
+	Password string
+	// Dialers restricts the dialers the user may use. If it is empty, all
+	// dialers are allowed.
+	Dialers []string
+}
+
+var (
+	socks5UsersLock sync.RWMutex
+	socks5Users     = make(map[string]Socks5User)
+)
+
+// AddSocks5User adds or replaces a user which is known by all SOCKS5
+// proxies
+func AddSocks5User(user Socks5User) error {
+	if err := user.validate(); err != nil {
+		return err
+	}
+	socks5UsersLock.Lock()
+	defer socks5UsersLock.Unlock()
+	socks5Users[user.Name] = user
+	return nil
+}
+
+// RemoveSocks5User removes a user added by AddSocks5User
+func RemoveSocks5User(name string) error {
+	socks5UsersLock.Lock()
+	defer socks5UsersLock.Unlock()
+	if _, ok := socks5Users[name]; !ok {
+		return fmt.Errorf("there is no SOCKS5 user with name '%s'", name)
+	}
+	delete(socks5Users, name)
+	return nil
+}
+
+// ListSocks5Users returns the users added by AddSocks5User sorted by name
+func ListSocks5Users() []Socks5User {
+	socks5UsersLock.RLock()
+	defer socks5UsersLock.RUnlock()
+	result := make([]Socks5User, 0, len(socks5Users))
+	for _, user := range socks5Users {
+		result = append(result, user)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func (user Socks5User) validate() error {
+	if len(user.Name) == 0 || len(user.Name) > 255 {
+		return fmt.Errorf("invalid SOCKS5 user name '%s'", user.Name)
+	}
+	if len(user.Password) == 0 {
+		return fmt.Errorf("the SOCKS5 user '%s' has no password", user.Name)
+	}
+	return nil
+}
+
+func (user Socks5User) checkPassword(password string) bool {
+	if strings.HasPrefix(user.Password, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+}
+
+// mayUse checks if the user is allowed to use all of the given dialers
+func (user Socks5User) mayUse(dialerNames []string) bool {
+	if len(user.Dialers) == 0 {
+		return true
+	}
+	for _, dialerName := range dialerNames {
+		allowed := false
+		for _, d := range user.Dialers {
+			if d == dialerName {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// loadSocks5Users reads a users file. Each line has the format
+// "name:password[:dialer,...]", where password is plain text or a bcrypt
+// hash. Empty lines and lines starting with '#' are ignored.
+func loadSocks5Users(filename string) (map[string]Socks5User, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseSocks5Users(string(data))
+}
+
+func parseSocks5Users(data string) (map[string]Socks5User, error) {
+	users := make(map[string]Socks5User)
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected 'name:password[:dialers]'", i+1)
+		}
+		user := Socks5User{Name: fields[0], Password: fields[1]}
+		if len(fields) > 2 && len(fields[2]) > 0 {
+			user.Dialers = strings.Split(fields[2], ",")
+		}
+		if err := user.validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		users[user.Name] = user
+	}
+	return users, nil
+}
+
+// parseCIDRList parses a comma separated list of CIDR ranges or IP addresses
+func parseCIDRList(list string) (result []*net.IPNet, err error) {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// sourceAllowed checks if a client may connect to the proxy. Clients
+// connecting via unix sockets are always allowed.
+func sourceAllowed(allowList []*net.IPNet, addr net.Addr) bool {
+	if len(allowList) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, ipNet := range allowList {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupProxyUser returns a user of a users file or a user added by
+// AddSocks5User
+func lookupProxyUser(users map[string]Socks5User, name string) (Socks5User, bool) {
+	if user, ok := users[name]; ok {
+		return user, true
+	}
+	socks5UsersLock.RLock()
+	defer socks5UsersLock.RUnlock()
+	user, ok := socks5Users[name]
+	return user, ok
+}
+
+// dialersFor returns the names of the dialers a proxy dialer uses for addr
+func dialersFor(ctx context.Context, d dialer.Dialer, network, addr string) []string {
+	if rule, ok := ruleSetOf(d).MatchContext(ctx, network, addr); ok {
+		return rule.Dialers
+	}
+	return []string{dialer.DirectDialer}
+}
+
+// lookupUser returns a user of the users file of the proxy or a user added
+// by AddSocks5User
+func (proxy *socks5Proxy) lookupUser(name string) (Socks5User, bool) {
+	return lookupProxyUser(proxy.users, name)
+}
+
+// implements the socks5 CredentialStore interface
+func (proxy *socks5Proxy) Valid(name, password string) bool {
+	user, ok := proxy.lookupUser(name)
+	if ok && user.checkPassword(password) {
+		return true
+	}
+	logger.L.Printf("SOCKS5: authentication of user '%s' failed\n", name)
+	return false
+}
+
+// requestUser returns the user who has authenticated the request or nil
+// if the proxy doesn't require authentication
+func (proxy *socks5Proxy) requestUser(request *socks5.Request) (*Socks5User, bool) {
+	if request.AuthContext == nil || request.AuthContext.Method != socks5.UserPassAuth {
+		return nil, true
+	}
+	user, ok := proxy.lookupUser(request.AuthContext.Payload["Username"])
+	if !ok {
+		return nil, false
+	}
+	return &user, true
+}
+
+// implements the socks5 RuleSet interface. The go-socks5 library doesn't
+// support UDP ASSOCIATE and has no hook for other commands, the RuleSet is
+// the only one which is called with the request before the command is
+// dispatched. So UDP ASSOCIATE requests are handled here on the connection
+// of the session, the library only sees a rejected request.
+func (session *socks5Session) Allow(ctx context.Context, request *socks5.Request) (context.Context, bool) {
+	if request.Command == socks5.AssociateCommand {
+		user, ok := session.proxy.requestUser(request)
+		if ok && request.RemoteAddr != nil {
+			session.handleAssociate(request, user)
+		}
+		return ctx, false
+	}
+	return session.proxy.Allow(ctx, request)
+}
+
+// Allow checks the CONNECT requests. Users may only connect to addresses
+// which are dialed using the dialers they are allowed to use.
+func (proxy *socks5Proxy) Allow(ctx context.Context, request *socks5.Request) (context.Context, bool) {
+	user, ok := proxy.requestUser(request)
+	if !ok {
+		return ctx, false
+	}
+	if request.Command != socks5.ConnectCommand || user == nil || len(user.Dialers) == 0 {
+		return ctx, true
+	}
+	if dialerNames, ok := proxy.userDialers(ctx, user, request.DestAddr.Address()); !ok {
+		logger.L.Printf("SOCKS5: user '%s' is not allowed to connect to '%v' (dialers: %s)\n",
+			user.Name, request.DestAddr, strings.Join(dialerNames, ","))
+		return ctx, false
+	}
+	return ctx, true
+}
+
+// userDialers returns the names of the dialers the proxy uses for addr and
+// checks if the user may use them. It is used for CONNECT requests and for
+// the datagrams of UDP associations.
+func (proxy *socks5Proxy) userDialers(ctx context.Context, user *Socks5User, addr string) ([]string, bool) {
+	dialerNames := dialersFor(ctx, proxy.Dialer, "tcp", addr)
+	return dialerNames, user == nil || user.mayUse(dialerNames)
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+	"github.com/dueckminor/go-sshtunnel/rules"
+)
+
+// socks5Connect performs a SOCKS5 handshake with user/password
+// authentication and returns the reply code of the CONNECT request or -1 if
+// the authentication failed
+func socks5Connect(t *testing.T, proxyAddr, user, password, target string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{5, 1, 2})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return -1
+	}
+	if reply[1] != 2 {
+		return -1
+	}
+
+	auth := []byte{1, byte(len(user))}
+	auth = append(auth, user...)
+	auth = append(auth, byte(len(password)))
+	auth = append(auth, password...)
+	conn.Write(auth)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		return -1
+	}
+
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", target)
+	request := []byte{5, 1, 0, 1}
+	request = append(request, tcpAddr.IP.To4()...)
+	request = binary.BigEndian.AppendUint16(request, uint16(tcpAddr.Port))
+	conn.Write(request)
+	response := make([]byte, 10)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	return int(response[1])
+}
+
+func TestSocks5Auth(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	usersFile := filepath.Join(t.TempDir(), "users")
+	ioutil.WriteFile(usersFile, []byte("# test users\nalice:secret\nbob:secret:office\n"), 0600)
+
+	p, err := NewProxy("socks5", Config{Options: map[string]string{"users": usersFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	ruleSet := &rules.RuleSet{Name: "socks5-auth"}
+	addTestRule(t, ruleSet, control.Rule{CIDR: "10.0.0.0/8", Dialer: "office"})
+	p.SetDialer(ruleSet)
+
+	if code := socks5Connect(t, p.GetAddress(), "alice", "wrong", target.Addr().String()); code != -1 {
+		t.Errorf("authentication with a wrong password succeeded")
+	}
+	if code := socks5Connect(t, p.GetAddress(), "alice", "secret", target.Addr().String()); code != 0 {
+		t.Errorf("alice got reply %d, expected success", code)
+	}
+	// bob may only use the dialer 'office', but the target is dialed directly
+	if code := socks5Connect(t, p.GetAddress(), "bob", "secret", target.Addr().String()); code != 2 {
+		t.Errorf("bob got reply %d, expected 'not allowed by ruleset'", code)
+	}
+
+	AddSocks5User(Socks5User{Name: "carol", Password: "secret"})
+	defer RemoveSocks5User("carol")
+	if code := socks5Connect(t, p.GetAddress(), "carol", "secret", target.Addr().String()); code != 0 {
+		t.Errorf("carol got reply %d, expected success", code)
+	}
+}
+
+func TestSocks5AllowList(t *testing.T) {
+	p, err := NewProxy("socks5", Config{Options: map[string]string{"allow": "10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.GetAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, 0})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err == nil {
+		t.Errorf("a client outside of the allow list has been accepted")
+	}
+}
+
+func TestParseSocks5Users(t *testing.T) {
+	if _, err := parseSocks5Users("alice"); err == nil {
+		t.Errorf("a line without password has been accepted")
+	}
+	users, err := parseSocks5Users("alice:$2a$10$abc:direct,office\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users["alice"].Dialers) != 2 {
+		t.Errorf("unexpected dialers: %v", users["alice"].Dialers)
+	}
+}
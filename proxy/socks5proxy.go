@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -9,41 +11,105 @@ import (
 	// cSpell:ignore armon
 	socks5 "github.com/armon/go-socks5"
 	"github.com/dueckminor/go-sshtunnel/dialer"
-	"github.com/dueckminor/go-sshtunnel/rules"
+	"github.com/dueckminor/go-sshtunnel/logger"
 )
 
 type socks5Proxy struct {
 	Dialer dialer.Dialer
-	Port   int
+
+	listener net.Listener
+	conns    connTracker
+
+	// auth requires clients to authenticate with user name and password
+	auth bool
+	// users are loaded from the users file of the proxy
+	users map[string]Socks5User
+	// allowList restricts the source addresses of clients
+	allowList []*net.IPNet
+	// udpRelay is the address of the UDP relay on the remote side of the
+	// dialers
+	udpRelay string
+	// dns selects the DNS proxy which resolves host names for rules with
+	// the resolve mode "dns" (see findDNSProxy)
+	dns string
 }
 
 func (proxy *socks5Proxy) GetPort() int {
-	return proxy.Port
+	return addrPort(proxy.listener.Addr())
+}
+
+func (proxy *socks5Proxy) GetAddress() string {
+	return proxy.listener.Addr().String()
 }
 
 func (proxy *socks5Proxy) SetDialer(dialer dialer.Dialer) {
 	proxy.Dialer = dialer
 }
 
+func (proxy *socks5Proxy) Close() error {
+	removeRunningProxy(proxy)
+	err := proxy.listener.Close()
+	proxy.conns.drain(DrainTimeout)
+	return err
+}
+
 func init() {
 	RegisterProxyFactory("socks5", newSocks5Proxy)
 }
 
-func newSocks5Proxy(parameters string) (Proxy, error) {
-	proxy := &socks5Proxy{}
+// Options of the socks5 proxy:
+//
+//	auth:  "true" requires authentication using the users added by
+//	       AddSocks5User
+//	users: a users file (see loadSocks5Users), implies auth
+//	allow: a comma separated list of CIDR ranges from which clients may
+//	       connect
+//	udp-relay: the address of the UDP relay on the remote side of the
+//	       dialers (default: DefaultUDPRelayAddress)
+//	dns:   the address or port of the DNS proxy which resolves host names
+//	       for rules with the resolve mode "dns" (default: the DNS proxy
+//	       started first)
+func newSocks5Proxy(config Config) (Proxy, error) {
+	if err := config.checkOptions("auth", "users", "allow", "udp-relay", "dns"); err != nil {
+		return nil, err
+	}
+
+	proxy := &socks5Proxy{
+		udpRelay: DefaultUDPRelayAddress,
+	}
 	var err error
 
-	proxy.Dialer = rules.GetDefaultRuleSet()
+	proxy.Dialer = config.dialer()
 
-	port := 0
-	if len(parameters) > 0 {
-		port, err = strconv.Atoi(parameters)
+	if auth, ok := config.Options["auth"]; ok {
+		proxy.auth, err = strconv.ParseBool(auth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of option 'auth': %v", err)
+		}
+	}
+	if usersFile := config.Options["users"]; len(usersFile) > 0 {
+		proxy.users, err = loadSocks5Users(usersFile)
 		if err != nil {
 			return nil, err
 		}
+		proxy.auth = true
+	}
+	proxy.allowList, err = parseCIDRList(config.Options["allow"])
+	if err != nil {
+		return nil, err
+	}
+	if udpRelay := config.Options["udp-relay"]; len(udpRelay) > 0 {
+		if _, _, err := net.SplitHostPort(udpRelay); err != nil {
+			return nil, fmt.Errorf("invalid value of option 'udp-relay': %v", err)
+		}
+		proxy.udpRelay = udpRelay
+	}
+	proxy.dns = config.Options["dns"]
+	if err = checkDNSProxy(proxy.dns); err != nil {
+		return nil, err
 	}
 
-	err = proxy.start(port)
+	err = proxy.start(config.listenOrParameters())
 	if err != nil {
 		return nil, err
 	}
@@ -51,46 +117,88 @@ func newSocks5Proxy(parameters string) (Proxy, error) {
 	return proxy, nil
 }
 
-func (proxy *socks5Proxy) start(port int) (err error) {
-	listener, port, err := createTCPListener(port)
+func (proxy *socks5Proxy) start(listen string) (err error) {
+	proxy.listener, err = createListener(listen, LoopbackHost)
 	if err != nil {
 		return err
 	}
+	go proxy.serve()
+	return nil
+}
 
-	proxy.Port = port
+// socks5Session is the state of one client connection of the socks5 proxy
+type socks5Session struct {
+	proxy *socks5Proxy
+	conn  *socks5Conn
+}
 
+// newSocks5Server creates the socks5 server of a client connection. Each
+// connection gets its own server, so that its RuleSet hook knows the
+// connection (see socks5Session.Allow).
+func (proxy *socks5Proxy) newSocks5Server(conn *socks5Conn) (*socks5.Server, error) {
 	config := &socks5.Config{}
 	config.Rewriter = proxy
-	config.Dial = func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
-		return proxy.Dialer.Dial(network, addr)
+	config.Rules = &socks5Session{proxy: proxy, conn: conn}
+	if proxy.auth {
+		config.Credentials = proxy
 	}
-	if len(dnsTarget) > 0 {
-		config.Resolver = proxy
+	config.Dial = func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+		return dialContext(ctx, proxy.Dialer, network, addr)
 	}
+	config.Resolver = proxy
+	return socks5.New(config)
+}
 
-	socksServer, err := socks5.New(config)
-	if err != nil {
-		listener.Close()
-		return err
+func (proxy *socks5Proxy) serve() {
+	for {
+		conn, err := proxy.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.L.Println("SOCKS5: accept failed:", err)
+			continue
+		}
+		if !sourceAllowed(proxy.allowList, conn.RemoteAddr()) {
+			logger.L.Printf("SOCKS5: rejected connection from '%v'\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		socksConn := &socks5Conn{Conn: conn}
+		proxy.conns.serve(socksConn, func(conn net.Conn) {
+			// SOCKS4 clients are served on the same listener
+			reader := bufio.NewReader(conn)
+			version, err := reader.Peek(1)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if version[0] == 4 {
+				defer conn.Close()
+				if proxy.auth {
+					logger.L.Printf("SOCKS5: rejected SOCKS4 request of '%v' (authentication required)\n", conn.RemoteAddr())
+					sendSocks4Reply(conn, socks4Rejected, nil) //nolint:errcheck
+					return
+				}
+				serveSocks4(conn, reader, proxy.Dialer, proxy.dns) //nolint:errcheck
+				return
+			}
+			socksServer, err := proxy.newSocks5Server(socksConn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			socksServer.ServeConn(&bufferedConn{Conn: conn, reader: reader}) //nolint:errcheck
+		})
 	}
-
-	go func() {
-		defer listener.Close()
-		socksServer.Serve(listener)
-	}()
-	return nil
 }
 
-// implements the socks5 NameResolver interface
+// implements the socks5 NameResolver interface. Host names are not resolved
+// here, but passed to the dialer, so that the resolve mode of the matching
+// rule decides where they get resolved. The returned context selects the
+// DNS proxy of the proxy for rules with the resolve mode "dns".
 func (proxy *socks5Proxy) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	fmt.Printf("SOCKS5: resolving '%s'...\n", name)
-	ip, err := ResolveDNS(ctx, name)
-	if err != nil {
-		fmt.Printf("SOCKS5: resolving '%s' failed: %v\n", name, err)
-	} else {
-		fmt.Printf("SOCKS5: resolving '%s' -> %v\n", name, ip.String())
-	}
-	return ctx, ip, err
+	return withDNSProxy(ctx, proxy.dns), nil, nil
 }
 
 func (proxy *socks5Proxy) Rewrite(ctx context.Context, request *socks5.Request) (context.Context, *socks5.AddrSpec) {
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/dueckminor/go-sshtunnel/rules"
+)
+
+// recordingDialer reports the addresses it is asked to dial
+type recordingDialer chan string
+
+func (dialer recordingDialer) Dial(network, addr string) (net.Conn, error) {
+	dialer <- addr
+	return nil, errors.New("not connected")
+}
+
+func TestSocks5HostName(t *testing.T) {
+	// the upstream proxy is reached by the dialer of a domain rule
+	recording := make(recordingDialer, 1)
+	upstream, err := NewProxy("socks5", Config{Dialer: recording})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	if err := dialer.AddDialer("socks5-host-name", "socks5://"+upstream.GetAddress()); err != nil {
+		t.Fatal(err)
+	}
+
+	ruleSet := &rules.RuleSet{Name: "socks5-host-name"}
+	addTestRule(t, ruleSet, control.Rule{Domain: "*.corp.example", Dialer: "socks5-host-name"})
+	p, err := NewProxy("socks5", Config{Dialer: ruleSet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.GetAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, 0})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	request := []byte{5, 1, 0, 3, byte(len("host.corp.example"))}
+	request = append(request, "host.corp.example"...)
+	request = append(request, 0, 80)
+	conn.Write(request)
+
+	// neither proxy resolves the host name
+	select {
+	case addr := <-recording:
+		if addr != "host.corp.example:80" {
+			t.Errorf("dialed '%s', expected 'host.corp.example:80'", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the host name has not been dialed")
+	}
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	// cSpell:ignore armon
+	socks5 "github.com/armon/go-socks5"
+	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/dueckminor/go-sshtunnel/logger"
+)
+
+// socks5Conn wraps the connections of the socks5 proxy. The go-socks5
+// library doesn't support UDP ASSOCIATE, so the RuleSet hook of the session
+// takes over the connection for these requests. Afterwards all writes of the
+// library are discarded.
+type socks5Conn struct {
+	net.Conn
+	lock     sync.Mutex
+	hijacked bool
+}
+
+func (conn *socks5Conn) Write(b []byte) (int, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.hijacked {
+		return len(b), nil
+	}
+	return conn.Conn.Write(b)
+}
+
+// hijack returns the underlying connection. Further writes to conn are
+// discarded.
+func (conn *socks5Conn) hijack() net.Conn {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.hijacked = true
+	return conn.Conn
+}
+
+// dialUDPRelay opens a stream to the UDP relay on the remote side of a
+// dialer (replaced by tests)
+var dialUDPRelay = func(dialerName, addr string) (net.Conn, error) {
+	return dialer.Dial(dialerName, "tcp", addr)
+}
+
+// udpAssociation relays the datagrams of one SOCKS5 UDP ASSOCIATE request.
+// Datagrams to destinations handled by the direct dialer are sent from a
+// local socket, all others are carried over UDP-over-TCP streams to the UDP
+// relay on the remote side of the dialer.
+type udpAssociation struct {
+	proxy *socks5Proxy
+	user  *Socks5User
+
+	clientIP net.IP
+	conn     *net.UDPConn
+
+	lock       sync.Mutex
+	clientAddr *net.UDPAddr
+	direct     *net.UDPConn
+	streams    map[string]net.Conn
+	closed     bool
+}
+
+// handleAssociate handles a UDP ASSOCIATE request on the hijacked connection
+// of the session. It returns when the client closes the TCP connection.
+func (session *socks5Session) handleAssociate(request *socks5.Request, user *Socks5User) {
+	proxy := session.proxy
+	tcpConn := session.conn.hijack()
+	localAddr, ok := tcpConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		sendSocks5Reply(tcpConn, 7, nil) //nolint:errcheck
+		return
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		logger.L.Println("SOCKS5: failed to create UDP socket:", err)
+		sendSocks5Reply(tcpConn, 1, nil) //nolint:errcheck
+		return
+	}
+
+	association := &udpAssociation{
+		proxy:    proxy,
+		user:     user,
+		clientIP: request.RemoteAddr.IP,
+		conn:     udpConn,
+		streams:  make(map[string]net.Conn),
+	}
+	if request.DestAddr != nil && request.DestAddr.Port != 0 && !request.DestAddr.IP.IsUnspecified() {
+		association.clientAddr = &net.UDPAddr{IP: request.DestAddr.IP, Port: request.DestAddr.Port}
+	}
+	defer association.close()
+
+	if err := sendSocks5Reply(tcpConn, 0, udpConn.LocalAddr().(*net.UDPAddr)); err != nil {
+		return
+	}
+	logger.L.Printf("SOCKS5: UDP association for '%v' on '%v'\n", tcpConn.RemoteAddr(), udpConn.LocalAddr())
+
+	go association.serve()
+
+	// the association ends with the TCP connection
+	io.Copy(ioutil.Discard, tcpConn) //nolint:errcheck
+}
+
+// sendSocks5Reply sends the reply of a SOCKS5 request
+func sendSocks5Reply(w io.Writer, code byte, addr *net.UDPAddr) error {
+	reply := []byte{5, code, 0}
+	var err error
+	if addr == nil {
+		reply, err = appendSocks5Addr(reply, "0.0.0.0", 0)
+	} else {
+		reply, err = appendSocks5Addr(reply, addr.IP.String(), addr.Port)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(reply)
+	return err
+}
+
+func (association *udpAssociation) close() {
+	association.lock.Lock()
+	defer association.lock.Unlock()
+	association.closed = true
+	association.conn.Close()
+	if association.direct != nil {
+		association.direct.Close()
+	}
+	for _, stream := range association.streams {
+		stream.Close()
+	}
+}
+
+// serve reads the datagrams sent by the client
+func (association *udpAssociation) serve() {
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := association.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(association.clientIP) {
+			continue
+		}
+		association.lock.Lock()
+		if association.clientAddr == nil {
+			association.clientAddr = from
+		}
+		clientAddr := association.clientAddr
+		association.lock.Unlock()
+		if from.Port != clientAddr.Port {
+			continue
+		}
+
+		// RSV(2), FRAG(1), address, data
+		if n < 4 || buffer[2] != 0 {
+			// fragmentation is not supported
+			continue
+		}
+		host, port, payload, err := parseSocks5Addr(buffer[3:n])
+		if err != nil {
+			continue
+		}
+		association.forward(host, port, payload)
+	}
+}
+
+// forward sends a datagram to its destination using the dialer selected by
+// the rules of the proxy
+func (association *udpAssociation) forward(host string, port int, payload []byte) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	// the rules are matched like the connections of the TCP path, the
+	// network is only used to resolve host names for CIDR rules
+	proxy := association.proxy
+	ctx := withDNSProxy(context.Background(), proxy.dns)
+	dialerNames, ok := proxy.userDialers(ctx, association.user, addr)
+	if !ok {
+		logger.L.Printf("SOCKS5: user '%s' is not allowed to send datagrams to '%s'\n", association.user.Name, addr)
+		return
+	}
+
+	dialerName := dialer.Select(dialerNames)
+	if dialerName == dialer.DirectDialer {
+		association.forwardDirect(addr, payload)
+		return
+	}
+
+	stream, err := association.stream(dialerName)
+	if err != nil {
+		logger.L.Printf("SOCKS5: failed to open UDP relay stream via dialer '%s': %v\n", dialerName, err)
+		return
+	}
+	if err := writeUDPFrame(stream, host, port, payload); err != nil {
+		stream.Close()
+	}
+}
+
+func (association *udpAssociation) forwardDirect(addr string, payload []byte) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		logger.L.Printf("SOCKS5: failed to resolve '%s': %v\n", addr, err)
+		return
+	}
+
+	association.lock.Lock()
+	if association.closed {
+		association.lock.Unlock()
+		return
+	}
+	if association.direct == nil {
+		association.direct, err = net.ListenUDP("udp", nil)
+		if err != nil {
+			association.lock.Unlock()
+			logger.L.Println("SOCKS5: failed to create UDP socket:", err)
+			return
+		}
+		go association.receiveDirect(association.direct)
+	}
+	direct := association.direct
+	association.lock.Unlock()
+
+	direct.WriteToUDP(payload, udpAddr) //nolint:errcheck
+}
+
+func (association *udpAssociation) receiveDirect(direct *net.UDPConn) {
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := direct.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		association.reply(from.IP.String(), from.Port, buffer[:n])
+	}
+}
+
+// stream returns the UDP-over-TCP stream to the relay of a dialer
+func (association *udpAssociation) stream(dialerName string) (net.Conn, error) {
+	association.lock.Lock()
+	defer association.lock.Unlock()
+	if association.closed {
+		return nil, fmt.Errorf("the association has been closed")
+	}
+	if stream, ok := association.streams[dialerName]; ok {
+		return stream, nil
+	}
+	stream, err := dialUDPRelay(dialerName, association.proxy.udpRelay)
+	if err != nil {
+		return nil, err
+	}
+	association.streams[dialerName] = stream
+	go association.receiveStream(dialerName, stream)
+	return stream, nil
+}
+
+func (association *udpAssociation) receiveStream(dialerName string, stream net.Conn) {
+	defer func() {
+		stream.Close()
+		association.lock.Lock()
+		if association.streams[dialerName] == stream {
+			delete(association.streams, dialerName)
+		}
+		association.lock.Unlock()
+	}()
+	for {
+		stream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		host, port, payload, err := readUDPFrame(stream)
+		if err != nil {
+			return
+		}
+		association.reply(host, port, payload)
+	}
+}
+
+// reply sends a datagram received from host:port to the client
+func (association *udpAssociation) reply(host string, port int, payload []byte) {
+	association.lock.Lock()
+	clientAddr := association.clientAddr
+	association.lock.Unlock()
+	if clientAddr == nil {
+		return
+	}
+	datagram, err := appendSocks5Addr([]byte{0, 0, 0}, host, port)
+	if err != nil {
+		return
+	}
+	association.conn.WriteToUDP(append(datagram, payload...), clientAddr) //nolint:errcheck
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+	"github.com/dueckminor/go-sshtunnel/rules"
+)
+
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buffer[:n], from)
+		}
+	}()
+	return conn
+}
+
+// socks5Associate sends a UDP ASSOCIATE request and returns the control
+// connection and the address of the UDP relay
+func socks5Associate(t *testing.T, proxyAddr string) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{5, 1, 0})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	return conn, socks5AssociateRequest(t, conn)
+}
+
+// socks5AssociateUser is like socks5Associate, but authenticates with user
+// and password
+func socks5AssociateUser(t *testing.T, proxyAddr, user, password string) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{5, 1, 2})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 2 {
+		t.Fatal("the proxy doesn't accept user/password authentication")
+	}
+	auth := []byte{1, byte(len(user))}
+	auth = append(auth, user...)
+	auth = append(auth, byte(len(password)))
+	auth = append(auth, password...)
+	conn.Write(auth)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("authentication of '%s' failed", user)
+	}
+	return conn, socks5AssociateRequest(t, conn)
+}
+
+func socks5AssociateRequest(t *testing.T, conn net.Conn) *net.UDPAddr {
+	t.Helper()
+	conn.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0 {
+		t.Fatalf("UDP ASSOCIATE failed with reply %d", reply[1])
+	}
+	host, port, _, err := parseSocks5Addr(reply[3:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+}
+
+func udpRoundTrip(t *testing.T, relayAddr *net.UDPAddr, target *net.UDPAddr, payload []byte) {
+	t.Helper()
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	datagram, _ := appendSocks5Addr([]byte{0, 0, 0}, target.IP.String(), target.Port)
+	client.Write(append(datagram, payload...))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, maxDatagramSize)
+	n, err := client.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, data, err := parseSocks5Addr(buffer[3:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != target.IP.String() || port != target.Port {
+		t.Errorf("response from %s:%d, expected %v", host, port, target)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("got %q, expected %q", data, payload)
+	}
+}
+
+func TestSocks5UDPAssociate(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	target := echo.LocalAddr().(*net.UDPAddr)
+
+	// a local stand-in of the UDP relay on the remote side of a dialer
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	go ServeUDPRelay(relay)
+
+	var relayDialer string
+	defer func(orig func(dialerName, addr string) (net.Conn, error)) { dialUDPRelay = orig }(dialUDPRelay)
+	dialUDPRelay = func(dialerName, addr string) (net.Conn, error) {
+		relayDialer = dialerName
+		return net.Dial("tcp", addr)
+	}
+
+	p, err := NewProxy("socks5", Config{Options: map[string]string{"udp-relay": relay.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ruleSet := &rules.RuleSet{Name: "socks5-udp"}
+	p.SetDialer(ruleSet)
+
+	// no rule matches, the datagrams are relayed locally
+	conn, relayAddr := socks5Associate(t, p.GetAddress())
+	udpRoundTrip(t, relayAddr, target, []byte("direct"))
+	conn.Close()
+	if len(relayDialer) != 0 {
+		t.Errorf("the datagram has been sent via dialer '%s'", relayDialer)
+	}
+
+	addTestRule(t, ruleSet, control.Rule{CIDR: target.IP.String() + "/32", Dialer: "office"})
+	conn, relayAddr = socks5Associate(t, p.GetAddress())
+	defer conn.Close()
+	udpRoundTrip(t, relayAddr, target, []byte("relayed"))
+	if relayDialer != "office" {
+		t.Errorf("the datagram has not been sent via the dialer 'office'")
+	}
+}
+
+func TestSocks5UDPAssociateHostName(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	target := echo.LocalAddr().(*net.UDPAddr)
+
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	go ServeUDPRelay(relay)
+
+	var relayDialer string
+	defer func(orig func(dialerName, addr string) (net.Conn, error)) { dialUDPRelay = orig }(dialUDPRelay)
+	dialUDPRelay = func(dialerName, addr string) (net.Conn, error) {
+		relayDialer = dialerName
+		return net.Dial("tcp", addr)
+	}
+
+	// the CIDR rule matches the resolved host name of the destination
+	ruleSet := &rules.RuleSet{Name: "socks5-udp-host"}
+	addTestRule(t, ruleSet, control.Rule{CIDR: "127.0.0.0/8", Dialer: "office"})
+
+	p, err := NewProxy("socks5", Config{
+		Options: map[string]string{"udp-relay": relay.Addr().String()},
+		Dialer:  ruleSet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, relayAddr := socks5Associate(t, p.GetAddress())
+	defer conn.Close()
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	datagram, _ := appendSocks5Addr([]byte{0, 0, 0}, "localhost", target.Port)
+	client.Write(append(datagram, []byte("relayed")...))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, maxDatagramSize)
+	n, err := client.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, data, err := parseSocks5Addr(buffer[3:n]); err != nil || string(data) != "relayed" {
+		t.Errorf("got %q (%v), expected %q", data, err, "relayed")
+	}
+	if relayDialer != "office" {
+		t.Errorf("the datagram has not been sent via the dialer 'office'")
+	}
+}
+
+func TestSocks5UDPAssociateUserDialers(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	target := echo.LocalAddr().(*net.UDPAddr)
+
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	go ServeUDPRelay(relay)
+
+	var lock sync.Mutex
+	var relayDialers []string
+	defer func(orig func(dialerName, addr string) (net.Conn, error)) { dialUDPRelay = orig }(dialUDPRelay)
+	dialUDPRelay = func(dialerName, addr string) (net.Conn, error) {
+		lock.Lock()
+		relayDialers = append(relayDialers, dialerName)
+		lock.Unlock()
+		return net.Dial("tcp", addr)
+	}
+
+	// the host name is sent via 'office', the IP address via 'lab'
+	ruleSet := &rules.RuleSet{Name: "socks5-udp-user"}
+	addTestRule(t, ruleSet, control.Rule{Domain: "localhost", Dialer: "office"})
+	addTestRule(t, ruleSet, control.Rule{CIDR: target.IP.String() + "/32", Dialer: "lab"})
+
+	usersFile := filepath.Join(t.TempDir(), "users")
+	ioutil.WriteFile(usersFile, []byte("bob:secret:office\n"), 0600)
+	p, err := NewProxy("socks5", Config{
+		Options: map[string]string{"udp-relay": relay.Addr().String(), "users": usersFile},
+		Dialer:  ruleSet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, relayAddr := socks5AssociateUser(t, p.GetAddress(), "bob", "secret")
+	defer conn.Close()
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// bob may not use the dialer 'lab', the datagram is dropped
+	datagram, _ := appendSocks5Addr([]byte{0, 0, 0}, target.IP.String(), target.Port)
+	client.Write(append(datagram, []byte("denied")...))
+	datagram, _ = appendSocks5Addr([]byte{0, 0, 0}, "localhost", target.Port)
+	client.Write(append(datagram, []byte("allowed")...))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, maxDatagramSize)
+	n, err := client.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, data, err := parseSocks5Addr(buffer[3:n]); err != nil || string(data) != "allowed" {
+		t.Errorf("got %q (%v), expected %q", data, err, "allowed")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(relayDialers) != 1 || relayDialers[0] != "office" {
+		t.Errorf("the datagrams have been sent via the dialers %v, expected [office]", relayDialers)
+	}
+}
+
+func TestUDPFrames(t *testing.T) {
+	var buffer bytes.Buffer
+	writeUDPFrame(&buffer, "example.com", 53, []byte("query"))
+	writeUDPFrame(&buffer, "::1", 5353, nil)
+
+	host, port, payload, err := readUDPFrame(&buffer)
+	if err != nil || host != "example.com" || port != 53 || string(payload) != "query" {
+		t.Errorf("unexpected frame: %s %d %q %v", host, port, payload, err)
+	}
+	host, port, payload, err = readUDPFrame(&buffer)
+	if err != nil || net.JoinHostPort(host, strconv.Itoa(port)) != "[::1]:5353" || len(payload) != 0 {
+		t.Errorf("unexpected frame: %s %d %q %v", host, port, payload, err)
+	}
+}
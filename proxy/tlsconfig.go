@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/logger"
+)
+
+// serverTLSConfig creates the TLS configuration of a proxy listener from the
+// options of the proxy:
+//
+//	tls:       "true" enables TLS, implied by all other options
+//	cert, key: the PEM files of the server certificate. Without them, a
+//	           self-signed certificate is generated.
+//	client-ca: a PEM file with the CAs of the client certificates. If it is
+//	           set, clients must present a valid certificate.
+//
+// If TLS is not enabled, nil is returned.
+func serverTLSConfig(options map[string]string, listenAddr net.Addr) (*tls.Config, error) {
+	enabled := false
+	if value, ok := options["tls"]; ok {
+		var err error
+		enabled, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of option 'tls': %v", err)
+		}
+	}
+	certFile, keyFile, clientCA := options["cert"], options["key"], options["client-ca"]
+	if len(certFile) > 0 || len(keyFile) > 0 || len(clientCA) > 0 {
+		enabled = true
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case len(certFile) > 0 && len(keyFile) > 0:
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	case len(certFile) > 0 || len(keyFile) > 0:
+		err = fmt.Errorf("the options 'cert' and 'key' must be used together")
+	default:
+		cert, err = selfSignedCertificate(listenAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+
+	if len(clientCA) > 0 {
+		config.ClientCAs, err = loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// loadCertPool reads the certificates of a PEM file
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in '%s'", filename)
+	}
+	return pool, nil
+}
+
+// selfSignedCertificate generates a certificate which is valid for
+// localhost and the IP address of listenAddr
+func selfSignedCertificate(listenAddr net.Addr) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "sshtunnel"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if tcpAddr, ok := listenAddr.(*net.TCPAddr); ok && !tcpAddr.IP.IsUnspecified() && !tcpAddr.IP.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, tcpAddr.IP)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	fingerprint := sha256.Sum256(der)
+	logger.L.Printf("generated self-signed certificate for %v (SHA256 %s)\n",
+		listenAddr, hex.EncodeToString(fingerprint[:]))
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
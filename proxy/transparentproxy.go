@@ -1,15 +1,17 @@
+//go:build linux
 // +build linux
 
 package proxy
 
 import (
-	"io"
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"strconv"
+	"syscall"
 
 	"github.com/dueckminor/go-sshtunnel/originaldest"
-	"github.com/dueckminor/go-sshtunnel/rules"
 
 	"github.com/dueckminor/go-sshtunnel/dialer"
 	"github.com/dueckminor/go-sshtunnel/logger"
@@ -17,28 +19,72 @@ import (
 
 type transparentProxy struct {
 	Dialer dialer.Dialer
-	Port   int
+
+	listener *net.TCPListener
+	conns    connTracker
+
+	// tproxy is set if the connections are diverted using the iptables
+	// target TPROXY instead of REDIRECT
+	tproxy bool
+	// sniff enables sniffing of the host name (TLS SNI or HTTP Host header)
+	// for rule matching. With sniffDial, the host name is also passed to the
+	// dialer.
+	sniff     bool
+	sniffDial bool
+}
+
+// sniffedDialer is implemented by dialers which use a sniffed host name,
+// see rules.RuleSet.DialSniffed
+type sniffedDialer interface {
+	DialSniffed(network, host, addr string, dialHost bool) (net.Conn, error)
 }
 
 func init() {
 	RegisterProxyFactory("transparent", newTransparentProxy)
+	RegisterProxyFactory("tproxy", newTProxy)
+}
+
+func newTransparentProxy(config Config) (Proxy, error) {
+	return newTransparentProxyWithMode(config, false)
+}
+
+// newTProxy creates a transparent proxy for connections diverted by the
+// iptables target TPROXY. It requires the capability CAP_NET_ADMIN.
+func newTProxy(config Config) (Proxy, error) {
+	return newTransparentProxyWithMode(config, true)
 }
 
-func newTransparentProxy(parameters string) (Proxy, error) {
-	proxy := &transparentProxy{}
+// Options of the transparent and the tproxy proxy:
+//
+//	sniff:      "true" matches the rules using the host name sent by the
+//	            client (TLS SNI or HTTP Host header)
+//	sniff-dial: "true" also passes the sniffed host name to the dialer,
+//	            implies sniff
+func newTransparentProxyWithMode(config Config, tproxy bool) (Proxy, error) {
+	if err := config.checkOptions("sniff", "sniff-dial"); err != nil {
+		return nil, err
+	}
+
+	proxy := &transparentProxy{tproxy: tproxy}
 	var err error
 
-	proxy.Dialer = rules.GetDefaultRuleSet()
+	proxy.Dialer = config.dialer()
 
-	port := 0
-	if len(parameters) > 0 {
-		port, err = strconv.Atoi(parameters)
+	if sniff, ok := config.Options["sniff"]; ok {
+		proxy.sniff, err = strconv.ParseBool(sniff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of option 'sniff': %v", err)
+		}
+	}
+	if sniffDial, ok := config.Options["sniff-dial"]; ok {
+		proxy.sniffDial, err = strconv.ParseBool(sniffDial)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid value of option 'sniff-dial': %v", err)
 		}
+		proxy.sniff = proxy.sniff || proxy.sniffDial
 	}
 
-	err = proxy.start(port)
+	err = proxy.start(config.listenOrParameters())
 	if err != nil {
 		return nil, err
 	}
@@ -47,81 +93,158 @@ func newTransparentProxy(parameters string) (Proxy, error) {
 }
 
 func (proxy *transparentProxy) GetPort() int {
-	return proxy.Port
+	return addrPort(proxy.listener.Addr())
+}
+
+func (proxy *transparentProxy) GetAddress() string {
+	return proxy.listener.Addr().String()
 }
 
 func (proxy *transparentProxy) SetDialer(dialer dialer.Dialer) {
 	proxy.Dialer = dialer
 }
 
-func handleConnection(dialer dialer.Dialer, conn *net.TCPConn) {
-	defer conn.Close()
+func (proxy *transparentProxy) Close() error {
+	removeRunningProxy(proxy)
+	err := proxy.listener.Close()
+	proxy.conns.drain(DrainTimeout)
+	return err
+}
+
+// originalDst returns the address the client has connected to
+func (proxy *transparentProxy) originalDst(conn *net.TCPConn) (string, *net.TCPConn, error) {
+	if proxy.tproxy {
+		// TPROXY doesn't rewrite the packets, the socket is bound to the
+		// original destination
+		return conn.LocalAddr().String(), conn, nil
+	}
 	ip, port, conn, err := originaldest.GetOriginalDst(conn)
+	if err != nil {
+		return "", conn, err
+	}
+	return net.JoinHostPort(ip, strconv.FormatUint(uint64(port), 10)), conn, nil
+}
+
+func (proxy *transparentProxy) handleConnection(conn *net.TCPConn) {
+	defer conn.Close()
+	remoteAddr, conn, err := proxy.originalDst(conn)
 	if err != nil {
 		logger.L.Println("Failed to get original destination:", err)
 		return
 	}
-	remoteAddr := ip + ":" + strconv.FormatUint(uint64(port), 10)
-	logger.L.Println("Connecting to:", remoteAddr)
-	remoteConn, err := dialer.Dial("tcp", remoteAddr)
+	// GetOriginalDst may replace the connection
+	defer conn.Close()
+	if !proxy.conns.track(conn) {
+		return
+	}
+	defer proxy.conns.untrack(conn)
+
+	var localConn net.Conn = conn
+	var remoteConn net.Conn
+	if host, ok := lookupFakeIP(remoteAddr); ok {
+		// the host name is resolved by the dialer
+		_, port, _ := net.SplitHostPort(remoteAddr)
+		logger.L.Printf("Connecting to: %s (fake IP of %s)\n", remoteAddr, host)
+		remoteConn, err = proxy.Dialer.Dial("tcp", net.JoinHostPort(host, port))
+	} else if proxy.sniff {
+		var host string
+		host, localConn = sniffHost(conn)
+		remoteConn, err = proxy.dialSniffed(host, remoteAddr)
+	} else {
+		logger.L.Println("Connecting to:", remoteAddr)
+		remoteConn, err = proxy.Dialer.Dial("tcp", remoteAddr)
+	}
 	if err != nil {
 		logger.L.Println("Failed to connect to original destination:", err)
 		return
 	}
-	nSend, nReceived, err := forwardConnection(conn, remoteConn)
+	nSend, nReceived, err := forwardConnection(localConn, remoteConn)
 
 	logger.L.Println("Send bytes:", nSend)
 	logger.L.Println("Received bytes:", nReceived)
 }
 
-func forwardConnection(localConn, remoteConn net.Conn) (nSend, nReceived int64, err error) {
-	done := make(chan bool)
-
-	var errSend error
-	var errReceive error
-
-	go func() {
-		defer localConn.Close()
-		defer remoteConn.Close()
-		nReceived, errReceive = io.Copy(localConn, remoteConn)
-		done <- true
-	}()
-	go func() {
-		defer localConn.Close()
-		defer remoteConn.Close()
-		nSend, errSend = io.Copy(remoteConn, localConn)
-		done <- true
-	}()
+// dialSniffed connects to the original destination remoteAddr of a client
+// which has sent the host name host
+func (proxy *transparentProxy) dialSniffed(host, remoteAddr string) (net.Conn, error) {
+	if len(host) == 0 {
+		logger.L.Println("Connecting to:", remoteAddr)
+		return proxy.Dialer.Dial("tcp", remoteAddr)
+	}
+	logger.L.Printf("Connecting to: %s (%s)\n", remoteAddr, host)
+	if d, ok := proxy.Dialer.(sniffedDialer); ok {
+		return d.DialSniffed("tcp", host, remoteAddr, proxy.sniffDial)
+	}
+	if proxy.sniffDial {
+		_, port, _ := net.SplitHostPort(remoteAddr)
+		return proxy.Dialer.Dial("tcp", net.JoinHostPort(host, port))
+	}
+	return proxy.Dialer.Dial("tcp", remoteAddr)
+}
 
-	_ = <-done
-	_ = <-done
+// ipv6Transparent is IPV6_TRANSPARENT, which is missing in package syscall
+const ipv6Transparent = 75
 
-	if errSend != nil {
-		err = errSend
-	} else if errReceive != nil {
-		err = errReceive
+// listenTransparent creates a listener which accepts connections to foreign
+// addresses (IP_TRANSPARENT)
+func listenTransparent(listen string) (net.Listener, error) {
+	network, address, err := listenAddress(listen, AnyHost)
+	if err != nil {
+		return nil, err
 	}
-
-	return nSend, nReceived, err
+	if network != "tcp" {
+		return nil, fmt.Errorf("the tproxy proxy can't listen on '%s'", address)
+	}
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				} else {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("failed to enable IP_TRANSPARENT (CAP_NET_ADMIN required): %v", sockErr)
+			}
+			return nil
+		},
+	}
+	return listenConfig.Listen(context.Background(), network, address)
 }
 
-func (proxy *transparentProxy) start(port int) (err error) {
-	listener, port, err := createTCPListener(port)
+func (proxy *transparentProxy) start(listen string) (err error) {
+	var l net.Listener
+	if proxy.tproxy {
+		l, err = listenTransparent(listen)
+	} else {
+		l, err = createListener(listen, AnyHost)
+	}
 	if err != nil {
 		return err
 	}
-	proxy.Port = port
+	listener, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return fmt.Errorf("the transparent proxy can't listen on '%s'", l.Addr())
+	}
+	proxy.listener = listener
 
 	go func() {
-		defer listener.Close()
-
 		for {
 			conn, err := listener.AcceptTCP()
 			if err != nil {
-				log.Fatalln(err)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				logger.L.Println("Failed to accept connection:", err)
 				continue
 			}
-			go handleConnection(proxy.Dialer, conn)
+			go proxy.handleConnection(conn)
 		}
 	}()
 
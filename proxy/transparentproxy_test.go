@@ -0,0 +1,115 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTProxyOriginalDst(t *testing.T) {
+	dialer := make(recordingDialer, 1)
+	p, err := NewProxy("tproxy", Config{Listen: "127.0.0.1:0", Dialer: dialer})
+	if err != nil {
+		t.Skip("tproxy is not available:", err)
+	}
+	defer p.Close()
+
+	// without TPROXY rules, the original destination is the listener itself
+	conn, err := net.Dial("tcp", p.GetAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case addr := <-dialer:
+		if addr != p.GetAddress() {
+			t.Errorf("dialed '%s', expected '%s'", addr, p.GetAddress())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the destination has not been dialed")
+	}
+}
+
+func TestTProxySniffDial(t *testing.T) {
+	dialer := make(recordingDialer, 1)
+	p, err := NewProxy("tproxy", Config{
+		Listen:  "127.0.0.1:0",
+		Options: map[string]string{"sniff-dial": "true"},
+		Dialer:  dialer,
+	})
+	if err != nil {
+		t.Skip("tproxy is not available:", err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.GetAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: www.corp.example\r\n\r\n"))
+
+	_, port, _ := net.SplitHostPort(p.GetAddress())
+	select {
+	case addr := <-dialer:
+		if addr != net.JoinHostPort("www.corp.example", port) {
+			t.Errorf("dialed '%s', expected the sniffed host name", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the destination has not been dialed")
+	}
+}
+
+func TestTProxyFakeIP(t *testing.T) {
+	upstream := startDNSUpstream(t, 1)
+	// the first fake address is the address of the tproxy listener
+	dnsProxy, err := NewProxy("dns", Config{
+		Listen:     "127.0.0.1:0",
+		Parameters: upstream.addr,
+		Options:    map[string]string{"fake-ip": "127.0.0.0/30"},
+		Dialer:     &countingDialer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsProxy.Close()
+
+	dialer := make(recordingDialer, 1)
+	p, err := NewProxy("tproxy", Config{Listen: "127.0.0.1:0", Dialer: dialer})
+	if err != nil {
+		t.Skip("tproxy is not available:", err)
+	}
+	defer p.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.corp.example.", dns.TypeA)
+	response, _, err := (&dns.Client{Net: "udp"}).Exchange(query, dnsProxy.GetAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Fatalf("unexpected response %v", response)
+	}
+
+	conn, err := net.Dial("tcp", p.GetAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, port, _ := net.SplitHostPort(p.GetAddress())
+	select {
+	case addr := <-dialer:
+		if addr != net.JoinHostPort("www.corp.example", port) {
+			t.Errorf("dialed '%s', expected the host name of the fake IP", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the destination has not been dialed")
+	}
+}
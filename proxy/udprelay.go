@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/logger"
+)
+
+// The UDP-over-TCP protocol carries datagrams of SOCKS5 UDP associations
+// through dialers which only support TCP (like ssh). A stream is opened to a
+// UDP relay on the remote side, which sends the datagrams to their
+// destinations and returns the responses on the same stream.
+//
+// Each datagram is sent as a frame: a 2 byte big endian length followed by
+// the address (encoded like in SOCKS5: ATYP, address, port) and the payload.
+// Frames sent to the relay contain the destination address, frames received
+// from the relay contain the source address of the response.
+
+const (
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+
+	// DefaultUDPRelayAddress is the address of the UDP relay on the remote
+	// side of a dialer, if nothing else has been configured
+	DefaultUDPRelayAddress = "127.0.0.1:5300"
+
+	// udpIdleTimeout closes UDP sockets and relay streams without traffic
+	udpIdleTimeout = 2 * time.Minute
+
+	maxDatagramSize = 65535
+)
+
+// appendSocks5Addr appends an address in the SOCKS5 format
+func appendSocks5Addr(b []byte, host string, port int) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, socks5AddrIPv4), ip4...)
+		} else {
+			b = append(append(b, socks5AddrIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("invalid host name '%s'", host)
+		}
+		b = append(append(b, socks5AddrDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// parseSocks5Addr parses an address in the SOCKS5 format and returns the
+// remaining bytes
+func parseSocks5Addr(b []byte) (host string, port int, rest []byte, err error) {
+	if len(b) < 2 {
+		return "", 0, nil, errors.New("truncated address")
+	}
+	var addr []byte
+	switch b[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		addrLen := net.IPv4len
+		if b[0] == socks5AddrIPv6 {
+			addrLen = net.IPv6len
+		}
+		if len(b) < 1+addrLen+2 {
+			return "", 0, nil, errors.New("truncated address")
+		}
+		addr, b = b[1:1+addrLen], b[1+addrLen:]
+		host = net.IP(addr).String()
+	case socks5AddrDomain:
+		addrLen := int(b[1])
+		if len(b) < 2+addrLen+2 {
+			return "", 0, nil, errors.New("truncated address")
+		}
+		addr, b = b[2:2+addrLen], b[2+addrLen:]
+		host = string(addr)
+	default:
+		return "", 0, nil, fmt.Errorf("unsupported address type %d", b[0])
+	}
+	return host, int(binary.BigEndian.Uint16(b)), b[2:], nil
+}
+
+// writeUDPFrame writes a datagram to a UDP-over-TCP stream
+func writeUDPFrame(w io.Writer, host string, port int, payload []byte) error {
+	frame, err := appendSocks5Addr(make([]byte, 2, 2+1+1+len(host)+2+len(payload)), host, port)
+	if err != nil {
+		return err
+	}
+	frame = append(frame, payload...)
+	if len(frame)-2 > maxDatagramSize {
+		return errors.New("datagram too large")
+	}
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+	_, err = w.Write(frame)
+	return err
+}
+
+// readUDPFrame reads a datagram from a UDP-over-TCP stream
+func readUDPFrame(r io.Reader) (host string, port int, payload []byte, err error) {
+	var length [2]byte
+	if _, err = io.ReadFull(r, length[:]); err != nil {
+		return "", 0, nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(r, frame); err != nil {
+		return "", 0, nil, err
+	}
+	return parseSocks5Addr(frame)
+}
+
+// ServeUDPRelay accepts UDP-over-TCP streams and relays their datagrams. It
+// runs on the remote side of a dialer (see the command udp-relay), but can
+// also be used locally as a stand-in for tests.
+func ServeUDPRelay(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go serveUDPRelayStream(conn)
+	}
+}
+
+func serveUDPRelayStream(stream net.Conn) {
+	defer stream.Close()
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logger.L.Println("UDP relay: failed to create socket:", err)
+		return
+	}
+	defer udpConn.Close()
+
+	var writeLock sync.Mutex
+	go func() {
+		defer stream.Close()
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			udpConn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+			n, from, err := udpConn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			writeLock.Lock()
+			err = writeUDPFrame(stream, from.IP.String(), from.Port, buffer[:n])
+			writeLock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		stream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		host, port, payload, err := readUDPFrame(stream)
+		if err != nil {
+			return
+		}
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			logger.L.Printf("UDP relay: failed to resolve '%s': %v\n", host, err)
+			continue
+		}
+		udpConn.WriteToUDP(payload, addr) //nolint:errcheck
+	}
+}
@@ -0,0 +1,68 @@
+package rules
+
+import (
+	"context"
+	"net"
+)
+
+// EvaluatedRule is a rule which has been checked while matching an address
+type EvaluatedRule struct {
+	Rule    Rule
+	Matched bool
+}
+
+// A Lookup is a host name resolution which has been necessary to check the
+// CIDR rules. Mode is the resolve mode, for remote lookups followed by the
+// name of the dialer.
+type Lookup struct {
+	Mode string
+	IP   net.IP
+	Err  error
+}
+
+// An Explanation describes how RuleSet.Dial selects the dialer for an address
+type Explanation struct {
+	Profile string
+	Lookups []Lookup
+	Rules   []EvaluatedRule
+	// Rule is the winning rule. If no rule matches, it is nil and the
+	// connection is established directly.
+	Rule *Rule
+	// DialAddr is the address which is passed to the dialers of the rule
+	DialAddr string
+	DialErr  error
+}
+
+// Explain runs the same matching logic as Dial and records each step
+func (rs *RuleSet) Explain(network, addr string) *Explanation {
+	explanation := &Explanation{
+		Profile: rs.Name,
+	}
+	m := newMatcher(context.Background(), network, addr, explanation)
+	if rule, ok := m.match(rs); ok {
+		explanation.Rule = &rule
+		explanation.DialAddr, explanation.DialErr = m.dialAddr(rule)
+	}
+	return explanation
+}
+
+func (explanation *Explanation) evaluated(rule Rule, matched bool) {
+	if explanation == nil {
+		return
+	}
+	explanation.Rules = append(explanation.Rules, EvaluatedRule{
+		Rule:    rule,
+		Matched: matched,
+	})
+}
+
+func (explanation *Explanation) resolved(mode string, ip net.IP, err error) {
+	if explanation == nil {
+		return
+	}
+	explanation.Lookups = append(explanation.Lookups, Lookup{
+		Mode: mode,
+		IP:   ip,
+		Err:  err,
+	})
+}
@@ -0,0 +1,112 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/dueckminor/go-sshtunnel/dialer"
+)
+
+// DefaultProfile is the name of the RuleSet which is active after startup
+const DefaultProfile = "default"
+
+var (
+	ruleSetsLock  sync.RWMutex
+	ruleSets      = make(map[string]*RuleSet)
+	activeProfile = DefaultProfile
+)
+
+// GetRuleSet returns the RuleSet with the given name. If there is no such
+// RuleSet yet, an empty one gets created.
+func GetRuleSet(name string) *RuleSet {
+	if len(name) == 0 {
+		name = DefaultProfile
+	}
+
+	ruleSetsLock.Lock()
+	defer ruleSetsLock.Unlock()
+
+	ruleSet, ok := ruleSets[name]
+	if !ok {
+		ruleSet = &RuleSet{Name: name}
+		ruleSets[name] = ruleSet
+	}
+	return ruleSet
+}
+
+// FindRuleSet returns the RuleSet with the given name or nil, if there is no
+// such RuleSet
+func FindRuleSet(name string) *RuleSet {
+	if len(name) == 0 || name == DefaultProfile {
+		return GetDefaultRuleSet()
+	}
+
+	ruleSetsLock.RLock()
+	defer ruleSetsLock.RUnlock()
+	return ruleSets[name]
+}
+
+// ListRuleSets returns all known RuleSets sorted by name
+func ListRuleSets() []*RuleSet {
+	GetDefaultRuleSet()
+
+	ruleSetsLock.RLock()
+	defer ruleSetsLock.RUnlock()
+
+	result := make([]*RuleSet, 0, len(ruleSets))
+	for _, ruleSet := range ruleSets {
+		result = append(result, ruleSet)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// UseProfile makes the RuleSet with the given name the active one. All
+// proxies which are not bound to a specific RuleSet will use it from now on.
+func UseProfile(name string) error {
+	ruleSetsLock.Lock()
+	defer ruleSetsLock.Unlock()
+
+	if _, ok := ruleSets[name]; !ok && name != DefaultProfile {
+		return fmt.Errorf("there is no profile with name '%s'", name)
+	}
+	activeProfile = name
+	return nil
+}
+
+// GetActiveProfile returns the name of the active RuleSet
+func GetActiveProfile() string {
+	ruleSetsLock.RLock()
+	defer ruleSetsLock.RUnlock()
+	return activeProfile
+}
+
+// GetActiveRuleSet returns the active RuleSet
+func GetActiveRuleSet() *RuleSet {
+	return GetRuleSet(GetActiveProfile())
+}
+
+type activeRuleSet struct{}
+
+// Active returns a dialer which always uses the RuleSet which is active at
+// the time a connection gets established
+func Active() dialer.Dialer {
+	return activeRuleSet{}
+}
+
+func (activeRuleSet) Dial(network, addr string) (net.Conn, error) {
+	return GetActiveRuleSet().Dial(network, addr)
+}
+
+func (activeRuleSet) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return GetActiveRuleSet().DialContext(ctx, network, addr)
+}
+
+func (activeRuleSet) DialSniffed(network, host, addr string, dialHost bool) (net.Conn, error) {
+	return GetActiveRuleSet().DialSniffed(network, host, addr, dialHost)
+}
@@ -0,0 +1,57 @@
+package rules
+
+import "testing"
+
+func TestGetRuleSet_CreatesOnce(t *testing.T) {
+	a := GetRuleSet("test-create")
+	b := GetRuleSet("test-create")
+	if a != b {
+		t.Fatal("GetRuleSet returned different RuleSets for the same name")
+	}
+	if a.Name != "test-create" {
+		t.Errorf("expected name 'test-create', got '%s'", a.Name)
+	}
+	if GetRuleSet("") != GetDefaultRuleSet() {
+		t.Error("an empty name should refer to the default RuleSet")
+	}
+}
+
+func TestFindRuleSet_Unknown(t *testing.T) {
+	if FindRuleSet("test-does-not-exist") != nil {
+		t.Error("FindRuleSet should return nil for unknown names")
+	}
+	if FindRuleSet(DefaultProfile) == nil {
+		t.Error("FindRuleSet should always find the default RuleSet")
+	}
+}
+
+func TestUseProfile(t *testing.T) {
+	defer UseProfile(DefaultProfile)
+
+	if err := UseProfile("test-unknown-profile"); err == nil {
+		t.Error("UseProfile should fail for unknown profiles")
+	}
+	if GetActiveProfile() != DefaultProfile {
+		t.Errorf("active profile changed to '%s' after a failed switch", GetActiveProfile())
+	}
+
+	office := GetRuleSet("test-office")
+	if err := UseProfile("test-office"); err != nil {
+		t.Fatalf("UseProfile failed: %v", err)
+	}
+	if GetActiveRuleSet() != office {
+		t.Error("GetActiveRuleSet does not return the selected RuleSet")
+	}
+}
+
+func TestListRuleSets_Sorted(t *testing.T) {
+	GetRuleSet("test-b")
+	GetRuleSet("test-a")
+
+	ruleSets := ListRuleSets()
+	for i := 1; i < len(ruleSets); i++ {
+		if ruleSets[i-1].Name >= ruleSets[i].Name {
+			t.Errorf("RuleSets are not sorted: '%s' before '%s'", ruleSets[i-1].Name, ruleSets[i].Name)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/dialer"
+)
+
+// Resolve modes of a Rule
+const (
+	// ResolveDefault matches CIDR rules using the local resolver and passes
+	// the address unchanged to the dialer
+	ResolveDefault = ""
+	// ResolveLocal resolves host names using the local resolver and passes
+	// the resolved address to the dialer
+	ResolveLocal = "local"
+	// ResolveDNS resolves host names using the DNS proxy and passes the
+	// resolved address to the dialer
+	ResolveDNS = "dns"
+	// ResolveRemote never resolves host names locally. They are passed to the
+	// dialer, so that the remote side of the tunnel resolves them. CIDR rules
+	// only match host names if RemoteLookup is enabled, which resolves them
+	// over the ssh session of the dialer.
+	ResolveRemote = "remote"
+)
+
+// DNSResolver resolves host names for rules with the resolve mode ResolveDNS.
+// It is provided by the DNS proxy.
+var DNSResolver func(ctx context.Context, name string) (net.IP, error)
+
+const lookupTimeout = 10 * time.Second
+
+var errNoLookup = errors.New("host names are not resolved locally")
+
+type lookupResult struct {
+	ip  net.IP
+	err error
+}
+
+// matcher implements the matching logic of RuleSet.Match, RuleSet.Dial and
+// RuleSet.Explain. Each host name is resolved at most once per lookup mode.
+type matcher struct {
+	// ctx is passed to DNSResolver
+	ctx         context.Context
+	network     string
+	addr        string
+	host        string
+	port        string
+	ip          net.IP
+	lookups     map[string]lookupResult
+	explanation *Explanation
+	// knownIP is the address the host name is known to belong to, it is
+	// used instead of resolving the host name
+	knownIP net.IP
+}
+
+func newMatcher(ctx context.Context, network, addr string, explanation *Explanation) *matcher {
+	m := &matcher{
+		ctx:         ctx,
+		network:     network,
+		addr:        addr,
+		lookups:     make(map[string]lookupResult),
+		explanation: explanation,
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		m.host = host
+		m.port = port
+		m.ip = net.ParseIP(host)
+	}
+	return m
+}
+
+func (m *matcher) match(rs *RuleSet) (Rule, bool) {
+	if len(m.host) == 0 {
+		return Rule{}, false
+	}
+
+	ruleList, _ := rs.ListRules()
+	for _, r := range ruleList {
+		var matched bool
+		if r.IPNet == nil {
+			matched = m.ip == nil && r.MatchesDomain(m.host)
+		} else {
+			ip, err := m.lookup(r)
+			matched = err == nil && r.IPNet.Contains(ip)
+		}
+		m.explanation.evaluated(r, matched)
+		if matched {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// lookup returns the IP address which is used to check the CIDR range of
+// a rule
+func (m *matcher) lookup(rule Rule) (net.IP, error) {
+	if m.ip != nil {
+		return m.ip, nil
+	}
+	if m.knownIP != nil {
+		return m.knownIP, nil
+	}
+
+	mode := rule.Resolve
+	key := mode
+	if key == ResolveDefault {
+		key = ResolveLocal
+	}
+	dialerName := ""
+	if mode == ResolveRemote {
+		if !rule.RemoteLookup {
+			return nil, errNoLookup
+		}
+		dialerName = dialer.Select(rule.Dialers)
+		key = ResolveRemote + ":" + dialerName
+	}
+
+	if result, ok := m.lookups[key]; ok {
+		return result.ip, result.err
+	}
+
+	var ip net.IP
+	var err error
+
+	switch mode {
+	case ResolveDNS:
+		if DNSResolver == nil {
+			err = fmt.Errorf("there is no DNS proxy to resolve '%s'", m.host)
+			break
+		}
+		ctx, cancel := context.WithTimeout(m.ctx, lookupTimeout)
+		ip, err = DNSResolver(ctx, m.host)
+		cancel()
+	case ResolveRemote:
+		var ips []net.IP
+		ips, err = dialer.LookupHost(dialerName, m.host)
+		if err == nil {
+			ip = ips[0]
+		}
+	default:
+		var ipAddr *net.TCPAddr
+		ipAddr, err = net.ResolveTCPAddr(m.network, m.addr)
+		if err == nil {
+			ip = ipAddr.IP
+		}
+	}
+
+	m.lookups[key] = lookupResult{ip: ip, err: err}
+	m.explanation.resolved(key, ip, err)
+	return ip, err
+}
+
+// dialAddr returns the address which is passed to the dialers of a rule
+func (m *matcher) dialAddr(rule Rule) (string, error) {
+	if m.ip != nil {
+		return m.addr, nil
+	}
+	switch rule.Resolve {
+	case ResolveLocal, ResolveDNS:
+		ip, err := m.lookup(rule)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(ip.String(), m.port), nil
+	}
+	return m.addr, nil
+}
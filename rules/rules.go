@@ -1,32 +1,55 @@
 package rules
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"strings"
+	"sync"
 
 	"github.com/dueckminor/go-sshtunnel/dialer"
 
 	"github.com/dueckminor/go-sshtunnel/control"
 )
 
-// A Rule binds a CIDR range to a dialer
+// A Rule binds a CIDR range or a domain to an ordered list of dialers. If a
+// dialer fails to establish a connection, the next one is tried.
 type Rule struct {
-	IPNet  *net.IPNet
-	Dialer string
+	IPNet   *net.IPNet
+	Domain  string
+	Dialers []string
+	// Resolve defines where host names are resolved, see ResolveLocal,
+	// ResolveDNS and ResolveRemote. RemoteLookup enables CIDR matching of
+	// host names with ResolveRemote.
+	Resolve      string
+	RemoteLookup bool
+	// Source is the name of the rule source the rule has been loaded from.
+	// It is empty for rules which have been added manually.
+	Source string
 }
 
 // A RuleSet is a named set of Rules
 type RuleSet struct {
 	Name  string
 	Rules []Rule
+	// lock protects Rules. Rules is replaced on each change instead of being
+	// modified in place, so readers can keep using a snapshot of it.
+	lock sync.RWMutex
 }
 
 // Marshall converts a Rule to the wire-Format (JSON)
 func Marshall(rule Rule) control.Rule {
-	return control.Rule{
-		CIDR:   rule.IPNet.String(),
-		Dialer: rule.Dialer,
+	result := control.Rule{
+		Domain:       rule.Domain,
+		Dialer:       strings.Join(rule.Dialers, ","),
+		Resolve:      rule.Resolve,
+		RemoteLookup: rule.RemoteLookup,
+		Source:       rule.Source,
 	}
+	if rule.IPNet != nil {
+		result.CIDR = rule.IPNet.String()
+	}
+	return result
 }
 
 // UnMarshall converts the wire-Format (JSON) to a Rule
@@ -34,63 +57,212 @@ func UnMarshall(rule control.Rule) (Rule, error) {
 	var IPNet *net.IPNet
 	var err error
 
+	result := Rule{
+		Resolve:      rule.Resolve,
+		RemoteLookup: rule.RemoteLookup,
+	}
+	switch result.Resolve {
+	case ResolveDefault, ResolveLocal, ResolveDNS, ResolveRemote:
+	default:
+		return result, fmt.Errorf("'%s' is not a valid resolve mode", rule.Resolve)
+	}
+	if result.RemoteLookup && result.Resolve != ResolveRemote {
+		return result, fmt.Errorf("remote lookups require the resolve mode '%s'", ResolveRemote)
+	}
+
+	for _, dialerName := range strings.Split(rule.Dialer, ",") {
+		dialerName = strings.TrimSpace(dialerName)
+		if len(dialerName) > 0 {
+			result.Dialers = append(result.Dialers, dialerName)
+		}
+	}
+
+	if len(result.Dialers) == 0 {
+		result.Dialers = []string{"default"}
+	}
+
+	if len(rule.Domain) > 0 {
+		if len(rule.CIDR) > 0 {
+			return result, fmt.Errorf("a rule must not have a cidr and a domain")
+		}
+		result.Domain = NormalizeDomain(rule.Domain)
+		if !isValidDomain(result.Domain) {
+			return result, fmt.Errorf("'%s' is not a valid domain", rule.Domain)
+		}
+		return result, nil
+	}
+
 	cidr := rule.CIDR
 	if !strings.Contains(cidr, "/") {
-		cidr = cidr + "/32"
+		if strings.Contains(cidr, ":") {
+			cidr = cidr + "/128"
+		} else {
+			cidr = cidr + "/32"
+		}
 	}
 
 	_, IPNet, err = net.ParseCIDR(cidr)
+	result.IPNet = IPNet
 
-	result := Rule{
-		IPNet:  IPNet,
-		Dialer: rule.Dialer,
+	return result, err
+}
+
+// NormalizeDomain converts domain patterns like "*.example.com" or
+// ".example.com" to "example.com"
+func NormalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*")
+	domain = strings.Trim(domain, ".")
+	return domain
+}
+
+func isValidDomain(domain string) bool {
+	if len(domain) == 0 {
+		return false
+	}
+	for _, c := range domain {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
 	}
+	return true
+}
 
-	if len(result.Dialer) == 0 {
-		result.Dialer = "default"
+// MatchesDomain checks if the host name is equal to the domain of the rule
+// or is a subdomain of it
+func (rule Rule) MatchesDomain(host string) bool {
+	if len(rule.Domain) == 0 {
+		return false
 	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host == rule.Domain || strings.HasSuffix(host, "."+rule.Domain)
+}
 
-	return result, err
+func (rule Rule) key() string {
+	if rule.IPNet != nil {
+		return rule.IPNet.String()
+	}
+	return rule.Domain
 }
 
-// AddRule adds a single rule to a RuleSet. If the CIDR range is already
-// part if the RuleSet, the existing rule will be replaced
+// AddRule adds a single rule to a RuleSet. If the CIDR range or domain is
+// already part if the RuleSet, the existing rule will be replaced
 func (rs *RuleSet) AddRule(rule Rule) error {
-	for i, r := range rs.Rules {
-		if r.IPNet.String() == rule.IPNet.String() {
-			rs.Rules[i] = rule
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	result := make([]Rule, len(rs.Rules), len(rs.Rules)+1)
+	copy(result, rs.Rules)
+	for i, r := range result {
+		if r.key() == rule.key() {
+			result[i] = rule
+			rs.Rules = result
 			return nil
 		}
 	}
-	rs.Rules = append(rs.Rules, rule)
+	rs.Rules = append(result, rule)
 	return nil
 }
 
+// ReplaceSourceRules atomically replaces all rules loaded from the given
+// source. Rules which have been added manually or by another source take
+// precedence over the new rules.
+func (rs *RuleSet) ReplaceSourceRules(source string, rules []Rule) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	result := make([]Rule, 0, len(rs.Rules)+len(rules))
+	keys := make(map[string]bool)
+	for _, r := range rs.Rules {
+		if r.Source != source {
+			result = append(result, r)
+			keys[r.key()] = true
+		}
+	}
+	for _, r := range rules {
+		if !keys[r.key()] {
+			r.Source = source
+			result = append(result, r)
+			keys[r.key()] = true
+		}
+	}
+	rs.Rules = result
+}
+
 // ListRules returns all Rules
 func (rs *RuleSet) ListRules() (rules []Rule, err error) {
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
 	return rs.Rules, nil
 }
 
-var (
-	defaultRuleSet = &RuleSet{
-		Name: "default",
-	}
-)
-
-// GetDefaultRuleSet returns the default RuleSet
+// GetDefaultRuleSet returns the RuleSet named "default"
 func GetDefaultRuleSet() *RuleSet {
-	return defaultRuleSet
+	return GetRuleSet(DefaultProfile)
+}
+
+// Match returns the first rule matching addr. Domain rules are only checked
+// for host names, CIDR rules are checked after resolving the host name as
+// defined by the Resolve mode of the rule.
+func (rs *RuleSet) Match(network, addr string) (Rule, bool) {
+	return rs.MatchContext(context.Background(), network, addr)
 }
 
-// Dial uses the dialer of the first matching rule to establish a network connection
+// MatchContext is like Match, ctx is passed to DNSResolver
+func (rs *RuleSet) MatchContext(ctx context.Context, network, addr string) (Rule, bool) {
+	return newMatcher(ctx, network, addr, nil).match(rs)
+}
+
+// Dial uses the dialers of the first matching rule to establish a network
+// connection
 func (rs *RuleSet) Dial(network, addr string) (net.Conn, error) {
-	ipAddr, err := net.ResolveTCPAddr(network, addr)
-	if err == nil {
-		for _, rule := range rs.Rules {
-			if rule.IPNet.Contains(ipAddr.IP) {
-				return dialer.Dial(rule.Dialer, network, addr)
-			}
-		}
+	return rs.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial, ctx is passed to DNSResolver and used for
+// direct connections
+func (rs *RuleSet) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	m := newMatcher(ctx, network, addr, nil)
+	rule, ok := m.match(rs)
+	if !ok {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	dialAddr, err := m.dialAddr(rule)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialChain(rule.Dialers, network, dialAddr)
+}
+
+// DialSniffed establishes a connection to addr, which is an IP address and
+// a port, for a client which has sent the host name host (e.g. a transparent
+// proxy which has sniffed the TLS SNI). Domain rules are matched against
+// host, CIDR rules against the IP address of addr. If dialHost is set, the
+// host name is passed to the dialers instead of addr, unless the rule
+// resolves host names locally.
+func (rs *RuleSet) DialSniffed(network, host, addr string, dialHost bool) (net.Conn, error) {
+	rule, ok, dialAddr := rs.matchSniffed(network, host, addr, dialHost)
+	if !ok {
+		return net.Dial(network, dialAddr)
+	}
+	return dialer.DialChain(rule.Dialers, network, dialAddr)
+}
+
+// matchSniffed returns the rule and the dial address used by DialSniffed
+func (rs *RuleSet) matchSniffed(network, host, addr string, dialHost bool) (Rule, bool, string) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip, port, err := net.SplitHostPort(addr)
+	if err != nil || !isValidDomain(host) || net.ParseIP(host) != nil {
+		// not a usable host name, fall back to the IP address
+		m := newMatcher(context.Background(), network, addr, nil)
+		rule, ok := m.match(rs)
+		return rule, ok, addr
+	}
+	m := newMatcher(context.Background(), network, net.JoinHostPort(host, port), nil)
+	m.knownIP = net.ParseIP(ip)
+	rule, ok := m.match(rs)
+	if ok && dialHost && (rule.Resolve == ResolveDefault || rule.Resolve == ResolveRemote) {
+		return rule, true, m.addr
 	}
-	return net.Dial(network, addr)
+	return rule, ok, addr
 }
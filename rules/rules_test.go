@@ -0,0 +1,223 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+)
+
+func mustUnMarshall(t *testing.T, rule control.Rule) Rule {
+	t.Helper()
+	r, err := UnMarshall(rule)
+	if err != nil {
+		t.Fatalf("UnMarshall(%v) failed: %v", rule, err)
+	}
+	return r
+}
+
+func TestUnMarshall(t *testing.T) {
+	r := mustUnMarshall(t, control.Rule{CIDR: "10.1.2.3"})
+	if r.IPNet.String() != "10.1.2.3/32" || len(r.Dialers) != 1 || r.Dialers[0] != "default" {
+		t.Errorf("unexpected rule: %v %v", r.IPNet, r.Dialers)
+	}
+
+	r = mustUnMarshall(t, control.Rule{CIDR: "10.0.0.0/8", Dialer: "bastion-a, bastion-b,direct"})
+	if strings.Join(r.Dialers, "|") != "bastion-a|bastion-b|direct" {
+		t.Errorf("unexpected dialer chain: %v", r.Dialers)
+	}
+	if Marshall(r).Dialer != "bastion-a,bastion-b,direct" {
+		t.Errorf("unexpected marshalled dialer chain: %s", Marshall(r).Dialer)
+	}
+
+	r = mustUnMarshall(t, control.Rule{CIDR: "fd00::1"})
+	if r.IPNet.String() != "fd00::1/128" {
+		t.Errorf("unexpected IPv6 rule: %v", r.IPNet)
+	}
+
+	r = mustUnMarshall(t, control.Rule{Domain: "*.Corp.Example.", Dialer: "bastion"})
+	if r.Domain != "corp.example" || r.IPNet != nil {
+		t.Errorf("unexpected domain rule: %q %v", r.Domain, r.IPNet)
+	}
+
+	if _, err := UnMarshall(control.Rule{CIDR: "10.0.0.0/8", Domain: "corp.example"}); err == nil {
+		t.Error("UnMarshall should reject rules with a cidr and a domain")
+	}
+	if _, err := UnMarshall(control.Rule{CIDR: "not-a-cidr"}); err == nil {
+		t.Error("UnMarshall should reject invalid cidrs")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rs := &RuleSet{}
+	rs.AddRule(mustUnMarshall(t, control.Rule{Domain: "corp.example", Dialer: "bastion"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "10.0.0.0/8", Dialer: "office"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "10.1.0.0/16", Dialer: "never"}))
+
+	tests := []struct {
+		addr   string
+		dialer string
+	}{
+		{"corp.example:443", "bastion"},
+		{"www.corp.example:443", "bastion"},
+		{"WWW.CORP.EXAMPLE.:443", "bastion"},
+		{"10.1.2.3:22", "office"},
+		{"192.168.1.1:22", ""},
+		{"notcorp.example.invalid:443", ""},
+	}
+	for _, test := range tests {
+		rule, ok := rs.Match("tcp", test.addr)
+		dialerName := ""
+		if ok {
+			dialerName = rule.Dialers[0]
+		}
+		if dialerName != test.dialer {
+			t.Errorf("Match(%s): expected dialer %q, got %q", test.addr, test.dialer, dialerName)
+		}
+	}
+}
+
+func TestAddRule_Replaces(t *testing.T) {
+	rs := &RuleSet{}
+	rs.AddRule(mustUnMarshall(t, control.Rule{Domain: "corp.example", Dialer: "a"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{Domain: ".corp.example", Dialer: "b"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "10.0.0.0/8", Dialer: "a"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "10.0.0.0/8", Dialer: "b"}))
+
+	if len(rs.Rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rs.Rules))
+	}
+	for _, rule := range rs.Rules {
+		if rule.Dialers[0] != "b" {
+			t.Errorf("rule %s was not replaced", rule.key())
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	rs := &RuleSet{Name: "explain"}
+	rs.AddRule(mustUnMarshall(t, control.Rule{Domain: "corp.example", Dialer: "bastion"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "10.1.0.0/16", Dialer: "office"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "10.0.0.0/8", Dialer: "default"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "192.168.0.0/16", Dialer: "never"}))
+
+	explanation := rs.Explain("tcp", "10.2.3.4:22")
+	if explanation.Profile != "explain" {
+		t.Errorf("unexpected profile '%s'", explanation.Profile)
+	}
+	if len(explanation.Lookups) != 0 {
+		t.Error("IP addresses must not be resolved")
+	}
+	if explanation.Rule == nil || explanation.Rule.Dialers[0] != "default" {
+		t.Fatalf("unexpected winning rule: %v", explanation.Rule)
+	}
+	if len(explanation.Rules) != 3 {
+		t.Fatalf("expected 3 evaluated rules, got %d", len(explanation.Rules))
+	}
+	for i, matched := range []bool{false, false, true} {
+		if explanation.Rules[i].Matched != matched {
+			t.Errorf("rule %d: expected matched=%v", i, matched)
+		}
+	}
+
+	explanation = rs.Explain("tcp", "www.corp.example:443")
+	if explanation.Rule == nil || explanation.Rule.Dialers[0] != "bastion" || len(explanation.Rules) != 1 {
+		t.Errorf("unexpected explanation for a domain rule: %v", explanation.Rule)
+	}
+
+	explanation = rs.Explain("tcp", "172.16.0.1:22")
+	if explanation.Rule != nil || len(explanation.Rules) != 4 {
+		t.Errorf("expected no match after evaluating all rules, got %v", explanation.Rule)
+	}
+}
+
+func TestResolveModes(t *testing.T) {
+	defer func(resolver func(ctx context.Context, name string) (net.IP, error)) {
+		DNSResolver = resolver
+	}(DNSResolver)
+	DNSResolver = func(ctx context.Context, name string) (net.IP, error) {
+		if name == "intranet.corp.example" {
+			return net.ParseIP("10.1.2.3"), nil
+		}
+		return nil, fmt.Errorf("unknown host '%s'", name)
+	}
+
+	rs := &RuleSet{}
+	rs.AddRule(mustUnMarshall(t, control.Rule{Domain: "app.corp.example", Resolve: "dns"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "10.0.0.0/8", Resolve: "dns"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "172.16.0.0/12", Resolve: "remote"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "127.0.0.0/8", Dialer: "direct", Resolve: "remote", RemoteLookup: true}))
+
+	explanation := rs.Explain("tcp", "intranet.corp.example:443")
+	if explanation.Rule == nil || explanation.Rule.IPNet.String() != "10.0.0.0/8" {
+		t.Fatalf("unexpected rule: %v", explanation.Rule)
+	}
+	if explanation.DialAddr != "10.1.2.3:443" {
+		t.Errorf("the address resolved by the DNS proxy should be dialed, got '%s'", explanation.DialAddr)
+	}
+	if len(explanation.Lookups) != 1 || explanation.Lookups[0].Mode != "dns" {
+		t.Errorf("expected a single dns lookup, got %v", explanation.Lookups)
+	}
+
+	explanation = rs.Explain("tcp", "app.corp.example:443")
+	if explanation.Rule == nil || explanation.DialErr == nil {
+		t.Error("dialing should fail if the DNS proxy can't resolve the host name")
+	}
+
+	explanation = rs.Explain("tcp", "localhost:80")
+	if explanation.Rule == nil || explanation.Rule.IPNet.String() != "127.0.0.0/8" {
+		t.Fatalf("unexpected rule: %v", explanation.Rule)
+	}
+	if explanation.DialAddr != "localhost:80" {
+		t.Errorf("the host name should be passed to the dialer, got '%s'", explanation.DialAddr)
+	}
+	for _, lookup := range explanation.Lookups {
+		if lookup.Mode == "local" {
+			t.Error("host names must not be resolved locally for remote rules")
+		}
+	}
+
+	if _, err := UnMarshall(control.Rule{CIDR: "10.0.0.0/8", Resolve: "somewhere"}); err == nil {
+		t.Error("UnMarshall should reject unknown resolve modes")
+	}
+	if _, err := UnMarshall(control.Rule{CIDR: "10.0.0.0/8", RemoteLookup: true}); err == nil {
+		t.Error("UnMarshall should reject remote lookups without the remote resolve mode")
+	}
+}
+
+func TestMatchSniffed(t *testing.T) {
+	rs := &RuleSet{}
+	rs.AddRule(mustUnMarshall(t, control.Rule{Domain: "local.corp.example", Dialer: "office", Resolve: "local"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{Domain: "corp.example", Dialer: "office"}))
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "10.0.0.0/8", Dialer: "lab"}))
+
+	tests := []struct {
+		host     string
+		addr     string
+		dialHost bool
+		dialer   string
+		dialAddr string
+	}{
+		{"www.corp.example", "192.0.2.1:443", false, "office", "192.0.2.1:443"},
+		{"WWW.Corp.Example.", "192.0.2.1:443", true, "office", "www.corp.example:443"},
+		{"local.corp.example", "192.0.2.1:443", true, "office", "192.0.2.1:443"},
+		// CIDR rules use the original destination instead of resolving
+		{"www.example.org", "10.1.2.3:443", true, "lab", "www.example.org:443"},
+		{"10.1.2.3", "10.1.2.3:80", true, "lab", "10.1.2.3:80"},
+		{"www.example.org", "192.0.2.1:443", true, "", "192.0.2.1:443"},
+	}
+	for _, test := range tests {
+		rule, ok, dialAddr := rs.matchSniffed("tcp", test.host, test.addr, test.dialHost)
+		dialerName := ""
+		if ok {
+			dialerName = strings.Join(rule.Dialers, ",")
+		}
+		if dialerName != test.dialer || dialAddr != test.dialAddr {
+			t.Errorf("matchSniffed(%s, %s): got %s/%s, expected %s/%s",
+				test.host, test.addr, dialerName, dialAddr, test.dialer, test.dialAddr)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+	"github.com/dueckminor/go-sshtunnel/logger"
+	"github.com/goccy/go-yaml"
+)
+
+const (
+	// DefaultSourceInterval is used if a Source has no refresh interval
+	DefaultSourceInterval = 5 * time.Minute
+
+	// sourceFilePollInterval defines how often local files are checked for
+	// modifications
+	sourceFilePollInterval = 2 * time.Second
+)
+
+// A Source loads rules from a local file or an HTTP(S) URL and keeps them up
+// to date. All rules loaded from a Source are replaced atomically on each
+// refresh.
+type Source struct {
+	Name     string
+	Location string
+	// Format is one of "cidr", "json" or "yaml". If it is empty, the format
+	// is derived from the file extension or the content type.
+	Format string
+	// Dialer is used for all entries which don't specify a dialer
+	Dialer   string
+	Profile  string
+	Interval time.Duration
+
+	lock        sync.RWMutex
+	lastRefresh time.Time
+	modTime     time.Time
+	size        int64
+	rules       int
+	err         error
+	stop        chan struct{}
+}
+
+var (
+	sourcesLock sync.Mutex
+	sources     = make(map[string]*Source)
+
+	sourceHTTPClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// AddSource loads the rules of a source and refreshes them periodically.
+// An existing source with the same name gets replaced.
+func AddSource(source *Source) error {
+	if len(source.Location) == 0 {
+		return fmt.Errorf("the rule source has no location")
+	}
+	if len(source.Name) == 0 {
+		source.Name = source.Location
+	}
+	if len(source.Profile) == 0 {
+		source.Profile = DefaultProfile
+	}
+	if source.Interval <= 0 {
+		source.Interval = DefaultSourceInterval
+	}
+	source.stop = make(chan struct{})
+
+	rules, err := source.load()
+	if err != nil {
+		return err
+	}
+
+	// the old watcher is stopped before the rules are replaced, so that a
+	// refresh of the old source can't overwrite them anymore
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	if old, ok := sources[source.Name]; ok {
+		close(old.stop)
+		if old.Profile != source.Profile {
+			GetRuleSet(old.Profile).ReplaceSourceRules(old.Name, nil)
+		}
+	}
+	GetRuleSet(source.Profile).ReplaceSourceRules(source.Name, rules)
+	sources[source.Name] = source
+
+	go source.watch()
+	return nil
+}
+
+// RemoveSource stops refreshing a source and removes all rules loaded from it
+func RemoveSource(name string) error {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+
+	source, ok := sources[name]
+	if !ok {
+		return fmt.Errorf("there is no rule source with name '%s'", name)
+	}
+	close(source.stop)
+	delete(sources, name)
+	GetRuleSet(source.Profile).ReplaceSourceRules(source.Name, nil)
+	return nil
+}
+
+// ListSources returns all sources sorted by name
+func ListSources() []*Source {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+
+	result := make([]*Source, 0, len(sources))
+	for _, source := range sources {
+		result = append(result, source)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// MarshallSource converts a Source to the wire-Format (JSON)
+func MarshallSource(source *Source) control.RuleSource {
+	source.lock.RLock()
+	defer source.lock.RUnlock()
+
+	result := control.RuleSource{
+		Name:        source.Name,
+		Location:    source.Location,
+		Format:      source.Format,
+		Dialer:      source.Dialer,
+		Profile:     source.Profile,
+		Interval:    source.Interval.String(),
+		LastRefresh: source.lastRefresh,
+		Rules:       source.rules,
+	}
+	if source.err != nil {
+		result.Error = source.err.Error()
+	}
+	return result
+}
+
+// UnMarshallSource converts the wire-Format (JSON) to a Source
+func UnMarshallSource(source control.RuleSource) (*Source, error) {
+	result := &Source{
+		Name:     source.Name,
+		Location: source.Location,
+		Format:   source.Format,
+		Dialer:   source.Dialer,
+		Profile:  source.Profile,
+	}
+	if len(source.Interval) > 0 {
+		interval, err := time.ParseDuration(source.Interval)
+		if err != nil {
+			return nil, err
+		}
+		result.Interval = interval
+	}
+	switch result.Format {
+	case "", "cidr", "json", "yaml":
+	default:
+		return nil, fmt.Errorf("unsupported rule source format '%s'", result.Format)
+	}
+	return result, nil
+}
+
+func (source *Source) isURL() bool {
+	return strings.HasPrefix(source.Location, "http://") ||
+		strings.HasPrefix(source.Location, "https://")
+}
+
+func (source *Source) watch() {
+	pollInterval := source.Interval
+	if !source.isURL() && sourceFilePollInterval < pollInterval {
+		pollInterval = sourceFilePollInterval
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	nextRefresh := time.Now().Add(source.Interval)
+	for {
+		select {
+		case <-source.stop:
+			return
+		case now := <-ticker.C:
+			if now.Before(nextRefresh) && !source.fileChanged() {
+				continue
+			}
+			nextRefresh = now.Add(source.Interval)
+			source.Refresh() //nolint:errcheck
+		}
+	}
+}
+
+func (source *Source) fileChanged() bool {
+	if source.isURL() {
+		return false
+	}
+	info, err := os.Stat(source.Location)
+	if err != nil {
+		return false
+	}
+	source.lock.RLock()
+	defer source.lock.RUnlock()
+	return !info.ModTime().Equal(source.modTime) || info.Size() != source.size
+}
+
+// Refresh loads the rules of a source. If loading fails, the rules loaded
+// previously are kept.
+func (source *Source) Refresh() error {
+	rules, err := source.load()
+	if err != nil {
+		return err
+	}
+
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	select {
+	case <-source.stop:
+		// the source has been removed or replaced in the meantime
+		return nil
+	default:
+	}
+	GetRuleSet(source.Profile).ReplaceSourceRules(source.Name, rules)
+	return nil
+}
+
+// load reads and parses the rules of a source and records the result in
+// the status of the source
+func (source *Source) load() ([]Rule, error) {
+	data, format, info, err := source.read()
+	var rules []Rule
+	if err == nil {
+		rules, err = parseSourceRules(data, format, source.Dialer)
+	}
+
+	source.lock.Lock()
+	source.lastRefresh = time.Now()
+	source.err = err
+	if info != nil {
+		source.modTime = info.ModTime()
+		source.size = info.Size()
+	}
+	if err == nil {
+		source.rules = len(rules)
+	}
+	source.lock.Unlock()
+
+	if err != nil {
+		logger.L.Printf("refreshing rule source '%s' failed: %v\n", source.Name, err)
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (source *Source) read() (data []byte, format string, info os.FileInfo, err error) {
+	format = source.Format
+
+	if source.isURL() {
+		resp, err := sourceHTTPClient.Get(source.Location)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, "", nil, fmt.Errorf("GET %s failed: %s", source.Location, resp.Status)
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+		if len(format) == 0 {
+			format = formatFromContentType(resp.Header.Get("Content-Type"))
+		}
+		if len(format) == 0 {
+			format = formatFromExtension(resp.Request.URL.Path)
+		}
+		return data, format, nil, err
+	}
+
+	info, err = os.Stat(source.Location)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	data, err = ioutil.ReadFile(source.Location)
+	if len(format) == 0 {
+		format = formatFromExtension(source.Location)
+	}
+	return data, format, info, err
+}
+
+func formatFromContentType(contentType string) string {
+	switch {
+	case strings.Contains(contentType, "json"):
+		return "json"
+	case strings.Contains(contentType, "yaml"):
+		return "yaml"
+	}
+	return ""
+}
+
+func formatFromExtension(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "cidr"
+}
+
+// sourceEntry is an entry of a json or yaml rule source. Entries are either
+// plain strings (a CIDR range or a domain) or objects like control.Rule.
+type sourceEntry control.Rule
+
+func (entry *sourceEntry) UnmarshalJSON(data []byte) error {
+	var target string
+	if err := json.Unmarshal(data, &target); err == nil {
+		*entry = sourceEntry(ruleTarget(target))
+		return nil
+	}
+	return json.Unmarshal(data, (*control.Rule)(entry))
+}
+
+func ruleTarget(target string) control.Rule {
+	if _, _, err := net.ParseCIDR(target); err == nil || net.ParseIP(target) != nil {
+		return control.Rule{CIDR: target}
+	}
+	return control.Rule{Domain: target}
+}
+
+func parseSourceRules(data []byte, format, dialer string) (rules []Rule, err error) {
+	var entries []control.Rule
+
+	switch format {
+	case "yaml":
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		fallthrough
+	case "json":
+		var list []sourceEntry
+		if err = json.Unmarshal(data, &list); err != nil {
+			var object struct {
+				Rules []sourceEntry `json:"rules"`
+			}
+			if json.Unmarshal(data, &object) != nil {
+				return nil, err
+			}
+			list = object.Rules
+		}
+		for _, entry := range list {
+			entries = append(entries, control.Rule(entry))
+		}
+	default:
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			entry := ruleTarget(fields[0])
+			if len(fields) > 1 {
+				entry.Dialer = fields[1]
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, entry := range entries {
+		if len(entry.Dialer) == 0 {
+			entry.Dialer = dialer
+		}
+		rule, err := UnMarshall(entry)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,170 @@
+package rules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+)
+
+func ruleKeys(rules []Rule) (keys []string) {
+	for _, rule := range rules {
+		keys = append(keys, rule.key()+"@"+strings.Join(rule.Dialers, ","))
+	}
+	return keys
+}
+
+func expectKeys(t *testing.T, rules []Rule, expected ...string) {
+	t.Helper()
+	keys := ruleKeys(rules)
+	if len(keys) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, keys)
+	}
+	for i := range keys {
+		if keys[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, keys)
+		}
+	}
+}
+
+func TestParseSourceRules(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+	}{
+		{"cidr", "# internal networks\n10.0.0.0/8\n\n172.16.0.0/12 office # comment\ncorp.example\n"},
+		{"json", `["10.0.0.0/8", {"cidr": "172.16.0.0/12", "dialer": "office"}, "corp.example"]`},
+		{"json", `{"rules": ["10.0.0.0/8", {"cidr": "172.16.0.0/12", "dialer": "office"}, {"domain": "corp.example"}]}`},
+		{"yaml", "- 10.0.0.0/8\n- cidr: 172.16.0.0/12\n  dialer: office\n- domain: corp.example\n"},
+		{"yaml", "rules:\n  - 10.0.0.0/8\n  - {cidr: 172.16.0.0/12, dialer: office}\n  - corp.example\n"},
+	}
+	for _, test := range tests {
+		rules, err := parseSourceRules([]byte(test.data), test.format, "bastion")
+		if err != nil {
+			t.Errorf("%s: parseSourceRules failed: %v", test.format, err)
+			continue
+		}
+		expectKeys(t, rules, "10.0.0.0/8@bastion", "172.16.0.0/12@office", "corp.example@bastion")
+	}
+
+	if _, err := parseSourceRules([]byte("10.0.0.0/33\n"), "cidr", ""); err == nil {
+		t.Error("parseSourceRules should reject invalid entries")
+	}
+}
+
+func TestReplaceSourceRules(t *testing.T) {
+	rs := &RuleSet{}
+	rs.AddRule(mustUnMarshall(t, control.Rule{CIDR: "10.1.0.0/16", Dialer: "manual"}))
+
+	rs.ReplaceSourceRules("net", []Rule{
+		mustUnMarshall(t, control.Rule{CIDR: "10.0.0.0/8"}),
+		mustUnMarshall(t, control.Rule{CIDR: "10.1.0.0/16", Dialer: "source"}),
+	})
+	expectKeys(t, rs.Rules, "10.1.0.0/16@manual", "10.0.0.0/8@default")
+	if rs.Rules[1].Source != "net" {
+		t.Errorf("expected source 'net', got '%s'", rs.Rules[1].Source)
+	}
+
+	rs.ReplaceSourceRules("net", []Rule{
+		mustUnMarshall(t, control.Rule{CIDR: "192.168.0.0/16"}),
+	})
+	expectKeys(t, rs.Rules, "10.1.0.0/16@manual", "192.168.0.0/16@default")
+
+	rs.ReplaceSourceRules("net", nil)
+	expectKeys(t, rs.Rules, "10.1.0.0/16@manual")
+}
+
+func TestAddSource_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "networks.txt")
+	if err := os.WriteFile(path, []byte("10.0.0.0/8\n10.1.0.0/16\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &Source{Name: "test-file", Location: path, Profile: "test-source-file", Dialer: "bastion"}
+	if err := AddSource(source); err != nil {
+		t.Fatalf("AddSource failed: %v", err)
+	}
+	defer RemoveSource("test-file")
+
+	ruleSet := GetRuleSet("test-source-file")
+	expectKeys(t, ruleSet.Rules, "10.0.0.0/8@bastion", "10.1.0.0/16@bastion")
+
+	if err := os.WriteFile(path, []byte("192.168.0.0/16\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !source.fileChanged() {
+		t.Error("fileChanged does not detect the modification")
+	}
+	if err := source.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	expectKeys(t, ruleSet.Rules, "192.168.0.0/16@bastion")
+
+	if err := os.WriteFile(path, []byte("10.0.0.0/33\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Refresh(); err == nil {
+		t.Error("Refresh should fail for invalid content")
+	}
+	expectKeys(t, ruleSet.Rules, "192.168.0.0/16@bastion")
+
+	if err := RemoveSource("test-file"); err != nil {
+		t.Fatalf("RemoveSource failed: %v", err)
+	}
+	expectKeys(t, ruleSet.Rules)
+}
+
+func TestAddSource_URL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`["10.0.0.0/8", "corp.example"]`))
+	}))
+	defer server.Close()
+
+	source := &Source{Name: "test-url", Location: server.URL + "/networks", Profile: "test-source-url"}
+	if err := AddSource(source); err != nil {
+		t.Fatalf("AddSource failed: %v", err)
+	}
+	defer RemoveSource("test-url")
+
+	expectKeys(t, GetRuleSet("test-source-url").Rules, "10.0.0.0/8@default", "corp.example@default")
+	if MarshallSource(source).Rules != 2 {
+		t.Error("the source does not report the number of rules")
+	}
+}
+
+func TestAddSource_Replace(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.txt")
+	newPath := filepath.Join(dir, "new.txt")
+	os.WriteFile(oldPath, []byte("10.0.0.0/8\n"), 0600)
+	os.WriteFile(newPath, []byte("192.168.0.0/16\n"), 0600)
+
+	old := &Source{Name: "test-replace", Location: oldPath, Profile: "test-source-replace"}
+	if err := AddSource(old); err != nil {
+		t.Fatalf("AddSource failed: %v", err)
+	}
+	defer RemoveSource("test-replace")
+
+	// a failing replacement keeps the old source
+	if err := AddSource(&Source{Name: "test-replace", Location: filepath.Join(dir, "missing.txt"), Profile: "test-source-replace"}); err == nil {
+		t.Fatal("AddSource should fail for a missing file")
+	}
+	ruleSet := GetRuleSet("test-source-replace")
+	expectKeys(t, ruleSet.Rules, "10.0.0.0/8@default")
+
+	if err := AddSource(&Source{Name: "test-replace", Location: newPath, Profile: "test-source-replace"}); err != nil {
+		t.Fatalf("AddSource failed: %v", err)
+	}
+	expectKeys(t, ruleSet.Rules, "192.168.0.0/16@default")
+
+	// a refresh of the replaced source doesn't restore its rules
+	if err := old.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	expectKeys(t, ruleSet.Rules, "192.168.0.0/16@default")
+}
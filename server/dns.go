@@ -0,0 +1,128 @@
+package server
+
+import (
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+	"github.com/dueckminor/go-sshtunnel/proxy"
+)
+
+// ListDNSCache implements control.API.ListDNSCache
+func (server *Server) ListDNSCache() ([]control.DNSCacheEntry, error) {
+	entries := proxy.ListDNSCache()
+	result := make([]control.DNSCacheEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = control.DNSCacheEntry{
+			Proxy:    entry.Proxy,
+			Name:     entry.Name,
+			Type:     entry.Type,
+			Negative: entry.Negative,
+			Rcode:    entry.Rcode,
+			TTL:      int(entry.TTL / time.Second),
+			Hits:     entry.Hits,
+		}
+	}
+	return result, nil
+}
+
+// FlushDNSCache implements control.API.FlushDNSCache
+func (server *Server) FlushDNSCache(name string) (control.DNSCacheFlush, error) {
+	return control.DNSCacheFlush{Removed: proxy.FlushDNSCache(name)}, nil
+}
+
+// ListDNSZones implements control.API.ListDNSZones
+func (server *Server) ListDNSZones() ([]control.DNSZone, error) {
+	zones := proxy.ListDNSZones()
+	result := make([]control.DNSZone, len(zones))
+	for i, zone := range zones {
+		result[i] = control.DNSZone{
+			Zone:   zone.Zone,
+			Target: zone.Target,
+			Dialer: zone.Dialer,
+		}
+	}
+	return result, nil
+}
+
+// AddDNSZone implements control.API.AddDNSZone
+func (server *Server) AddDNSZone(zone control.DNSZone) error {
+	return proxy.AddDNSZone(proxy.DNSZone{
+		Zone:   zone.Zone,
+		Target: zone.Target,
+		Dialer: zone.Dialer,
+	})
+}
+
+// RemoveDNSZone implements control.API.RemoveDNSZone
+func (server *Server) RemoveDNSZone(zone string) error {
+	return proxy.RemoveDNSZone(zone)
+}
+
+// ListDNSHosts implements control.API.ListDNSHosts
+func (server *Server) ListDNSHosts() ([]control.DNSHost, error) {
+	hosts := proxy.ListDNSHosts()
+	result := make([]control.DNSHost, len(hosts))
+	for i, host := range hosts {
+		result[i] = control.DNSHost{
+			Name:   host.Name,
+			Type:   host.Type,
+			Value:  host.Value,
+			Source: host.Source,
+		}
+	}
+	return result, nil
+}
+
+// AddDNSHost implements control.API.AddDNSHost
+func (server *Server) AddDNSHost(host control.DNSHost) error {
+	return proxy.AddDNSHost(proxy.DNSHost{
+		Name:  host.Name,
+		Type:  host.Type,
+		Value: host.Value,
+	})
+}
+
+// RemoveDNSHost implements control.API.RemoveDNSHost
+func (server *Server) RemoveDNSHost(name string) error {
+	return proxy.RemoveDNSHost(name)
+}
+
+// ListDNSLog implements control.API.ListDNSLog
+func (server *Server) ListDNSLog(filter control.DNSLogFilter) ([]control.DNSLogEntry, error) {
+	entries := proxy.ListDNSLog(proxy.DNSLogFilter{
+		Since:  filter.Since,
+		Name:   filter.Name,
+		Type:   filter.Type,
+		Rcode:  filter.Rcode,
+		Client: filter.Client,
+		Proxy:  filter.Proxy,
+		Limit:  filter.Limit,
+	})
+	result := make([]control.DNSLogEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = control.DNSLogEntry{
+			Seq:       entry.Seq,
+			Time:      entry.Time,
+			Proxy:     entry.Proxy,
+			Client:    entry.Client,
+			Name:      entry.Name,
+			Type:      entry.Type,
+			Rcode:     entry.Rcode,
+			Upstream:  entry.Upstream,
+			LatencyMS: float64(entry.Latency) / float64(time.Millisecond),
+			Cached:    entry.Cached,
+			Error:     entry.Error,
+		}
+	}
+	return result, nil
+}
+
+// LoadDNSHosts implements control.API.LoadDNSHosts
+func (server *Server) LoadDNSHosts(file control.DNSHostsFile) (control.DNSHostsFile, error) {
+	hosts, err := proxy.LoadDNSHosts(file.File)
+	if err != nil {
+		return file, err
+	}
+	file.Hosts = hosts
+	return file, nil
+}
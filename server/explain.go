@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+	"github.com/dueckminor/go-sshtunnel/dialer"
+	"github.com/dueckminor/go-sshtunnel/proxy"
+	"github.com/dueckminor/go-sshtunnel/rules"
+)
+
+// splitTarget splits "host[:port]" into host and port. If there is no port,
+// port 0 is used, as the rules don't depend on the port.
+func splitTarget(target string) (host, port string) {
+	if ip := net.ParseIP(strings.Trim(target, "[]")); ip != nil {
+		return ip.String(), "0"
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return target, "0"
+	}
+	return host, port
+}
+
+// Explain implements control.API.Explain
+func (server *Server) Explain(target string, profile string) (result control.Explanation, err error) {
+	ruleSet := rules.GetActiveRuleSet()
+	if len(profile) > 0 {
+		ruleSet = rules.FindRuleSet(profile)
+		if ruleSet == nil {
+			return result, fmt.Errorf("there is no profile with name '%s'", profile)
+		}
+	}
+
+	host, port := splitTarget(target)
+	if len(host) == 0 {
+		return result, fmt.Errorf("'%s' is not a valid target", target)
+	}
+
+	explanation := ruleSet.Explain("tcp", net.JoinHostPort(host, port))
+
+	result.Target = target
+	result.Profile = explanation.Profile
+
+	// the host name is only resolved as far as the resolve modes of the
+	// evaluated rules require it, like a connection to the target would
+	if ip := net.ParseIP(host); ip != nil {
+		result.Addresses = []string{ip.String()}
+	} else {
+		for _, lookup := range explanation.Lookups {
+			result.Lookups = append(result.Lookups, explainLookup(lookup))
+			if lookup.IP != nil && !containsString(result.Addresses, lookup.IP.String()) {
+				result.Addresses = append(result.Addresses, lookup.IP.String())
+			}
+		}
+		result.DNSProxy = explainDNSProxy(host, explanation.Lookups)
+	}
+
+	result.Rules = make([]control.EvaluatedRule, len(explanation.Rules))
+	for i, evaluated := range explanation.Rules {
+		result.Rules[i].Rule = rules.Marshall(evaluated.Rule)
+		result.Rules[i].Matched = evaluated.Matched
+	}
+
+	if explanation.Rule != nil {
+		rule := rules.Marshall(*explanation.Rule)
+		result.Rule = &rule
+		result.DialAddress = explanation.DialAddr
+		if explanation.DialErr != nil {
+			result.DialError = explanation.DialErr.Error()
+		}
+
+		selected := dialer.Select(explanation.Rule.Dialers)
+		d := explainDialer(selected)
+		result.Dialer = &d
+		for _, dialerName := range explanation.Rule.Dialers {
+			if dialerName != selected {
+				result.Fallbacks = append(result.Fallbacks, explainDialer(dialerName))
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func explainLookup(lookup rules.Lookup) control.Lookup {
+	result := control.Lookup{
+		Mode: lookup.Mode,
+	}
+	if lookup.IP != nil {
+		result.Address = lookup.IP.String()
+	}
+	if lookup.Err != nil {
+		result.Error = lookup.Err.Error()
+	}
+	return result
+}
+
+func explainDialer(dialerName string) control.Dialer {
+	if info, ok := dialer.GetDialer(dialerName); ok {
+		d, _ := dialer.Marshall(info)
+		return d
+	}
+	return control.Dialer{
+		Name:  dialerName,
+		State: "missing",
+	}
+}
+
+// explainDNSProxy returns the upstream the DNS proxy forwards the queries
+// for host to and the result of the lookup using the DNS proxy, if a rule
+// has needed one
+func explainDNSProxy(host string, lookups []rules.Lookup) *control.ExplainDNS {
+	target := proxy.DNSTargetFor(host)
+	if len(target) == 0 {
+		return nil
+	}
+
+	result := &control.ExplainDNS{
+		Target: target,
+	}
+	for _, lookup := range lookups {
+		if lookup.Mode != rules.ResolveDNS {
+			continue
+		}
+		if lookup.Err != nil {
+			result.Error = lookup.Err.Error()
+		} else {
+			result.Addresses = []string{lookup.IP.String()}
+		}
+	}
+	return result
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
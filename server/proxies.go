@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dueckminor/go-sshtunnel/control"
+	"github.com/dueckminor/go-sshtunnel/proxy"
+	"github.com/dueckminor/go-sshtunnel/rules"
+)
+
+// serverProxy is a proxy started via the control API
+type serverProxy struct {
+	info  control.Proxy
+	proxy proxy.Proxy
+}
+
+func startProxy(id string, request control.Proxy) (*serverProxy, error) {
+	config := proxy.Config{
+		Listen:     request.Listen,
+		Parameters: request.ProxyParameters,
+		Options:    request.Options,
+	}
+	if len(request.Profile) > 0 {
+		config.Dialer = rules.GetRuleSet(request.Profile)
+	}
+	p, err := proxy.NewProxy(request.ProxyType, config)
+	if err != nil {
+		return nil, err
+	}
+	return &serverProxy{
+		info: control.Proxy{
+			ID:              id,
+			ProxyType:       request.ProxyType,
+			ProxyPort:       p.GetPort(),
+			ProxyParameters: request.ProxyParameters,
+			Profile:         request.Profile,
+			Listen:          request.Listen,
+			Address:         p.GetAddress(),
+			Options:         request.Options,
+		},
+		proxy: p,
+	}, nil
+}
+
+// findProxy returns the index of the proxy with the given id. The caller
+// must hold proxiesLock.
+func (server *Server) findProxy(id string) (int, error) {
+	for i, p := range server.proxies {
+		if p.info.ID == id {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("there is no proxy with id '%s'", id)
+}
+
+// StartProxy implements control.API.StartProxy
+func (server *Server) StartProxy(request control.Proxy) (proxyInfo control.Proxy, err error) {
+	server.proxiesLock.Lock()
+	defer server.proxiesLock.Unlock()
+
+	p, err := startProxy(strconv.Itoa(server.lastProxyID+1), request)
+	if err != nil {
+		return proxyInfo, err
+	}
+	server.lastProxyID++
+	server.proxies = append(server.proxies, p)
+	return p.info, nil
+}
+
+// ListProxies implements control.API.ListProxies
+func (server *Server) ListProxies() ([]control.Proxy, error) {
+	server.proxiesLock.Lock()
+	defer server.proxiesLock.Unlock()
+
+	result := make([]control.Proxy, len(server.proxies))
+	for i, p := range server.proxies {
+		result[i] = p.info
+		for _, upstream := range proxy.DNSUpstreams(p.proxy) {
+			result[i].Upstreams = append(result[i].Upstreams, control.DNSUpstream{
+				Target:    upstream.Target,
+				Dialer:    upstream.Dialer,
+				Healthy:   upstream.Healthy,
+				RTTMS:     float64(upstream.RTT) / float64(time.Millisecond),
+				LastError: upstream.LastError,
+			})
+		}
+	}
+	return result, nil
+}
+
+// StopProxy implements control.API.StopProxy. The proxy is removed while
+// holding the lock, but drained without it, so that other requests are not
+// blocked.
+func (server *Server) StopProxy(id string) error {
+	server.proxiesLock.Lock()
+	i, err := server.findProxy(id)
+	if err != nil {
+		server.proxiesLock.Unlock()
+		return err
+	}
+	p := server.proxies[i]
+	server.proxies = append(server.proxies[:i:i], server.proxies[i+1:]...)
+	server.proxiesLock.Unlock()
+
+	return p.proxy.Close()
+}
+
+// RestartProxy implements control.API.RestartProxy. The proxy keeps its id,
+// but gets the type, parameters and profile of the request. If the new
+// configuration can't be started, the old one is restored. While the proxy
+// is restarted, it is not listed.
+func (server *Server) RestartProxy(id string, request control.Proxy) (proxyInfo control.Proxy, err error) {
+	server.proxiesLock.Lock()
+	i, err := server.findProxy(id)
+	if err != nil {
+		server.proxiesLock.Unlock()
+		return proxyInfo, err
+	}
+	old := server.proxies[i]
+	server.proxies = append(server.proxies[:i:i], server.proxies[i+1:]...)
+	server.proxiesLock.Unlock()
+
+	if len(request.ProxyType) == 0 {
+		request.ProxyType = old.info.ProxyType
+	}
+	pinListen(old.info, &request)
+
+	old.proxy.Close() //nolint:errcheck
+
+	p, err := startProxy(id, request)
+	if err != nil {
+		restoreInfo := old.info
+		restoreInfo.Listen = old.info.Address
+		restored, restoreErr := startProxy(id, restoreInfo)
+		if restoreErr != nil {
+			return proxyInfo, fmt.Errorf("%v (restoring the old configuration failed: %v)", err, restoreErr)
+		}
+		server.insertProxy(i, restored)
+		return proxyInfo, err
+	}
+	server.insertProxy(i, p)
+	return p.info, nil
+}
+
+// insertProxy adds a restarted proxy at its old position
+func (server *Server) insertProxy(i int, p *serverProxy) {
+	server.proxiesLock.Lock()
+	defer server.proxiesLock.Unlock()
+	if i > len(server.proxies) {
+		i = len(server.proxies)
+	}
+	server.proxies = append(server.proxies[:i:i], append([]*serverProxy{p}, server.proxies[i:]...)...)
+}
+
+// pinListen keeps the address a proxy is bound to across a restart, so that
+// a proxy listening on a port chosen by the system keeps it. The address is
+// only changed by another listen address or, for the proxy types which accept
+// their listen address as parameters, by other parameters.
+func pinListen(old control.Proxy, request *control.Proxy) {
+	if len(request.Listen) > 0 && request.Listen != old.Listen {
+		return
+	}
+	if len(old.Listen) == 0 && request.ProxyType != "dns" && request.ProxyParameters != old.ProxyParameters {
+		return
+	}
+	request.Listen = old.Address
+}
+
+// ListSocks5Users implements control.API.ListSocks5Users. Passwords are not
+// returned.
+func (server *Server) ListSocks5Users() ([]control.Socks5User, error) {
+	users := proxy.ListSocks5Users()
+	result := make([]control.Socks5User, len(users))
+	for i, user := range users {
+		result[i].Name = user.Name
+		result[i].Dialers = strings.Join(user.Dialers, ",")
+	}
+	return result, nil
+}
+
+// AddSocks5User implements control.API.AddSocks5User
+func (server *Server) AddSocks5User(user control.Socks5User) error {
+	u := proxy.Socks5User{
+		Name:     user.Name,
+		Password: user.Password,
+	}
+	if len(user.Dialers) > 0 {
+		u.Dialers = strings.Split(user.Dialers, ",")
+	}
+	return proxy.AddSocks5User(u)
+}
+
+// RemoveSocks5User implements control.API.RemoveSocks5User
+func (server *Server) RemoveSocks5User(name string) error {
+	return proxy.RemoveSocks5User(name)
+}
@@ -6,19 +6,22 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/dueckminor/go-sshtunnel/commands"
 	"github.com/dueckminor/go-sshtunnel/control"
 	"github.com/dueckminor/go-sshtunnel/dialer"
-	"github.com/dueckminor/go-sshtunnel/proxy"
 	"github.com/dueckminor/go-sshtunnel/rules"
 )
 
 // Server is the central object of sshtunnel
 type Server struct {
-	done    chan int
-	proxies []control.Proxy
+	done chan int
+
+	proxiesLock sync.Mutex
+	proxies     []*serverProxy
+	lastProxyID int
 
 	connectors map[string]*ServerConnector
 }
@@ -44,7 +47,8 @@ func (server *Server) Health() (bool, error) {
 // Status implements control.API.Status
 func (server *Server) Status() (status control.Status, err error) {
 	status.Healthy = true
-	status.Proxies = server.proxies
+	status.Proxies, _ = server.ListProxies()
+	status.Profile = rules.GetActiveProfile()
 	return status, nil
 }
 
@@ -54,23 +58,6 @@ func (server *Server) Stop() error {
 	return nil
 }
 
-// StartProxy implements control.API.StartProxy
-func (server *Server) StartProxy(proxyType string, proxyParameter string) (proxyInfo control.Proxy, err error) {
-	proxy, err := proxy.NewProxy(proxyType, proxyParameter)
-	if err == nil {
-		proxyInfo.ProxyType = proxyType
-		proxyInfo.ProxyPort = proxy.GetPort()
-		proxyInfo.ProxyParameters = proxyParameter
-		server.proxies = append(server.proxies, proxyInfo)
-	}
-	return proxyInfo, err
-}
-
-// ListProxies implements control.API.ListProxies
-func (server *Server) ListProxies() ([]control.Proxy, error) {
-	return server.proxies, nil
-}
-
 // AddSSHKey implements control.API.AddSSHKey
 func (server *Server) AddSSHKey(encodedKey string, passPhrase string) error {
 	return dialer.AddSSHKey(encodedKey, passPhrase)
@@ -165,8 +152,15 @@ func (server *Server) ListDialers() (dialers []control.Dialer, err error) {
 }
 
 // ListRules implements control.API.ListRules
-func (server *Server) ListRules() ([]control.Rule, error) {
-	ruleList, err := rules.GetDefaultRuleSet().ListRules()
+func (server *Server) ListRules(profile string) ([]control.Rule, error) {
+	ruleSet := rules.GetActiveRuleSet()
+	if len(profile) > 0 {
+		ruleSet = rules.FindRuleSet(profile)
+		if ruleSet == nil {
+			return nil, fmt.Errorf("there is no profile with name '%s'", profile)
+		}
+	}
+	ruleList, err := ruleSet.ListRules()
 	if err != nil {
 		return nil, err
 	}
@@ -185,7 +179,60 @@ func (server *Server) AddRule(rule control.Rule) error {
 	if err != nil {
 		return err
 	}
-	return rules.GetDefaultRuleSet().AddRule(r)
+	if len(rule.Profile) > 0 {
+		return rules.GetRuleSet(rule.Profile).AddRule(r)
+	}
+	return rules.GetActiveRuleSet().AddRule(r)
+}
+
+// ListRuleSources implements control.API.ListRuleSources
+func (server *Server) ListRuleSources() ([]control.RuleSource, error) {
+	sources := rules.ListSources()
+	result := make([]control.RuleSource, len(sources))
+	for i, source := range sources {
+		result[i] = rules.MarshallSource(source)
+	}
+	return result, nil
+}
+
+// AddRuleSource implements control.API.AddRuleSource
+func (server *Server) AddRuleSource(source control.RuleSource) error {
+	s, err := rules.UnMarshallSource(source)
+	if err != nil {
+		return err
+	}
+	if len(s.Profile) == 0 {
+		s.Profile = rules.GetActiveProfile()
+	}
+	return rules.AddSource(s)
+}
+
+// RemoveRuleSource implements control.API.RemoveRuleSource
+func (server *Server) RemoveRuleSource(name string) error {
+	return rules.RemoveSource(name)
+}
+
+// ListProfiles implements control.API.ListProfiles
+func (server *Server) ListProfiles() ([]control.Profile, error) {
+	activeProfile := rules.GetActiveProfile()
+	ruleSets := rules.ListRuleSets()
+
+	result := make([]control.Profile, len(ruleSets))
+	for i, ruleSet := range ruleSets {
+		ruleList, err := ruleSet.ListRules()
+		if err != nil {
+			return nil, err
+		}
+		result[i].Name = ruleSet.Name
+		result[i].Active = ruleSet.Name == activeProfile
+		result[i].Rules = len(ruleList)
+	}
+	return result, nil
+}
+
+// UseProfile implements control.API.UseProfile
+func (server *Server) UseProfile(name string) error {
+	return rules.UseProfile(name)
 }
 
 // Run starts the Server and waits until the Server stops